@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/open-policy-agent/cert-controller/pkg/rotator"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/apis/v1alpha1"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/audit"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/controller"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/metrics"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/metrics/otlp"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/tracing"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/util"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/version"
 	wh "github.com/shiftavenue/azure-clientid-syncer/pkg/webhook"
@@ -36,10 +44,14 @@ var webhooks = []rotator.WebhookInfo{
 }
 
 const (
+	validatingWebhookConfigurationName = "azure-clientid-syncer-webhook-validating-webhook-configuration"
+
 	secretName     = "azure-clientid-syncer-webhook-server-cert" // #nosec
 	serviceName    = "azure-clientid-syncer-webhook-webhook-service"
 	caName         = "azure-clientid-syncer-ca"
 	caOrganization = "azure-clientid-syncer"
+	// leaderElectionID is the name of the lease held by the replica running the controllers and the inventory
+	leaderElectionID = "azure-clientid-syncer-webhook-leader"
 )
 
 var (
@@ -47,8 +59,17 @@ var (
 	healthAddr          string
 	metricsAddr         string
 	disableCertRotation bool
+	leaderElection      bool
 	metricsBackend      string
 	logLevel            int
+	validatingWebhook   bool
+	podWebhook          bool
+	tracingEndpoint     string
+	tracingInsecure     bool
+	tracingSampleRatio  float64
+	otlpConfig          otlp.Config
+	otlpHeaders         string
+	otlpAttributes      string
 
 	// DNSName is <service name>.<namespace>.svc
 	dnsName = fmt.Sprintf("%s.%s.svc", serviceName, util.GetNamespace())
@@ -59,6 +80,7 @@ var (
 
 func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
 }
 
 func main() {
@@ -70,9 +92,21 @@ func main() {
 func mainErr() error {
 	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "/certs", "Webhook certificates dir to use. Defaults to /certs")
 	flag.BoolVar(&disableCertRotation, "disable-cert-rotation", false, "disable automatic generation and rotation of webhook TLS certificates/keys")
+	flag.BoolVar(&leaderElection, "leader-elect", true, "run the controllers and the inventory only on the replica holding the leader lease, the webhooks are served by all replicas")
 	flag.StringVar(&healthAddr, "health-addr", ":9440", "The address the health endpoint binds to")
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8095", "The address the metrics endpoint binds to")
-	flag.StringVar(&metricsBackend, "metrics-backend", "prometheus", "Backend used for metrics")
+	flag.StringVar(&metricsBackend, "metrics-backend", "prometheus", "Backend used for metrics: prometheus or otlp")
+	flag.StringVar(&otlpConfig.Endpoint, "otlp-endpoint", "", "Endpoint of the OTLP collector the otlp metrics backend pushes to, e.g. otel-collector:4317")
+	flag.StringVar(&otlpConfig.Protocol, "otlp-protocol", otlp.ProtocolGRPC, "Protocol of the otlp metrics backend: grpc or http")
+	flag.BoolVar(&otlpConfig.Insecure, "otlp-insecure", false, "push metrics to the OTLP collector without TLS")
+	flag.StringVar(&otlpHeaders, "otlp-headers", "", "Comma separated key=value pairs sent as headers to the OTLP collector")
+	flag.DurationVar(&otlpConfig.Interval, "otlp-interval", time.Minute, "Interval in which metrics are pushed to the OTLP collector")
+	flag.StringVar(&otlpAttributes, "otlp-resource-attributes", "", "Comma separated key=value pairs added to the resource of the pushed metrics, e.g. k8s.cluster.name=prod")
+	flag.BoolVar(&validatingWebhook, "enable-validating-webhook", false, "enable the validating webhook verifying manually set identity annotations")
+	flag.BoolVar(&podWebhook, "enable-pod-webhook", false, "enable the pod mutating webhook injecting the workload identity configuration into pods")
+	flag.StringVar(&tracingEndpoint, "tracing-endpoint", "", "OTLP/gRPC endpoint spans are exported to, e.g. otel-collector:4317. Tracing is disabled if empty")
+	flag.BoolVar(&tracingInsecure, "tracing-insecure", false, "export spans without TLS")
+	flag.Float64Var(&tracingSampleRatio, "tracing-sample-ratio", 1, "ratio of the admission requests which are traced")
 	flag.IntVar(&logLevel, "log-level", 0,
 		"A zap log level should be multiplied by -1 to get the logr verbosity. For example, to get logr verbosity of 3, pass zapcore.Level(-3) to this Opts. See https://pkg.go.dev/github.com/go-logr/zapr for how zap level relates to logr verbosity.")
 	flag.Parse()
@@ -87,17 +121,45 @@ func mainErr() error {
 
 	// initialize metrics exporter before creating measurements
 	entryLog.Info("initializing metrics backend", "backend", metricsBackend)
-	if err := metrics.InitMetricsExporter(metricsBackend); err != nil {
+	var err error
+	if otlpConfig.Headers, err = otlp.ParseKeyValues(otlpHeaders); err != nil {
+		return fmt.Errorf("entrypoint: invalid --otlp-headers: %w", err)
+	}
+	if otlpConfig.ResourceAttributes, err = otlp.ParseKeyValues(otlpAttributes); err != nil {
+		return fmt.Errorf("entrypoint: invalid --otlp-resource-attributes: %w", err)
+	}
+	shutdownMetrics, err := metrics.InitMetricsExporter(ctx, metricsBackend, otlpConfig)
+	if err != nil {
 		return fmt.Errorf("entrypoint: failed to initialize metrics exporter: %w", err)
 	}
+	defer func() {
+		if err := shutdownMetrics(context.Background()); err != nil {
+			entryLog.Error(err, "failed to flush metrics")
+		}
+	}()
+
+	if tracingEndpoint != "" {
+		entryLog.Info("initializing tracing", "endpoint", tracingEndpoint)
+		shutdown, err := tracing.InitTracer(ctx, tracingEndpoint, tracingInsecure, tracingSampleRatio)
+		if err != nil {
+			return fmt.Errorf("entrypoint: failed to initialize tracing: %w", err)
+		}
+		defer func() {
+			if err := shutdown(context.Background()); err != nil {
+				entryLog.Error(err, "failed to flush spans")
+			}
+		}()
+	}
 
 	// log the user agent as it makes it easier to debug issues
 	entryLog.Info("setting up manager", "userAgent", config.UserAgent)
 	mgr, err := ctrl.NewManager(config, ctrl.Options{
-		Scheme:                 scheme,
-		LeaderElection:         false,
-		HealthProbeBindAddress: healthAddr,
-		Logger:                 kzap.New().WithName("manager"),
+		Scheme:                  scheme,
+		LeaderElection:          leaderElection,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: util.GetNamespace(),
+		HealthProbeBindAddress:  healthAddr,
+		Logger:                  kzap.New().WithName("manager"),
 		Metrics: metricsServer.Options{
 			BindAddress: metricsAddr,
 			CertDir:     webhookCertDir,
@@ -117,6 +179,12 @@ func mainErr() error {
 
 	// Make sure certs are generated and valid if cert rotation is enabled.
 	setupFinished := make(chan struct{})
+	if validatingWebhook {
+		webhooks = append(webhooks, rotator.WebhookInfo{
+			Name: validatingWebhookConfigurationName,
+			Type: rotator.Validating,
+		})
+	}
 	if !disableCertRotation {
 		entryLog.Info("setting up cert rotation")
 		if err := rotator.AddRotator(mgr, &rotator.CertRotator{
@@ -137,8 +205,30 @@ func mainErr() error {
 		close(setupFinished)
 	}
 
+	if err := controller.SetupServiceAccountReconciler(mgr, log); err != nil {
+		return fmt.Errorf("entrypoint: unable to set up serviceaccount controller: %w", err)
+	}
+
+	if err := controller.SetupIdentityBindingReconciler(mgr, log); err != nil {
+		return fmt.Errorf("entrypoint: unable to set up identitybinding controller: %w", err)
+	}
+
+	sharedClients, err := provider.SetupSharedClients(mgr, log)
+	if err != nil {
+		return fmt.Errorf("entrypoint: unable to set up shared clients: %w", err)
+	}
+
+	if err := provider.SetupInventory(mgr, log); err != nil {
+		return fmt.Errorf("entrypoint: unable to set up inventory: %w", err)
+	}
+
+	auditLogger, err := audit.Setup(mgr, log)
+	if err != nil {
+		return fmt.Errorf("entrypoint: unable to set up audit logger: %w", err)
+	}
+
 	setupProbeEndpoints(mgr, setupFinished)
-	go setupWebhook(mgr, setupFinished, log)
+	go setupWebhook(mgr, setupFinished, sharedClients, auditLogger, log)
 
 	entryLog.Info("starting manager")
 	if err := mgr.Start(ctx); err != nil {
@@ -148,7 +238,7 @@ func mainErr() error {
 	return nil
 }
 
-func setupWebhook(mgr manager.Manager, setupFinished chan struct{}, log logr.Logger) {
+func setupWebhook(mgr manager.Manager, setupFinished chan struct{}, sharedClients *provider.SharedClients, auditLogger *audit.Logger, log logr.Logger) {
 	// Block until the setup (certificate generation) finishes.
 	<-setupFinished
 
@@ -156,11 +246,27 @@ func setupWebhook(mgr manager.Manager, setupFinished chan struct{}, log logr.Log
 
 	// setup webhooks
 	entryLog.Info("registering webhook to the webhook server")
-	serviceAccountMutator, err := wh.NewServiceAccountMutator(mgr.GetClient(), mgr.GetAPIReader(), mgr.GetScheme(), log)
+	serviceAccountMutator, err := wh.NewServiceAccountMutator(mgr.GetClient(), mgr.GetAPIReader(), mgr.GetConfig(), mgr.GetHTTPClient(), mgr.GetEventRecorderFor("azure-clientid-syncer"), sharedClients, auditLogger, mgr.GetScheme(), log)
 	if err != nil {
 		panic(fmt.Errorf("unable to set up serviceaccount mutator: %w", err))
 	}
 	hookServer.Register("/mutate-v1-serviceaccount", &webhook.Admission{Handler: serviceAccountMutator})
+
+	if podWebhook {
+		podMutator, err := wh.NewPodMutator(mgr.GetClient(), mgr.GetScheme(), log)
+		if err != nil {
+			panic(fmt.Errorf("unable to set up pod mutator: %w", err))
+		}
+		hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: podMutator})
+	}
+
+	if validatingWebhook {
+		serviceAccountValidator, err := wh.NewServiceAccountValidator(mgr.GetClient(), mgr.GetConfig(), mgr.GetHTTPClient(), mgr.GetEventRecorderFor("azure-clientid-syncer"), sharedClients, mgr.GetScheme(), log)
+		if err != nil {
+			panic(fmt.Errorf("unable to set up serviceaccount validator: %w", err))
+		}
+		hookServer.Register("/validate-v1-serviceaccount", &webhook.Admission{Handler: serviceAccountValidator})
+	}
 }
 
 func setupProbeEndpoints(mgr ctrl.Manager, setupFinished chan struct{}) {
@@ -0,0 +1,142 @@
+// fake-otlp-collector is a stand-in for an OpenTelemetry collector, which accepts metrics pushed by the otlp metrics
+// backend via gRPC and HTTP and prints every received data point with its resource attributes, e.g.
+//
+//	fake-otlp-collector --grpc-addr :4317 --http-addr :4318
+//	manager --metrics-backend otlp --otlp-endpoint localhost:4317 --otlp-insecure --otlp-interval 5s
+//
+// It is meant for testing the metrics export without running a real collector.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	grpcAddr string
+	httpAddr string
+)
+
+type metricsService struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+}
+
+func (metricsService) Export(_ context.Context, req *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	printRequest("grpc", req)
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+func main() {
+	flag.StringVar(&grpcAddr, "grpc-addr", ":4317", "The address the OTLP/gRPC receiver binds to, disabled if empty")
+	flag.StringVar(&httpAddr, "http-addr", ":4318", "The address the OTLP/HTTP receiver binds to, disabled if empty")
+	flag.Parse()
+
+	errs := make(chan error, 2)
+	if grpcAddr != "" {
+		listener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		server := grpc.NewServer()
+		collectormetrics.RegisterMetricsServiceServer(server, metricsService{})
+		go func() { errs <- server.Serve(listener) }()
+	}
+	if httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v1/metrics", handleHTTP)
+		go func() { errs <- http.ListenAndServe(httpAddr, mux) }()
+	}
+	log.Fatalln(<-errs)
+}
+
+// handleHTTP accepts protobuf encoded export requests, JSON encoding isn't used by the Go exporter
+func handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &collectormetrics.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid export request: %s", err), http.StatusBadRequest)
+		return
+	}
+	printRequest("http", req)
+
+	data, err := proto.Marshal(&collectormetrics.ExportMetricsServiceResponse{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(data)
+}
+
+// printRequest writes a line for every data point of the request
+func printRequest(protocol string, req *collectormetrics.ExportMetricsServiceRequest) {
+	for _, resourceMetrics := range req.ResourceMetrics {
+		resource := attributes(resourceMetrics.GetResource().GetAttributes())
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, m := range scopeMetrics.Metrics {
+				for _, point := range dataPoints(m) {
+					fmt.Printf("%s resource={%s} %s{%s} %s\n", protocol, resource, m.Name, point.attributes, point.value)
+				}
+			}
+		}
+	}
+}
+
+type dataPoint struct {
+	attributes string
+	value      string
+}
+
+func dataPoints(m *metricsv1.Metric) []dataPoint {
+	var points []dataPoint
+	switch data := m.Data.(type) {
+	case *metricsv1.Metric_Sum:
+		for _, p := range data.Sum.DataPoints {
+			points = append(points, dataPoint{attributes(p.Attributes), numberValue(p)})
+		}
+	case *metricsv1.Metric_Gauge:
+		for _, p := range data.Gauge.DataPoints {
+			points = append(points, dataPoint{attributes(p.Attributes), numberValue(p)})
+		}
+	case *metricsv1.Metric_Histogram:
+		for _, p := range data.Histogram.DataPoints {
+			points = append(points, dataPoint{attributes(p.Attributes), fmt.Sprintf("count=%d sum=%g", p.Count, p.GetSum())})
+		}
+	}
+	return points
+}
+
+func numberValue(p *metricsv1.NumberDataPoint) string {
+	if _, ok := p.Value.(*metricsv1.NumberDataPoint_AsInt); ok {
+		return fmt.Sprint(p.GetAsInt())
+	}
+	return fmt.Sprint(p.GetAsDouble())
+}
+
+func attributes(kvs []*commonv1.KeyValue) string {
+	var pairs []string
+	for _, kv := range kvs {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", kv.Key, kv.Value.GetStringValue()))
+	}
+	return strings.Join(pairs, ",")
+}
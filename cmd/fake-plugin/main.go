@@ -0,0 +1,122 @@
+// fake-plugin is a reference implementation of the provider plugin protocol. It answers queries from a static
+// JSON file mapping "<namespace>/<name>" of service accounts to the plugin response, e.g.
+//
+//	{"default/app": {"annotations": {"example.com/role": "app"}, "identity": {"resourceID": "roles/app", "clientID": "app"}, "warnings": ["role app is deprecated"]}}
+//
+// It is meant for testing the webhook and as a starting point for real plugins.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/plugin"
+)
+
+var (
+	addr        string
+	mappingFile string
+	unhealthy   bool
+	apiVersion  string
+	delay       time.Duration
+)
+
+// mapping is the response for a single service account
+type mapping struct {
+	Annotations map[string]string `json:"annotations"`
+	Identity    *plugin.Identity  `json:"identity"`
+	Warnings    []string          `json:"warnings"`
+}
+
+func main() {
+	flag.StringVar(&addr, "addr", ":8080", "The address the plugin binds to")
+	flag.StringVar(&mappingFile, "mapping-file", "mappings.json", "JSON file mapping <namespace>/<name> of service accounts to annotations")
+	flag.BoolVar(&unhealthy, "unhealthy", false, "report the plugin as unhealthy, e.g. to test the health checks of the webhook")
+	flag.StringVar(&apiVersion, "api-version", plugin.APIVersion, "the protocol version of the responses, e.g. to test the version check of the webhook")
+	flag.DurationVar(&delay, "delay", 0, "delay every response, e.g. to test the plugin timeout of the webhook")
+	flag.Parse()
+
+	data, err := os.ReadFile(mappingFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	mappings := map[string]mapping{}
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		log.Fatalln(fmt.Errorf("invalid mapping file: %w", err))
+	}
+
+	log.Printf("serving %d mappings on %s", len(mappings), addr)
+	log.Fatalln(http.ListenAndServe(addr, &fakePlugin{mappings: mappings, unhealthy: unhealthy, apiVersion: apiVersion, delay: delay}))
+}
+
+// fakePlugin serves the plugin protocol from the mappings
+type fakePlugin struct {
+	mappings   map[string]mapping
+	unhealthy  bool
+	apiVersion string
+	delay      time.Duration
+}
+
+func (p *fakePlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-time.After(p.delay):
+	case <-r.Context().Done():
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/query":
+		req, ok := decode(w, r)
+		if !ok {
+			return
+		}
+		m := p.mappings[req.ServiceAccount.Namespace+"/"+req.ServiceAccount.Name]
+		encode(w, plugin.QueryResponse{APIVersion: p.apiVersion, Annotations: m.Annotations, Identity: m.Identity, Warnings: m.Warnings})
+	case "/v1/verify":
+		req, ok := decode(w, r)
+		if !ok {
+			return
+		}
+		var problems []string
+		for key, value := range req.ServiceAccount.Annotations {
+			expected, ok := p.mappings[req.ServiceAccount.Namespace+"/"+req.ServiceAccount.Name].Annotations[key]
+			if ok && expected != value {
+				problems = append(problems, fmt.Sprintf("annotation %s is %s, expected %s", key, value, expected))
+			}
+		}
+		encode(w, plugin.VerifyResponse{APIVersion: p.apiVersion, Problems: problems})
+	case "/v1/health":
+		status := plugin.HealthStatusOK
+		if p.unhealthy {
+			status = "unhealthy"
+		}
+		encode(w, plugin.HealthResponse{APIVersion: p.apiVersion, Status: status})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func decode(w http.ResponseWriter, r *http.Request) (*plugin.QueryRequest, bool) {
+	req := &plugin.QueryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if req.APIVersion != plugin.APIVersion {
+		http.Error(w, "unsupported API version "+req.APIVersion, http.StatusBadRequest)
+		return nil, false
+	}
+	return req, true
+}
+
+func encode(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/plugin"
+)
+
+var testMappings = map[string]mapping{
+	"default/app": {
+		Annotations: map[string]string{"example.com/role": "app"},
+		Identity:    &plugin.Identity{ResourceID: "roles/app", ClientID: "app"},
+		Warnings:    []string{"role app is deprecated"},
+	},
+}
+
+func newTestPlugin(t *testing.T, p *fakePlugin) *httptest.Server {
+	if p.apiVersion == "" {
+		p.apiVersion = plugin.APIVersion
+	}
+	p.mappings = testMappings
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		name            string
+		plugin          *fakePlugin
+		serviceAccount  plugin.ServiceAccount
+		wantAnnotations map[string]string
+		wantWarnings    []string
+		wantErr         string
+	}{
+		{
+			name:            "mapped service account",
+			plugin:          &fakePlugin{},
+			serviceAccount:  plugin.ServiceAccount{Name: "app", Namespace: "default"},
+			wantAnnotations: map[string]string{"example.com/role": "app"},
+			wantWarnings:    []string{"role app is deprecated"},
+		},
+		{
+			name:           "unknown service account",
+			plugin:         &fakePlugin{},
+			serviceAccount: plugin.ServiceAccount{Name: "other", Namespace: "default"},
+		},
+		{
+			name:           "version mismatch",
+			plugin:         &fakePlugin{apiVersion: "plugin.azure.clientid.syncer/v2"},
+			serviceAccount: plugin.ServiceAccount{Name: "app", Namespace: "default"},
+			wantErr:        "unsupported plugin API version",
+		},
+		{
+			name:           "timeout",
+			plugin:         &fakePlugin{delay: time.Second},
+			serviceAccount: plugin.ServiceAccount{Name: "app", Namespace: "default"},
+			wantErr:        "Client.Timeout exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := plugin.NewClient(newTestPlugin(t, tt.plugin).URL, 100*time.Millisecond)
+
+			response, err := client.Query(context.Background(), plugin.QueryRequest{ServiceAccount: tt.serviceAccount})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(response.Annotations, tt.wantAnnotations) {
+				t.Errorf("expected annotations %v, got %v", tt.wantAnnotations, response.Annotations)
+			}
+			if !reflect.DeepEqual(response.Warnings, tt.wantWarnings) {
+				t.Errorf("expected warnings %v, got %v", tt.wantWarnings, response.Warnings)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	client := plugin.NewClient(newTestPlugin(t, &fakePlugin{}).URL, time.Second)
+
+	response, err := client.Verify(context.Background(), plugin.QueryRequest{ServiceAccount: plugin.ServiceAccount{
+		Name:        "app",
+		Namespace:   "default",
+		Annotations: map[string]string{"example.com/role": "other"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(response.Problems) != 1 {
+		t.Errorf("expected one problem, got %v", response.Problems)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		name    string
+		plugin  *fakePlugin
+		wantErr bool
+	}{
+		{name: "healthy", plugin: &fakePlugin{}},
+		{name: "unhealthy", plugin: &fakePlugin{unhealthy: true}, wantErr: true},
+		{name: "version mismatch", plugin: &fakePlugin{apiVersion: "plugin.azure.clientid.syncer/v2"}, wantErr: true},
+		{name: "timeout", plugin: &fakePlugin{delay: time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := map[string]*plugin.Client{"fake": plugin.NewClient(newTestPlugin(t, tt.plugin).URL, time.Second)}
+			checker := plugin.NewHealthChecker(clients, time.Hour, 100*time.Millisecond, logr.Discard())
+
+			// the first probe runs when the checker starts
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_ = checker.Start(ctx)
+			}()
+			deadline := time.Now().Add(5 * time.Second)
+			for tt.wantErr && checker.Err("fake") == nil && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !tt.wantErr {
+				time.Sleep(200 * time.Millisecond)
+			}
+			cancel()
+			<-done
+
+			if err := checker.Err("fake"); (err != nil) != tt.wantErr {
+				t.Errorf("expected unhealthy %t, got error %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterIdentityPolicySpec restricts the identities which may be annotated on service accounts in the selected namespaces.
+// An identity is allowed if it matches any of the rules of every policy selecting the namespace.
+type ClusterIdentityPolicySpec struct {
+	// Namespaces selects namespaces by name
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector selects namespaces by labels
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Rules lists the allowed identities. A policy without rules denies all identities.
+	// +optional
+	Rules []IdentityPolicyRule `json:"rules,omitempty"`
+}
+
+// IdentityPolicyRule matches an identity if all of its non-empty fields match
+type IdentityPolicyRule struct {
+	// Providers the rule applies to, e.g. azure or gcp. Applies to all providers if empty.
+	// +optional
+	Providers []string `json:"providers,omitempty"`
+	// TenantIDs of the allowed Azure identities
+	// +optional
+	TenantIDs []string `json:"tenantIDs,omitempty"`
+	// SubscriptionIDs of the allowed Azure identities
+	// +optional
+	SubscriptionIDs []string `json:"subscriptionIDs,omitempty"`
+	// ResourceGroups of the allowed Azure identities
+	// +optional
+	ResourceGroups []string `json:"resourceGroups,omitempty"`
+	// Projects of the allowed GCP service accounts
+	// +optional
+	Projects []string `json:"projects,omitempty"`
+	// Tags the allowed identities must carry. The special value <NAMESPACE> is replaced with the namespace of the service account.
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// ClusterIdentityPolicy restricts which identities the service accounts of a namespace may claim
+type ClusterIdentityPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ClusterIdentityPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterIdentityPolicyList contains a list of ClusterIdentityPolicy
+type ClusterIdentityPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterIdentityPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterIdentityPolicy{}, &ClusterIdentityPolicyList{})
+}
@@ -0,0 +1,77 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// IdentityBindingConditionBound is true if the binding has been applied to at least one service account
+	IdentityBindingConditionBound = "Bound"
+)
+
+// IdentityBindingSpec defines the identities which are annotated on the selected service accounts
+type IdentityBindingSpec struct {
+	// ServiceAccountSelector selects the service accounts in the namespace of the binding
+	ServiceAccountSelector ServiceAccountSelector `json:"serviceAccountSelector"`
+
+	// AzureClientID is annotated as azure.workload.identity/client-id
+	// +optional
+	AzureClientID string `json:"azureClientID,omitempty"`
+	// AzureTenantID is annotated as azure.workload.identity/tenant-id
+	// +optional
+	AzureTenantID string `json:"azureTenantID,omitempty"`
+	// GCPServiceAccount is the email of the GCP service account annotated as iam.gke.io/gcp-service-account
+	// +optional
+	GCPServiceAccount string `json:"gcpServiceAccount,omitempty"`
+	// AWSRoleARN is annotated as eks.amazonaws.com/role-arn
+	// +optional
+	AWSRoleARN string `json:"awsRoleARN,omitempty"`
+}
+
+// ServiceAccountSelector selects service accounts by name or by labels. A service account is selected if it matches any of both.
+type ServiceAccountSelector struct {
+	// Names of the selected service accounts
+	// +optional
+	Names []string `json:"names,omitempty"`
+	// LabelSelector selects service accounts by labels
+	// +optional
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+}
+
+// IdentityBindingStatus defines the observed state of IdentityBinding
+type IdentityBindingStatus struct {
+	// BoundServiceAccounts lists the names of the service accounts which have been annotated by this binding
+	// +optional
+	BoundServiceAccounts []string `json:"boundServiceAccounts,omitempty"`
+	// Conditions of the binding
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Client ID",type=string,JSONPath=`.spec.azureClientID`
+// +kubebuilder:printcolumn:name="GCP Service Account",type=string,JSONPath=`.spec.gcpServiceAccount`
+// +kubebuilder:printcolumn:name="Bound",type=string,JSONPath=`.status.conditions[?(@.type=="Bound")].status`
+
+// IdentityBinding declares the identities of service accounts explicitly instead of discovering them in the cloud
+type IdentityBinding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IdentityBindingSpec   `json:"spec,omitempty"`
+	Status IdentityBindingStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IdentityBindingList contains a list of IdentityBinding
+type IdentityBindingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IdentityBinding `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IdentityBinding{}, &IdentityBindingList{})
+}
@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+)
+
+const (
+	// APIVersion and Kind identify audit events, e.g. to tell them apart from other log lines on stdout
+	APIVersion = "audit.azure.clientid.syncer/v1"
+	Kind       = "MutationEvent"
+
+	// PolicyAllowed and PolicyDenied are the policy decisions on the identity found by a provider
+	PolicyAllowed = "allowed"
+	PolicyDenied  = "denied"
+)
+
+// Event describes a single mutation decision of the service account webhook
+type Event struct {
+	APIVersion     string         `json:"apiVersion"`
+	Kind           string         `json:"kind"`
+	Time           time.Time      `json:"time"`
+	RequestUID     string         `json:"requestUID"`
+	Operation      string         `json:"operation"`
+	DryRun         bool           `json:"dryRun,omitempty"`
+	User           User           `json:"user"`
+	ServiceAccount ServiceAccount `json:"serviceAccount"`
+	// Providers are the decisions of all configured providers in order
+	Providers []Provider `json:"providers,omitempty"`
+	// Allowed is false if the request was rejected, Error describes why
+	Allowed bool   `json:"allowed"`
+	Error   string `json:"error,omitempty"`
+	// LatencySeconds is the time it took to handle the request
+	LatencySeconds float64 `json:"latencySeconds"`
+}
+
+// User is the user which sent the admission request
+type User struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+type ServiceAccount struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Provider describes the decision of a single provider
+type Provider struct {
+	Provider string `json:"provider"`
+	Outcome  string `json:"outcome"`
+	// Candidates are the resource IDs of the candidate identities the provider considered
+	Candidates []string  `json:"candidates,omitempty"`
+	Identity   *Identity `json:"identity,omitempty"`
+	// Policy is the decision of the identity policies, it is empty if no policy was evaluated
+	Policy      string            `json:"policy,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// Identity is the identity chosen by a provider
+type Identity struct {
+	ResourceID string `json:"resourceID,omitempty"`
+	ClientID   string `json:"clientID,omitempty"`
+	TenantID   string `json:"tenantID,omitempty"`
+}
+
+// redact replaces the given fields of the event by hashes, which can still be correlated between events.
+// Identities are also replaced in the error messages, e.g. of policy denials.
+func (e *Event) redact(fields []string) {
+	if slices.Contains(fields, config.AuditRedactUser) {
+		e.User = User{Username: hash(e.User.Username), UID: hash(e.User.UID)}
+	}
+	// the providers are shared with the caller, which may still use the unredacted event
+	e.Providers = slices.Clone(e.Providers)
+	var identities []string
+	for i := range e.Providers {
+		p := &e.Providers[i]
+		if slices.Contains(fields, config.AuditRedactIdentity) {
+			if p.Candidates != nil {
+				identities = append(identities, p.Candidates...)
+				candidates := make([]string, len(p.Candidates))
+				for j, candidate := range p.Candidates {
+					candidates[j] = hash(candidate)
+				}
+				p.Candidates = candidates
+			}
+			if p.Identity != nil {
+				identities = append(identities, p.Identity.ResourceID, p.Identity.ClientID, p.Identity.TenantID)
+				p.Identity = &Identity{ResourceID: hash(p.Identity.ResourceID), ClientID: hash(p.Identity.ClientID), TenantID: hash(p.Identity.TenantID)}
+			}
+		}
+		if slices.Contains(fields, config.AuditRedactAnnotations) && p.Annotations != nil {
+			annotations := make(map[string]string, len(p.Annotations))
+			for key, value := range p.Annotations {
+				annotations[key] = hash(value)
+			}
+			p.Annotations = annotations
+		}
+	}
+	if len(identities) == 0 {
+		return
+	}
+	// longer values first, so that an ID isn't partially replaced by a value it contains
+	sort.Slice(identities, func(i, j int) bool {
+		if len(identities[i]) != len(identities[j]) {
+			return len(identities[i]) > len(identities[j])
+		}
+		return identities[i] < identities[j]
+	})
+	var replacements []string
+	for _, identity := range slices.Compact(identities) {
+		if identity != "" {
+			replacements = append(replacements, identity, hash(identity))
+		}
+	}
+	replacer := strings.NewReplacer(replacements...)
+	e.Error = replacer.Replace(e.Error)
+	for i := range e.Providers {
+		e.Providers[i].Error = replacer.Replace(e.Providers[i].Error)
+	}
+}
+
+// hash returns a shortened SHA-256 hash of the value, empty values stay empty
+func hash(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:])[:16]
+}
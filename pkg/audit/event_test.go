@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+)
+
+const (
+	testResourceID = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/app"
+	testClientID   = "00000000-0000-0000-0000-000000000001"
+)
+
+// newTestEvent returns an event with every field which can be redacted
+func newTestEvent() Event {
+	return Event{
+		RequestUID: "uid",
+		User:       User{Username: "alice", UID: "user-uid", Groups: []string{"admins"}},
+		Providers: []Provider{
+			{
+				Provider:    "azure",
+				Outcome:     "matched",
+				Candidates:  []string{testResourceID, "/other"},
+				Identity:    &Identity{ResourceID: testResourceID, ClientID: testClientID},
+				Annotations: map[string]string{"azure.workload.identity/client-id": testClientID},
+			},
+			{
+				Provider: "gcp",
+				Outcome:  "denied",
+				Error:    "policy p does not allow identity " + testResourceID + " in namespace default",
+			},
+		},
+		Allowed: true,
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		want   func(e *Event)
+	}{
+		{
+			name: "nothing",
+			want: func(e *Event) {},
+		},
+		{
+			name:   "user",
+			fields: []string{config.AuditRedactUser},
+			want: func(e *Event) {
+				e.User = User{Username: hash("alice"), UID: hash("user-uid")}
+			},
+		},
+		{
+			name:   "identity",
+			fields: []string{config.AuditRedactIdentity},
+			want: func(e *Event) {
+				e.Providers[0].Candidates = []string{hash(testResourceID), hash("/other")}
+				e.Providers[0].Identity = &Identity{ResourceID: hash(testResourceID), ClientID: hash(testClientID)}
+				e.Providers[1].Error = "policy p does not allow identity " + hash(testResourceID) + " in namespace default"
+			},
+		},
+		{
+			name:   "annotations",
+			fields: []string{config.AuditRedactAnnotations},
+			want: func(e *Event) {
+				e.Providers[0].Annotations = map[string]string{"azure.workload.identity/client-id": hash(testClientID)}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, want := newTestEvent(), newTestEvent()
+			tt.want(&want)
+
+			event.redact(tt.fields)
+			if !reflect.DeepEqual(event, want) {
+				t.Errorf("expected %+v, got %+v", want, event)
+			}
+		})
+	}
+}
+
+func TestRecordRedactsAllFields(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := &Logger{
+		redact: []string{config.AuditRedactUser, config.AuditRedactIdentity, config.AuditRedactAnnotations},
+		logger: logr.Discard(),
+		out:    out,
+	}
+	event := newTestEvent()
+	l.Record(event)
+
+	line := out.String()
+	for _, value := range []string{"alice", "user-uid", "admins", testResourceID, testClientID} {
+		if strings.Contains(line, value) {
+			t.Errorf("expected %q to be redacted, got %s", value, line)
+		}
+	}
+	// the caller's event isn't modified
+	if event.User.Username != "alice" || event.Providers[0].Identity.ResourceID != testResourceID || event.Providers[0].Annotations["azure.workload.identity/client-id"] != testClientID {
+		t.Errorf("expected the recorded event to be left unchanged, got %+v", event)
+	}
+
+	var recorded Event
+	if err := json.Unmarshal(bytes.TrimSpace(out.Bytes()), &recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded.APIVersion != APIVersion || recorded.Kind != Kind {
+		t.Errorf("expected %s %s, got %s %s", APIVersion, Kind, recorded.APIVersion, recorded.Kind)
+	}
+	if recorded.Providers[0].Identity.ResourceID != hash(testResourceID) {
+		t.Errorf("expected hashes to be correlatable, got %s", recorded.Providers[0].Identity.ResourceID)
+	}
+}
+
+func TestHash(t *testing.T) {
+	if hash("") != "" {
+		t.Error("expected empty values to stay empty")
+	}
+	if hash("a") != hash("a") || hash("a") == hash("b") {
+		t.Error("expected stable, distinct hashes")
+	}
+	if !strings.HasPrefix(hash("a"), "sha256:") || len(hash("a")) != len("sha256:")+16 {
+		t.Errorf("unexpected hash format %s", hash("a"))
+	}
+}
@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// webhookQueueSize limits the events waiting to be sent to the audit webhook, further events are dropped
+const webhookQueueSize = 1000
+
+// Logger writes audit events as JSON lines and posts them to the audit webhook. Events are sent to the webhook in the
+// background by the manager, so a slow webhook doesn't delay admission requests. A nil Logger discards all events.
+type Logger struct {
+	redact []string
+	logger logr.Logger
+
+	mu  sync.Mutex
+	out io.Writer
+
+	webhookURL string
+	httpClient *http.Client
+	queue      chan []byte
+}
+
+// Setup creates the audit logger and adds the webhook sender to the manager. It returns nil if auditing is disabled.
+func Setup(mgr manager.Manager, logger logr.Logger) (*Logger, error) {
+	c, err := config.ParseConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c.AuditLogOutput == "" && c.AuditWebhookURL == "" {
+		return nil, nil
+	}
+
+	l := &Logger{
+		redact: c.AuditRedact,
+		logger: logger.WithName("audit"),
+	}
+	switch c.AuditLogOutput {
+	case "":
+	case "stdout":
+		l.out = os.Stdout
+	default:
+		file, err := os.OpenFile(c.AuditLogOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		l.out = file
+	}
+	if c.AuditWebhookURL != "" {
+		l.webhookURL = c.AuditWebhookURL
+		l.httpClient = &http.Client{Timeout: c.AuditWebhookTimeout}
+		l.queue = make(chan []byte, webhookQueueSize)
+		if err := mgr.Add(l); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Record redacts the event and writes it to all sinks. Failures are logged, but never fail the request.
+func (l *Logger) Record(event Event) {
+	if l == nil {
+		return
+	}
+	event.APIVersion, event.Kind = APIVersion, Kind
+	event.redact(l.redact)
+	data, err := json.Marshal(event)
+	if err != nil {
+		l.logger.Error(err, "failed to marshal audit event", "requestUID", event.RequestUID)
+		return
+	}
+
+	if l.out != nil {
+		l.mu.Lock()
+		_, err = l.out.Write(append(data, '\n'))
+		l.mu.Unlock()
+		if err != nil {
+			l.logger.Error(err, "failed to write audit event", "requestUID", event.RequestUID)
+		}
+	}
+	if l.queue != nil {
+		select {
+		case l.queue <- data:
+		default:
+			l.logger.Error(nil, "audit webhook queue is full, dropping audit event", "requestUID", event.RequestUID)
+		}
+	}
+}
+
+// Start posts the queued events to the audit webhook until the context is done
+func (l *Logger) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case data := <-l.queue:
+			if err := l.post(ctx, data); err != nil {
+				l.logger.Error(err, "failed to send audit event to webhook")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection is false, as the queue only holds the events recorded by this replica
+func (l *Logger) NeedLeaderElection() bool {
+	return false
+}
+
+func (l *Logger) post(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.webhookURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
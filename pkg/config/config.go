@@ -2,24 +2,156 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/expression"
 )
 
+const (
+	// ValidationModeWarn returns mismatching identity annotations as warnings
+	ValidationModeWarn = "warn"
+	// ValidationModeDeny rejects service accounts with mismatching identity annotations
+	ValidationModeDeny = "deny"
+
+	// AuditRedactUser replaces the user name and UID in audit events by a hash and drops the groups
+	AuditRedactUser = "user"
+	// AuditRedactIdentity replaces the resource IDs, client IDs and tenant IDs in audit events by a hash
+	AuditRedactIdentity = "identity"
+	// AuditRedactAnnotations replaces the values of the annotations in audit events by a hash
+	AuditRedactAnnotations = "annotations"
+)
+
+var auditRedactFields = []string{AuditRedactUser, AuditRedactIdentity, AuditRedactAnnotations}
+
 // Config holds configuration from the env variables
 type Config struct {
-	TenantID                string `envconfig:"AZURE_TENANT_ID"`
-	AutoDetectOidcIssuerUrl bool   `envconfig:"AUTO_DETECT_OIDC_ISSUER_URL"`
-	OidcIssuerUrl           string `envconfig:"OIDC_ISSUER_URL"`
+	TenantID string `envconfig:"AZURE_TENANT_ID"`
+	// ordered list of tenants to search for identities, e.g. 'export AZURE_TENANT_IDS="<tenant-a>,<tenant-b>"'. Defaults to AZURE_TENANT_ID.
+	TenantIDs []string `envconfig:"AZURE_TENANT_IDS"`
+	// client IDs of the webhook identity per tenant, e.g. 'export AZURE_TENANT_CLIENT_IDS="<tenant-b>:<client-id>"'.
+	// Tenants without an entry use the default credential chain (e.g. a multi-tenant app registration via AZURE_CLIENT_ID).
+	TenantClientIDs         map[string]string `envconfig:"AZURE_TENANT_CLIENT_IDS"`
+	AutoDetectOidcIssuerUrl bool              `envconfig:"AUTO_DETECT_OIDC_ISSUER_URL"`
+	OidcIssuerUrl           string            `envconfig:"OIDC_ISSUER_URL"`
+	// audiences of which at least one must be configured on a federated identity credential, credentials with other audiences are reported as mismatch
+	FederatedCredentialAudiences []string `envconfig:"AZURE_FEDERATED_CREDENTIAL_AUDIENCES" default:"api://AzureADTokenExchange"`
+	// creates a federated identity credential on the managed identity designated by the service account annotations
+	// 'azure.clientid.syncer/identity-resource-id' or 'azure.clientid.syncer/identity-selector' if none trusts the service account yet
+	AzureProvisioningEnabled bool `envconfig:"AZURE_PROVISIONING_ENABLED"`
+	// glob patterns of the resource IDs of the managed identities on which federated identity credentials may be provisioned,
+	// matched case-insensitively, e.g. 'export AZURE_IDENTITY_ALLOWLIST="/subscriptions/*/resourceGroups/team-*/providers/Microsoft.ManagedIdentity/userAssignedIdentities/*"'.
+	// Identities which don't match may only be provisioned in namespaces selected by an identity policy.
+	AzureIdentityAllowlist []string `envconfig:"AZURE_IDENTITY_ALLOWLIST"`
+	// prefix of the names of provisioned federated identity credentials, used to recognize them on cleanup
+	FederatedCredentialPrefix string `envconfig:"AZURE_FEDERATED_CREDENTIAL_PREFIX" default:"azure-clientid-syncer"`
+	// keeps provisioned federated identity credentials when their service account is deleted and only logs the deletion
+	CleanupDryRun bool `envconfig:"CLEANUP_DRY_RUN"`
+	// interval in which the federated identity credentials trusting the cluster issuer are compared with the service accounts
+	// of the cluster and exported as inventory metrics, 0 disables the inventory
+	InventoryInterval time.Duration `envconfig:"INVENTORY_INTERVAL"`
+	// exports every inventory finding with its service account, client ID and identity instead of the number of findings
+	// per namespace. The number of series grows with the service accounts, and the identities aren't redacted.
+	InventoryDetailedMetrics bool `envconfig:"INVENTORY_DETAILED_METRICS"`
+	// overrides the Azure Resource Manager endpoint, e.g. to run against a fake ARM server
+	ResourceManagerEndpoint string `envconfig:"AZURE_RESOURCE_MANAGER_ENDPOINT"`
+	// restricts the search to the given subscriptions instead of all subscriptions visible to the webhook identity.
+	// Entries of the form '<tenant-id>:<subscription-id>' only apply to that tenant, plain subscription IDs are searched
+	// in every tenant which can see them.
+	SubscriptionIDs []string `envconfig:"AZURE_SUBSCRIPTION_IDS"`
 	// add filter tags here via 'export FILTER_TAGS="aks-clientid-syncer:true"'.
 	// There are also two special tags: <NAMESPACE> and <SERVICE_ACCOUNT_NAME> which will be replaced with the actual values of the mutation request during runtime.
 	GcpProjectId string `envconfig:"GCP_PROJECT_ID"`
+	// ordered list of scopes to search for GCP service accounts, e.g. 'export GCP_SCOPES="projects/identities,folders/123,organizations/456"'.
+	// The first scope containing a matching service account wins. Defaults to projects/<GCP_PROJECT_ID>.
+	GcpScopes []string `envconfig:"GCP_SCOPES"`
+	// project of the workload identity pool '<project>.svc.id.goog' of the cluster. Defaults to GCP_PROJECT_ID.
+	GcpWorkloadIdentityPoolProject string `envconfig:"GCP_WORKLOAD_IDENTITY_POOL_PROJECT"`
+	// ID of the workload identity pool of a fleet ('<fleet-project>.svc.id.goog') or of a custom Workload Identity Federation pool.
+	// The service accounts are then matched as principal:// members instead of the members of GKE's default pool.
+	GcpWorkloadIdentityPool string `envconfig:"GCP_WORKLOAD_IDENTITY_POOL"`
+	// project number of the project containing GCP_WORKLOAD_IDENTITY_POOL
+	GcpWorkloadIdentityPoolProjectNumber string `envconfig:"GCP_WORKLOAD_IDENTITY_POOL_PROJECT_NUMBER"`
+	// ID of the provider in GCP_WORKLOAD_IDENTITY_POOL. If set, the credential configuration annotations required by non-GKE clusters are added.
+	GcpWorkloadIdentityProvider string `envconfig:"GCP_WORKLOAD_IDENTITY_PROVIDER"`
+	// interval in which the workload identity user bindings of GCP_SCOPES are cached, 0 disables the cache
+	GcpCacheRefreshInterval time.Duration `envconfig:"GCP_CACHE_REFRESH_INTERVAL" default:"5m"`
+	// grants the workload identity user role on the GCP service account requested by the service account annotation 'azure.clientid.syncer/gcp-service-account'
+	GcpProvisioningEnabled bool `envconfig:"GCP_PROVISIONING_ENABLED"`
+	// glob patterns of the GCP service accounts which may be requested, e.g. 'export GCP_SERVICE_ACCOUNT_ALLOWLIST="*@my-project.iam.gserviceaccount.com"'
+	GcpServiceAccountAllowlist []string `envconfig:"GCP_SERVICE_ACCOUNT_ALLOWLIST"`
+
+	// ARN of the RRSA OIDC provider of the cluster, e.g. 'acs:ram::<account>:oidc-provider/ack-rrsa-<cluster-id>'
+	AlibabaOidcProviderArn string `envconfig:"ALIBABA_OIDC_PROVIDER_ARN"`
+	// endpoints of the RAM and STS APIs, e.g. to run against a local fake RAM API
+	AlibabaRAMEndpoint string `envconfig:"ALIBABA_RAM_ENDPOINT" default:"https://ram.aliyuncs.com"`
+	AlibabaSTSEndpoint string `envconfig:"ALIBABA_STS_ENDPOINT" default:"https://sts.aliyuncs.com"`
+
+	// address of the Vault server, e.g. 'https://vault.example.com:8200'
+	VaultAddress string `envconfig:"VAULT_ADDR"`
+	// Vault Enterprise namespace of the auth mounts
+	VaultNamespace string `envconfig:"VAULT_NAMESPACE"`
+	// ordered list of Kubernetes or JWT auth mounts to search for roles bound to the service account
+	VaultAuthMounts []string `envconfig:"VAULT_AUTH_MOUNTS" default:"kubernetes"`
+	// token of the webhook, alternatively the webhook logs in with its service account to VAULT_LOGIN_ROLE of VAULT_LOGIN_MOUNT
+	VaultToken      string `envconfig:"VAULT_TOKEN"`
+	VaultLoginRole  string `envconfig:"VAULT_LOGIN_ROLE"`
+	VaultLoginMount string `envconfig:"VAULT_LOGIN_MOUNT" default:"kubernetes"`
+
+	// external provider plugins by name, e.g. 'export PLUGIN_ENDPOINTS="ldap:http://ldap-plugin:8080"'.
+	// A plugin is used like a built-in provider by adding its name to PROVIDER_TYPES.
+	PluginEndpoints map[string]string `envconfig:"PLUGIN_ENDPOINTS"`
+	// timeout of every plugin call
+	PluginTimeout time.Duration `envconfig:"PLUGIN_TIMEOUT" default:"5s"`
+	// interval in which the health of the plugins is probed
+	PluginHealthInterval time.Duration `envconfig:"PLUGIN_HEALTH_INTERVAL" default:"30s"`
+
+	// YAML or JSON file mapping namespace and service account patterns to annotations, used by the static provider.
+	// The file is reloaded whenever it changes.
+	StaticMappingFile string `envconfig:"STATIC_MAPPING_FILE"`
 
 	FilterTags map[string]string `envconfig:"FILTER_TAGS"`
 	// acts as a prefix for the tags in the azure portal allowing multi tenancy
 	ClusterIdentifier string `envconfig:"CLUSTER_IDENTIFIER"`
 
 	ProviderType string `envconfig:"PROVIDER_TYPE" default:"azure"`
+	// ordered list of providers used for every service account, e.g. 'export PROVIDER_TYPES="azure,gcp"'. Defaults to PROVIDER_TYPE.
+	ProviderTypes []string `envconfig:"PROVIDER_TYPES"`
+	// runs the providers in parallel instead of one after another
+	ProviderParallel bool `envconfig:"PROVIDER_PARALLEL"`
+	// only runs a provider if the service account is labeled with 'azure.clientid.syncer/provider-<type>: "true"'
+	ProviderOptIn bool `envconfig:"PROVIDER_OPT_IN"`
+
+	// list of settings which may be overridden by namespace annotations, e.g. 'export NAMESPACE_OVERRIDE_ALLOWLIST="tenant-id,filter-tags"'.
+	// Overrides are disabled if the list is empty.
+	NamespaceOverrideAllowlist []string `envconfig:"NAMESPACE_OVERRIDE_ALLOWLIST"`
+
+	// optional CEL expression filtering candidate identities, e.g. 'export MATCH_EXPRESSION="identity.tags[\"env\"] == namespaceObject.labels[\"env\"]"'.
+	// The expression has access to the variables serviceAccount, namespaceObject and identity and must evaluate to a bool.
+	MatchExpression string `envconfig:"MATCH_EXPRESSION"`
+	// optional CEL expression ranking candidate identities, the candidate with the highest rank wins.
+	// It has access to the same variables as MATCH_EXPRESSION and must evaluate to a number.
+	RankExpression string `envconfig:"RANK_EXPRESSION"`
+	matchProgram   *expression.Program
+	rankProgram    *expression.Program
+
+	// mode of the validating webhook: 'warn' returns mismatching identity annotations as warnings, 'deny' rejects the service account
+	ValidationMode string `envconfig:"VALIDATION_MODE" default:"warn"`
+
+	// enforces ClusterIdentityPolicy resources on every identity before it is annotated. Requires the ClusterIdentityPolicy CRD.
+	IdentityPolicyEnabled bool `envconfig:"IDENTITY_POLICY_ENABLED"`
+
+	// writes an audit event for every mutation decision as JSON line to 'stdout' or the given file. Disabled if empty.
+	AuditLogOutput string `envconfig:"AUDIT_LOG_OUTPUT"`
+	// additionally posts every audit event as JSON to this URL
+	AuditWebhookURL string `envconfig:"AUDIT_WEBHOOK_URL"`
+	// timeout of every audit webhook call
+	AuditWebhookTimeout time.Duration `envconfig:"AUDIT_WEBHOOK_TIMEOUT" default:"5s"`
+	// fields of the audit events which are replaced by a hash, e.g. 'export AUDIT_REDACT="user,annotations"'
+	AuditRedact []string `envconfig:"AUDIT_REDACT"`
 }
 
 // ParseConfig parses the configuration from env variables
@@ -28,18 +160,152 @@ func ParseConfig() (*Config, error) {
 	if err := envconfig.Process("config", c); err != nil {
 		return c, err
 	}
-	if c.ProviderType == "azure" {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.compileExpressions(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// compileExpressions compiles and type-checks the CEL expressions
+func (c *Config) compileExpressions() error {
+	var err error
+	if c.MatchExpression != "" {
+		if c.matchProgram, err = expression.CompileMatch(c.MatchExpression); err != nil {
+			return fmt.Errorf("invalid MATCH_EXPRESSION: %w", err)
+		}
+	}
+	if c.RankExpression != "" {
+		if c.rankProgram, err = expression.CompileRank(c.RankExpression); err != nil {
+			return fmt.Errorf("invalid RANK_EXPRESSION: %w", err)
+		}
+	}
+	return nil
+}
+
+// MatchProgram returns the compiled MATCH_EXPRESSION or nil if it is not set
+func (c *Config) MatchProgram() *expression.Program {
+	return c.matchProgram
+}
+
+// RankProgram returns the compiled RANK_EXPRESSION or nil if it is not set
+func (c *Config) RankProgram() *expression.Program {
+	return c.rankProgram
+}
+
+func (c *Config) validate() error {
+	if c.HasProvider("azure") {
 		if c.OidcIssuerUrl == "" && !c.AutoDetectOidcIssuerUrl {
-			return nil, errors.New("OIDC_ISSUER_URL or AUTO_DETECT_OIDC_ISSUER_URL must be set")
+			return errors.New("OIDC_ISSUER_URL or AUTO_DETECT_OIDC_ISSUER_URL must be set")
+		}
+		if c.TenantID == "" && len(c.TenantIDs) == 0 {
+			return errors.New("AZURE_TENANT_ID or AZURE_TENANT_IDS must be set")
+		}
+		if c.AzureProvisioningEnabled && (len(c.FederatedCredentialAudiences) == 0 || c.FederatedCredentialPrefix == "") {
+			return errors.New("AZURE_FEDERATED_CREDENTIAL_AUDIENCES and AZURE_FEDERATED_CREDENTIAL_PREFIX must be set if AZURE_PROVISIONING_ENABLED is set")
+		}
+	}
+	if c.HasProvider("gcp") {
+		if c.GcpProjectId == "" && (len(c.GcpScopes) == 0 || c.GcpWorkloadIdentityPoolProject == "") {
+			return errors.New("GCP_PROJECT_ID or GCP_SCOPES and GCP_WORKLOAD_IDENTITY_POOL_PROJECT must be set")
+		}
+		for _, scope := range c.GcpScopes {
+			if !strings.HasPrefix(scope, "projects/") && !strings.HasPrefix(scope, "folders/") && !strings.HasPrefix(scope, "organizations/") {
+				return fmt.Errorf("GCP_SCOPES contains unsupported scope %s, expected projects/<id>, folders/<id> or organizations/<id>", scope)
+			}
+		}
+		if c.GcpWorkloadIdentityPool != "" && c.GcpWorkloadIdentityPoolProjectNumber == "" {
+			return errors.New("GCP_WORKLOAD_IDENTITY_POOL_PROJECT_NUMBER must be set if GCP_WORKLOAD_IDENTITY_POOL is set")
+		}
+		if c.GcpWorkloadIdentityProvider != "" && c.GcpWorkloadIdentityPool == "" {
+			return errors.New("GCP_WORKLOAD_IDENTITY_POOL must be set if GCP_WORKLOAD_IDENTITY_PROVIDER is set")
+		}
+		if c.GcpProvisioningEnabled && len(c.GcpServiceAccountAllowlist) == 0 {
+			return errors.New("GCP_SERVICE_ACCOUNT_ALLOWLIST must be set if GCP_PROVISIONING_ENABLED is set")
+		}
+	}
+	if c.HasProvider("alibaba") && c.AlibabaOidcProviderArn == "" {
+		return errors.New("ALIBABA_OIDC_PROVIDER_ARN must be set")
+	}
+	if c.HasProvider("static") && c.StaticMappingFile == "" {
+		return errors.New("STATIC_MAPPING_FILE must be set")
+	}
+	if c.HasProvider("vault") {
+		if c.VaultAddress == "" {
+			return errors.New("VAULT_ADDR must be set")
+		}
+		if c.VaultToken == "" && c.VaultLoginRole == "" {
+			return errors.New("VAULT_TOKEN or VAULT_LOGIN_ROLE must be set")
 		}
-		if c.TenantID == "" {
-			return nil, errors.New("AZURE_TENANT_ID must be set")
+	}
+	if c.ValidationMode != ValidationModeWarn && c.ValidationMode != ValidationModeDeny {
+		return fmt.Errorf("VALIDATION_MODE must be %s or %s", ValidationModeWarn, ValidationModeDeny)
+	}
+	for _, field := range c.AuditRedact {
+		if !slices.Contains(auditRedactFields, field) {
+			return fmt.Errorf("AUDIT_REDACT contains unsupported field %s, expected one of %s", field, strings.Join(auditRedactFields, ","))
 		}
-	} else if c.ProviderType == "gcp" {
-		if c.GcpProjectId == "" {
-			return nil, errors.New("GCP_CLOUD_PROJECT_ID must be set")
+	}
+	for _, key := range c.NamespaceOverrideAllowlist {
+		if !slices.Contains(namespaceOverrideKeys, key) {
+			return fmt.Errorf("NAMESPACE_OVERRIDE_ALLOWLIST contains unsupported key: %s", key)
 		}
 	}
 
-	return c, nil
+	return nil
+}
+
+// AzureTenantIDs returns the ordered list of tenants to search for identities
+func (c *Config) AzureTenantIDs() []string {
+	if len(c.TenantIDs) > 0 {
+		return c.TenantIDs
+	}
+	return []string{c.TenantID}
+}
+
+// TenantSubscriptionIDs returns the subscriptions of AZURE_SUBSCRIPTION_IDS scoped to the tenant with '<tenant-id>:<subscription-id>'
+// and the plain subscription IDs, which apply to all tenants
+func (c *Config) TenantSubscriptionIDs(tenantID string) (scoped []string, unscoped []string) {
+	for _, id := range c.SubscriptionIDs {
+		tenant, subscription, ok := strings.Cut(id, ":")
+		switch {
+		case !ok:
+			unscoped = append(unscoped, id)
+		case strings.EqualFold(tenant, tenantID):
+			scoped = append(scoped, subscription)
+		}
+	}
+	return scoped, unscoped
+}
+
+// GcpSearchScopes returns the ordered list of scopes to search for GCP service accounts
+func (c *Config) GcpSearchScopes() []string {
+	if len(c.GcpScopes) > 0 {
+		return c.GcpScopes
+	}
+	return []string{"projects/" + c.GcpProjectId}
+}
+
+// GcpPoolProject returns the project of the workload identity pool of the cluster
+func (c *Config) GcpPoolProject() string {
+	if c.GcpWorkloadIdentityPoolProject != "" {
+		return c.GcpWorkloadIdentityPoolProject
+	}
+	return c.GcpProjectId
+}
+
+// Providers returns the ordered list of providers to query
+func (c *Config) Providers() []string {
+	if len(c.ProviderTypes) > 0 {
+		return c.ProviderTypes
+	}
+	return []string{c.ProviderType}
+}
+
+// HasProvider reports whether the provider is configured
+func (c *Config) HasProvider(providerType string) bool {
+	return slices.Contains(c.Providers(), providerType)
 }
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// namespaceOverrideAnnotationPrefix is the prefix of namespace annotations overriding the global configuration
+	namespaceOverrideAnnotationPrefix = "azure.clientid.syncer/"
+
+	// OverrideTenantID overrides AZURE_TENANT_ID and AZURE_TENANT_IDS, e.g. 'azure.clientid.syncer/tenant-id: <tenant-id>'
+	OverrideTenantID = "tenant-id"
+	// OverrideFilterTags overrides FILTER_TAGS and uses the same format, e.g. 'azure.clientid.syncer/filter-tags: team:a,env:dev'
+	OverrideFilterTags = "filter-tags"
+	// OverrideSubscriptionIDs overrides AZURE_SUBSCRIPTION_IDS, e.g. 'azure.clientid.syncer/subscription-ids: <id1>,<id2>'
+	OverrideSubscriptionIDs = "subscription-ids"
+	// OverrideProviderType overrides PROVIDER_TYPE and PROVIDER_TYPES with globally enabled providers, e.g. 'azure.clientid.syncer/provider-type: gcp'
+	// or 'azure.clientid.syncer/provider-type: azure,gcp'
+	OverrideProviderType = "provider-type"
+)
+
+var namespaceOverrideKeys = []string{OverrideTenantID, OverrideFilterTags, OverrideSubscriptionIDs, OverrideProviderType}
+
+// ApplyNamespaceOverrides overrides the configuration with the values of the given namespace annotations.
+// Only keys which are part of NAMESPACE_OVERRIDE_ALLOWLIST are applied, all other override annotations are ignored.
+// It returns the list of keys which have been applied. If any override is invalid, the configuration is left unchanged.
+func (c *Config) ApplyNamespaceOverrides(annotations map[string]string) ([]string, error) {
+	overridden := *c
+	var applied []string
+	for _, key := range c.NamespaceOverrideAllowlist {
+		value, ok := annotations[namespaceOverrideAnnotationPrefix+key]
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case OverrideTenantID:
+			overridden.TenantID = value
+			overridden.TenantIDs = parseList(value)
+		case OverrideFilterTags:
+			filterTags, err := parseMap(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid namespace override %s: %w", key, err)
+			}
+			// the tags are part of a Resource Graph query
+			if strings.ContainsAny(value, "'\"\\") {
+				return nil, fmt.Errorf("invalid namespace override %s: quotes and backslashes are not allowed", key)
+			}
+			overridden.FilterTags = filterTags
+		case OverrideSubscriptionIDs:
+			overridden.SubscriptionIDs = parseList(value)
+		case OverrideProviderType:
+			// the shared clients, caches and watchers only exist for the globally enabled providers
+			for _, provider := range parseList(value) {
+				if !slices.Contains(c.Providers(), provider) {
+					return nil, fmt.Errorf("invalid namespace override %s: provider %s is not enabled globally", key, provider)
+				}
+			}
+			overridden.ProviderType = value
+			overridden.ProviderTypes = parseList(value)
+		default:
+			return nil, fmt.Errorf("unsupported namespace override: %s", key)
+		}
+		applied = append(applied, key)
+	}
+
+	if len(applied) == 0 {
+		return nil, nil
+	}
+
+	if err := overridden.validate(); err != nil {
+		return nil, err
+	}
+	*c = overridden
+	return applied, nil
+}
+
+// parseList parses a comma separated list the same way envconfig does
+func parseList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		list = append(list, strings.TrimSpace(item))
+	}
+	return list
+}
+
+// parseMap parses a comma separated list of key:value pairs the same way envconfig does
+func parseMap(value string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, pair := range parseList(value) {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid map item: %q", pair)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyNamespaceOverrides(t *testing.T) {
+	base := Config{
+		ProviderTypes:              []string{"azure", "binding"},
+		TenantID:                   "tenant-a",
+		OidcIssuerUrl:              "https://oidc.example.com/",
+		FilterTags:                 map[string]string{"team": "a"},
+		ValidationMode:             ValidationModeWarn,
+		NamespaceOverrideAllowlist: []string{OverrideTenantID, OverrideFilterTags, OverrideSubscriptionIDs, OverrideProviderType},
+	}
+
+	tests := []struct {
+		name        string
+		allowlist   []string
+		annotations map[string]string
+		want        func(c *Config)
+		wantApplied []string
+		wantErr     bool
+	}{
+		{
+			name:        "no override annotations",
+			annotations: map[string]string{"example.com/other": "value"},
+		},
+		{
+			name:        "tenant",
+			annotations: map[string]string{"azure.clientid.syncer/tenant-id": "tenant-b, tenant-c"},
+			want: func(c *Config) {
+				c.TenantID = "tenant-b, tenant-c"
+				c.TenantIDs = []string{"tenant-b", "tenant-c"}
+			},
+			wantApplied: []string{OverrideTenantID},
+		},
+		{
+			name:        "filter tags",
+			annotations: map[string]string{"azure.clientid.syncer/filter-tags": "team:b,env:dev"},
+			want:        func(c *Config) { c.FilterTags = map[string]string{"team": "b", "env": "dev"} },
+			wantApplied: []string{OverrideFilterTags},
+		},
+		{
+			name: "subscriptions and providers",
+			annotations: map[string]string{
+				"azure.clientid.syncer/subscription-ids": "sub-1,tenant-a:sub-2",
+				"azure.clientid.syncer/provider-type":    "azure,binding",
+			},
+			want: func(c *Config) {
+				c.SubscriptionIDs = []string{"sub-1", "tenant-a:sub-2"}
+				c.ProviderType = "azure,binding"
+				c.ProviderTypes = []string{"azure", "binding"}
+			},
+			wantApplied: []string{OverrideSubscriptionIDs, OverrideProviderType},
+		},
+		{
+			name:        "key outside of the allowlist",
+			allowlist:   []string{OverrideTenantID},
+			annotations: map[string]string{"azure.clientid.syncer/filter-tags": "team:b"},
+		},
+		{
+			name:        "invalid filter tags",
+			annotations: map[string]string{"azure.clientid.syncer/filter-tags": "team"},
+			wantErr:     true,
+		},
+		{
+			name:        "quotes in filter tags",
+			annotations: map[string]string{"azure.clientid.syncer/filter-tags": "team:a' or 1==1 or '"},
+			wantErr:     true,
+		},
+		{
+			name:        "backslash in filter tags",
+			annotations: map[string]string{"azure.clientid.syncer/filter-tags": `team:a\`},
+			wantErr:     true,
+		},
+		{
+			name: "invalid configuration after overrides",
+			annotations: map[string]string{
+				"azure.clientid.syncer/tenant-id":     "tenant-b",
+				"azure.clientid.syncer/provider-type": "vault",
+			},
+			wantErr: true,
+		},
+		{
+			name:        "empty tenant",
+			annotations: map[string]string{"azure.clientid.syncer/tenant-id": ""},
+			wantErr:     true,
+		},
+		{
+			name:        "subset of the providers",
+			annotations: map[string]string{"azure.clientid.syncer/provider-type": "binding"},
+			want: func(c *Config) {
+				c.ProviderType = "binding"
+				c.ProviderTypes = []string{"binding"}
+			},
+			wantApplied: []string{OverrideProviderType},
+		},
+		{
+			name:        "provider not enabled globally",
+			annotations: map[string]string{"azure.clientid.syncer/provider-type": "azure,static"},
+			wantErr:     true,
+		},
+		{
+			name:        "provider not enabled globally without its configuration",
+			annotations: map[string]string{"azure.clientid.syncer/provider-type": "alibaba"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			if tt.allowlist != nil {
+				c.NamespaceOverrideAllowlist = tt.allowlist
+			}
+			want := c
+			if tt.want != nil && !tt.wantErr {
+				tt.want(&want)
+			}
+
+			applied, err := c.ApplyNamespaceOverrides(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(applied, tt.wantApplied) {
+				t.Errorf("expected applied overrides %v, got %v", tt.wantApplied, applied)
+			}
+			// an invalid override leaves the configuration unchanged
+			if !reflect.DeepEqual(c, want) {
+				t.Errorf("expected configuration %+v, got %+v", want, c)
+			}
+		})
+	}
+}
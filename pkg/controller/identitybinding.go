@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/apis/v1alpha1"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// +kubebuilder:rbac:groups=azure.clientid.syncer,resources=identitybindings,verbs=get;list;watch
+// +kubebuilder:rbac:groups=azure.clientid.syncer,resources=identitybindings/status,verbs=get;update;patch
+
+const (
+	// serviceAccountBoundReason is the reason of the Bound condition if the binding annotates at least one service account
+	serviceAccountBoundReason = "ServiceAccountBound"
+	// noServiceAccountBoundReason is the reason of the Bound condition if the binding annotates no service account
+	noServiceAccountBoundReason = "NoServiceAccountBound"
+)
+
+// identityBindingReconciler maintains the status of identity bindings from the service accounts annotated by them
+type identityBindingReconciler struct {
+	client client.Client
+	logger logr.Logger
+}
+
+// SetupIdentityBindingReconciler registers the status controller of identity bindings with the manager.
+// Nothing is registered if the binding provider isn't used.
+func SetupIdentityBindingReconciler(mgr ctrl.Manager, log logr.Logger) error {
+	c, err := config.ParseConfig()
+	if err != nil {
+		return err
+	}
+	if !c.HasProvider("binding") {
+		return nil
+	}
+
+	r := &identityBindingReconciler{
+		client: mgr.GetClient(),
+		logger: log.WithName("identitybinding-status"),
+	}
+	// a change of any binding or service account may change which binding wins for the service accounts of the namespace
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("identitybinding-status").
+		Watches(&v1alpha1.IdentityBinding{}, handler.EnqueueRequestsFromMapFunc(r.namespaceBindings)).
+		Watches(&corev1.ServiceAccount{}, handler.EnqueueRequestsFromMapFunc(r.namespaceBindings)).
+		Complete(r)
+}
+
+// namespaceBindings returns requests for all bindings in the namespace of the object
+func (r *identityBindingReconciler) namespaceBindings(ctx context.Context, object client.Object) []reconcile.Request {
+	bindings := &v1alpha1.IdentityBindingList{}
+	if err := r.client.List(ctx, bindings, client.InNamespace(object.GetNamespace())); err != nil {
+		r.logger.Error(err, "failed to list identity bindings", "namespace", object.GetNamespace())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(bindings.Items))
+	for _, binding := range bindings.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&binding)})
+	}
+	return requests
+}
+
+// Reconcile lists the service accounts which are selected by the binding, aren't claimed by an older binding and carry its annotations.
+// The status is patched with an optimistic lock, conflicts are retried by requeueing the binding.
+func (r *identityBindingReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	binding := &v1alpha1.IdentityBinding{}
+	if err := r.client.Get(ctx, req.NamespacedName, binding); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !binding.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	bindings := &v1alpha1.IdentityBindingList{}
+	if err := r.client.List(ctx, bindings, client.InNamespace(binding.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+	serviceAccounts := &corev1.ServiceAccountList{}
+	if err := r.client.List(ctx, serviceAccounts, client.InNamespace(binding.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	logger := r.logger.WithValues("identityBinding", binding.Name, "namespace", binding.Namespace)
+	bound := boundServiceAccounts(binding, bindings.Items, serviceAccounts.Items)
+
+	status := binding.Status.DeepCopy()
+	status.BoundServiceAccounts = bound
+	condition := metav1.Condition{
+		Type:               v1alpha1.IdentityBindingConditionBound,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: binding.Generation,
+		Reason:             serviceAccountBoundReason,
+		Message:            fmt.Sprintf("bound to %d service account(s)", len(bound)),
+	}
+	if len(bound) == 0 {
+		condition.Status, condition.Reason = metav1.ConditionFalse, noServiceAccountBoundReason
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+	if equality.Semantic.DeepEqual(status, &binding.Status) {
+		return ctrl.Result{}, nil
+	}
+
+	patch := client.MergeFromWithOptions(binding.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	binding.Status = *status
+	if err := r.client.Status().Patch(ctx, binding, patch); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	logger.Info("updated identity binding status", "boundServiceAccounts", len(bound))
+	return ctrl.Result{}, nil
+}
+
+// boundServiceAccounts returns the sorted names of the service accounts which the binding wins for and which carry its annotations.
+// Service accounts whose admission was rejected or whose annotations were set by a provider of higher precedence aren't bound.
+func boundServiceAccounts(binding *v1alpha1.IdentityBinding, bindings []v1alpha1.IdentityBinding, serviceAccounts []corev1.ServiceAccount) []string {
+	annotations := provider.IdentityBindingAnnotations(binding)
+	var bound []string
+	for i := range serviceAccounts {
+		serviceAccount := &serviceAccounts[i]
+		if !serviceAccount.DeletionTimestamp.IsZero() {
+			continue
+		}
+		// invalid selectors and conflicting bindings are already logged by the admission
+		selected := provider.SelectIdentityBinding(logr.Discard(), bindings, serviceAccount)
+		if selected == nil || selected.Name != binding.Name {
+			continue
+		}
+		annotated := true
+		for annotation, value := range annotations {
+			if serviceAccount.Annotations[annotation] != value {
+				annotated = false
+				break
+			}
+		}
+		if annotated {
+			bound = append(bound, serviceAccount.Name)
+		}
+	}
+	sort.Strings(bound)
+	return bound
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"context"
+	"slices"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+const (
+	// federatedCredentialDeletedReason is the reason of the events emitted if a provisioned federated identity credential was deleted
+	federatedCredentialDeletedReason = "FederatedCredentialDeleted"
+	// federatedCredentialCleanupFailedReason is the reason of the events emitted if a provisioned federated identity credential could not be deleted
+	federatedCredentialCleanupFailedReason = "FederatedCredentialCleanupFailed"
+	// gcpBindingRemovedReason is the reason of the events emitted if a provisioned workload identity binding was removed
+	gcpBindingRemovedReason = "WorkloadIdentityBindingRemoved"
+	// gcpBindingCleanupFailedReason is the reason of the events emitted if a provisioned workload identity binding could not be removed
+	gcpBindingCleanupFailedReason = "WorkloadIdentityBindingCleanupFailed"
+)
+
+// cleanupFinalizers are the finalizers handled by the reconciler
+var cleanupFinalizers = []string{provider.FederatedCredentialFinalizer, provider.GCPBindingFinalizer}
+
+// serviceAccountReconciler removes the cloud resources provisioned for service accounts when they are deleted
+type serviceAccountReconciler struct {
+	client   client.Client
+	config   *config.Config
+	recorder record.EventRecorder
+	logger   logr.Logger
+}
+
+// SetupServiceAccountReconciler registers the cleanup controller for provisioned cloud resources with the manager.
+// It is registered even if provisioning is disabled, so that the finalizers of service accounts provisioned before never block their deletion.
+func SetupServiceAccountReconciler(mgr ctrl.Manager, log logr.Logger) error {
+	c, err := config.ParseConfig()
+	if err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("serviceaccount-cleanup").
+		For(&corev1.ServiceAccount{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+			return slices.ContainsFunc(cleanupFinalizers, func(finalizer string) bool {
+				return controllerutil.ContainsFinalizer(object, finalizer)
+			})
+		}))).
+		Complete(&serviceAccountReconciler{
+			client:   mgr.GetClient(),
+			config:   c,
+			recorder: mgr.GetEventRecorderFor("azure-clientid-syncer"),
+			logger:   log.WithName("serviceaccount-cleanup"),
+		})
+}
+
+// Reconcile removes the provisioned cloud resources of a deleted service account and removes the finalizers afterwards.
+// In dry-run mode, or if the provisioning of the provider has been disabled, the resources are kept and only the finalizers are removed.
+func (r *serviceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := r.client.Get(ctx, req.NamespacedName, serviceAccount); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if serviceAccount.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	logger := r.logger.WithValues("name", serviceAccount.Name, "namespace", serviceAccount.Namespace)
+	patch := client.MergeFrom(serviceAccount.DeepCopy())
+	for _, finalizer := range cleanupFinalizers {
+		if !controllerutil.ContainsFinalizer(serviceAccount, finalizer) {
+			continue
+		}
+		if err := r.cleanup(ctx, logger, serviceAccount, finalizer); err != nil {
+			return ctrl.Result{}, err
+		}
+		controllerutil.RemoveFinalizer(serviceAccount, finalizer)
+	}
+	return ctrl.Result{}, client.IgnoreNotFound(r.client.Patch(ctx, serviceAccount, patch))
+}
+
+// cleanup removes the cloud resource protected by the finalizer
+func (r *serviceAccountReconciler) cleanup(ctx context.Context, logger logr.Logger, serviceAccount *corev1.ServiceAccount, finalizer string) error {
+	var annotation, description, removedReason, failedReason string
+	var enabled bool
+	var remove func(resource string) error
+	switch finalizer {
+	case provider.FederatedCredentialFinalizer:
+		enabled = r.config.AzureProvisioningEnabled
+		annotation, description = provider.ProvisionedFederatedCredentialAnnotation, "federated identity credential"
+		removedReason, failedReason = federatedCredentialDeletedReason, federatedCredentialCleanupFailedReason
+		remove = func(resource string) error {
+			tenantID := serviceAccount.Annotations[provider.AzureTenantIDAnnotation]
+			return provider.DeleteFederatedCredential(ctx, *r.config, tenantID, resource, serviceAccount)
+		}
+	case provider.GCPBindingFinalizer:
+		enabled = r.config.GcpProvisioningEnabled
+		annotation, description = provider.ProvisionedGCPBindingAnnotation, "workload identity binding on"
+		removedReason, failedReason = gcpBindingRemovedReason, gcpBindingCleanupFailedReason
+		remove = func(resource string) error {
+			return provider.RemoveGCPWorkloadIdentityBinding(ctx, *r.config, resource, serviceAccount)
+		}
+	}
+
+	resource := serviceAccount.Annotations[annotation]
+	switch {
+	case resource == "":
+		logger.Info("no provisioned resource recorded, removing finalizer", "finalizer", finalizer)
+	case r.config.CleanupDryRun:
+		logger.Info("skipping cleanup in dry-run", "resource", resource)
+		r.recorder.Eventf(serviceAccount, corev1.EventTypeNormal, removedReason, "dry-run: would remove %s %s", description, resource)
+	case !enabled:
+		// the configuration needed to remove the resource may be gone with the provisioning
+		logger.Info("skipping cleanup, provisioning is disabled", "resource", resource)
+		r.recorder.Eventf(serviceAccount, corev1.EventTypeWarning, failedReason, "provisioning is disabled, keeping %s %s", description, resource)
+	default:
+		if err := remove(resource); err != nil {
+			logger.Error(err, "failed to remove provisioned resource", "resource", resource)
+			r.recorder.Eventf(serviceAccount, corev1.EventTypeWarning, failedReason, "failed to remove %s %s: %s", description, resource, err)
+			return err
+		}
+		logger.Info("removed provisioned resource", "resource", resource)
+		r.recorder.Eventf(serviceAccount, corev1.EventTypeNormal, removedReason, "removed %s %s", description, resource)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package expression
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+const (
+	// ServiceAccountVariable holds the name, namespace, labels and annotations of the service account
+	ServiceAccountVariable = "serviceAccount"
+	// NamespaceVariable holds the name, labels and annotations of the namespace of the service account.
+	// It is named like in ValidatingAdmissionPolicy, because namespace is a reserved word in CEL.
+	NamespaceVariable = "namespaceObject"
+	// IdentityVariable holds the candidate identity, e.g. its tags, resourceGroup and the audiences of the federated credential
+	IdentityVariable = "identity"
+)
+
+const (
+	// serviceAccountType, namespaceType and identityType are the CEL types of the variables
+	serviceAccountType = "azurecs.ServiceAccount"
+	namespaceType      = "azurecs.Namespace"
+	identityType       = "azurecs.Identity"
+
+	// costLimit aborts the evaluation of expressions exceeding this cost, e.g. comprehensions over large maps
+	costLimit = 100000
+)
+
+// stringMap is the type of labels, annotations and tags
+var stringMap = cel.MapType(cel.StringType, cel.StringType)
+
+// objectTypes declares the fields of the variables, so the type of every expression is checked on compilation.
+// The values of the variables are passed as map[string]any with these keys.
+var objectTypes = map[string]map[string]*cel.Type{
+	serviceAccountType: {
+		"name":        cel.StringType,
+		"namespace":   cel.StringType,
+		"labels":      stringMap,
+		"annotations": stringMap,
+	},
+	namespaceType: {
+		"name":        cel.StringType,
+		"labels":      stringMap,
+		"annotations": stringMap,
+	},
+	identityType: {
+		"id":                  cel.StringType,
+		"clientId":            cel.StringType,
+		"tenantId":            cel.StringType,
+		"subscriptionId":      cel.StringType,
+		"resourceGroup":       cel.StringType,
+		"project":             cel.StringType,
+		"tags":                stringMap,
+		"federatedCredential": cel.StringType,
+		"issuer":              cel.StringType,
+		"subject":             cel.StringType,
+		"audiences":           cel.ListType(cel.StringType),
+	},
+}
+
+// typeProvider resolves the fields of the variables on top of the standard types
+type typeProvider struct {
+	*types.Registry
+}
+
+func (p *typeProvider) FindStructType(structType string) (*types.Type, bool) {
+	if _, ok := objectTypes[structType]; ok {
+		return types.NewTypeTypeWithParam(types.NewObjectType(structType)), true
+	}
+	return p.Registry.FindStructType(structType)
+}
+
+func (p *typeProvider) FindStructFieldType(structType, fieldName string) (*types.FieldType, bool) {
+	fields, ok := objectTypes[structType]
+	if !ok {
+		return p.Registry.FindStructFieldType(structType, fieldName)
+	}
+	fieldType, ok := fields[fieldName]
+	if !ok {
+		return nil, false
+	}
+	return &types.FieldType{
+		Type: fieldType,
+		IsSet: func(target any) bool {
+			object, ok := target.(map[string]any)
+			if !ok {
+				return false
+			}
+			_, ok = object[fieldName]
+			return ok
+		},
+		GetFrom: func(target any) (any, error) {
+			object, ok := target.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value %T of %s", target, structType)
+			}
+			value, ok := object[fieldName]
+			if !ok {
+				return nil, fmt.Errorf("no such field: %s", fieldName)
+			}
+			return value, nil
+		},
+	}, true
+}
+
+// Program is a compiled and type-checked CEL expression
+type Program struct {
+	expression string
+	program    cel.Program
+}
+
+var (
+	envOnce sync.Once
+	env     *cel.Env
+	envErr  error
+
+	programsMu sync.Mutex
+	// programs caches the compiled expressions, the configuration is parsed for every request but compiled only once
+	programs = map[string]*Program{}
+)
+
+func newEnv() (*cel.Env, error) {
+	envOnce.Do(func() {
+		env, envErr = cel.NewEnv(
+			cel.CustomTypeProvider(&typeProvider{Registry: types.NewEmptyRegistry()}),
+			cel.Variable(ServiceAccountVariable, cel.ObjectType(serviceAccountType)),
+			cel.Variable(NamespaceVariable, cel.ObjectType(namespaceType)),
+			cel.Variable(IdentityVariable, cel.ObjectType(identityType)),
+		)
+	})
+	return env, envErr
+}
+
+// Compile compiles the expression and checks that it evaluates to one of the given types.
+// Programs are cached, compiling the same expression again returns the same program.
+func Compile(expression string, outputTypes ...*cel.Type) (*Program, error) {
+	key := fmt.Sprint(outputTypes) + "/" + expression
+	programsMu.Lock()
+	defer programsMu.Unlock()
+	if program, ok := programs[key]; ok {
+		return program, nil
+	}
+
+	env, err := newEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile expression %q: %w", expression, issues.Err())
+	}
+	valid := false
+	for _, outputType := range outputTypes {
+		if ast.OutputType().IsExactType(outputType) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("expression %q evaluates to %s, expected one of %v", expression, ast.OutputType(), outputTypes)
+	}
+	program, err := env.Program(ast, cel.CostLimit(costLimit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create program for expression %q: %w", expression, err)
+	}
+	programs[key] = &Program{expression: expression, program: program}
+	return programs[key], nil
+}
+
+// CompileMatch compiles an expression filtering candidates, it must evaluate to a bool
+func CompileMatch(expression string) (*Program, error) {
+	return Compile(expression, cel.BoolType)
+}
+
+// CompileRank compiles an expression ranking candidates, it must evaluate to a number
+func CompileRank(expression string) (*Program, error) {
+	return Compile(expression, cel.IntType, cel.UintType, cel.DoubleType)
+}
+
+func (p *Program) eval(vars map[string]any) (any, error) {
+	out, _, err := p.program.Eval(vars)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate expression %q: %w", p.expression, err)
+	}
+	return out.Value(), nil
+}
+
+// Match evaluates an expression compiled with CompileMatch
+func (p *Program) Match(vars map[string]any) (bool, error) {
+	out, err := p.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	match, ok := out.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q evaluated to %T, expected bool", p.expression, out)
+	}
+	return match, nil
+}
+
+// Rank evaluates an expression compiled with CompileRank
+func (p *Program) Rank(vars map[string]any) (float64, error) {
+	out, err := p.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	switch rank := out.(type) {
+	case int64:
+		return float64(rank), nil
+	case uint64:
+		return float64(rank), nil
+	case float64:
+		return rank, nil
+	default:
+		return 0, fmt.Errorf("expression %q evaluated to %T, expected a number", p.expression, out)
+	}
+}
+
+// String returns the source of the expression
+func (p *Program) String() string {
+	return p.expression
+}
@@ -0,0 +1,85 @@
+package expression
+
+import (
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	vars := map[string]any{
+		ServiceAccountVariable: map[string]any{
+			"name":        "app",
+			"namespace":   "team-a",
+			"labels":      map[string]string{"env": "dev"},
+			"annotations": map[string]string{},
+		},
+		NamespaceVariable: map[string]any{
+			"name":        "team-a",
+			"labels":      map[string]string{"env": "dev"},
+			"annotations": map[string]string{},
+		},
+		IdentityVariable: map[string]any{
+			"id":        "/subscriptions/s/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/app",
+			"tags":      map[string]string{"env": "dev", "priority": "2"},
+			"audiences": []string{"api://AzureADTokenExchange"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		rank       bool
+		compileErr bool
+		want       any
+	}{
+		{name: "match tag", expression: `has(identity.tags.env) && identity.tags.env == namespaceObject.labels.env`, want: true},
+		{name: "match missing tag", expression: `has(identity.tags.team) && identity.tags.team == "a"`, want: false},
+		{name: "match list", expression: `"api://AzureADTokenExchange" in identity.audiences`, want: true},
+		{name: "match string output", expression: `identity.tags.env`, compileErr: true},
+		{name: "unknown field", expression: `identity.name == "app"`, compileErr: true},
+		{name: "rank int", expression: `int(identity.tags.priority)`, rank: true, want: 2.0},
+		{name: "rank bool output", expression: `identity.tags.env == "dev"`, rank: true, compileErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compile := CompileMatch
+			if tt.rank {
+				compile = CompileRank
+			}
+			program, err := compile(tt.expression)
+			if tt.compileErr {
+				if err == nil {
+					t.Fatalf("expected compile error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected compile error: %v", err)
+			}
+			var got any
+			if tt.rank {
+				got, err = program.Rank(vars)
+			} else {
+				got, err = program.Match(vars)
+			}
+			if err != nil {
+				t.Fatalf("unexpected evaluation error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if cached, _ := compile(tt.expression); cached != program {
+				t.Errorf("expected the compiled program to be cached")
+			}
+		})
+	}
+}
+
+func TestCostLimit(t *testing.T) {
+	program, err := CompileMatch(`[1,2,3,4,5,6,7,8,9,10].all(a, [1,2,3,4,5,6,7,8,9,10].all(b, [1,2,3,4,5,6,7,8,9,10].all(c, [1,2,3,4,5,6,7,8,9,10].all(d, [1,2,3,4,5,6,7,8,9,10].all(e, a+b+c+d+e > 0)))))`)
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+	if _, err := program.Match(map[string]any{}); err == nil {
+		t.Errorf("expected the evaluation to exceed the cost limit")
+	}
+}
@@ -3,11 +3,11 @@ package kuberneteshelper
 import (
 	"context"
 	"encoding/json"
+	"net/http"
 
 	"github.com/go-logr/logr"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 type KubernetesHelper struct {
@@ -19,18 +19,11 @@ type oidcConfig struct {
 	Issuer string `json:"issuer"`
 }
 
-func NewKubernetesHelper(log logr.Logger) (*KubernetesHelper, error) {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		log.Info("Failed to get in cluster config, trying kubeconfig")
-		config, err = clientcmd.BuildConfigFromFlags("", "kubeconfig")
-		if err != nil {
-			log.Error(err, "Failed to get kubeconfig")
-			return nil, err
-		}
-	}
-
-	clientSet, err := kubernetes.NewForConfig(config)
+// NewKubernetesHelper creates a helper from the given rest config and http client.
+// Both are expected to be the ones used by the controller manager (mgr.GetConfig and mgr.GetHTTPClient),
+// so that the helper honors --kubeconfig/KUBECONFIG and works in and out of cluster alike.
+func NewKubernetesHelper(config *rest.Config, httpClient *http.Client, log logr.Logger) (*KubernetesHelper, error) {
+	clientSet, err := kubernetes.NewForConfigAndClient(config, httpClient)
 	if err != nil {
 		log.Error(err, "Failed to create clientset")
 		return nil, err
@@ -41,8 +34,8 @@ func NewKubernetesHelper(log logr.Logger) (*KubernetesHelper, error) {
 	}, nil
 }
 
-func (k *KubernetesHelper) GetOidcIssuerUrl() (string, error) {
-	rawData, err := k.clientSet.RESTClient().Get().AbsPath("/.well-known/openid-configuration").DoRaw(context.Background())
+func (k *KubernetesHelper) GetOidcIssuerUrl(ctx context.Context) (string, error) {
+	rawData, err := k.clientSet.RESTClient().Get().AbsPath("/.well-known/openid-configuration").DoRaw(ctx)
 	if err != nil {
 		k.logger.Error(err, "Failed to get oidc config")
 		return "", err
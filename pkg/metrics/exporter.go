@@ -1,19 +1,46 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/metrics/otlp"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/metrics/prometheus"
+	"go.opentelemetry.io/otel/sdk/metric"
 )
 
-func InitMetricsExporter(metricsBackend string) error {
+// views set the buckets of the histograms, which are shared by all exporters. Every histogram is matched by
+// exactly one view, as several matching views would export it several times.
+var views = []metric.View{
+	// admission requests are expected to finish within the webhook timeout
+	metric.NewView(
+		metric.Instrument{Name: "azurecs_mutation_request", Kind: metric.InstrumentKindHistogram},
+		metric.Stream{
+			Aggregation: &metric.AggregationExplicitBucketHistogram{
+				Boundaries: []float64{0.001, 0.002, 0.003, 0.004, 0.005, 0.006, 0.007, 0.008, 0.009, 0.01, 0.02, 0.03, 0.04, 0.05, 0.06, 0.07, 0.08, 0.09, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.5, 2, 2.5, 3, 5, 10},
+			}},
+	),
+	// cloud API calls include paging and the background refresh of the caches, which may take much longer
+	metric.NewView(
+		metric.Instrument{Name: "azurecs_provider_api_request", Kind: metric.InstrumentKindHistogram},
+		metric.Stream{
+			Aggregation: &metric.AggregationExplicitBucketHistogram{
+				Boundaries: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+			}},
+	),
+}
+
+// InitMetricsExporter initializes the given metrics backend. The OTLP configuration is only used by the otlp backend.
+// The returned function flushes the metrics and has to be called on shutdown.
+func InitMetricsExporter(ctx context.Context, metricsBackend string, otlpConfig otlp.Config) (func(context.Context) error, error) {
 	mb := strings.ToLower(metricsBackend)
 	switch mb {
-	// Prometheus is the only exporter for now
 	case prometheus.ExporterName:
-		return prometheus.InitExporter()
+		return func(context.Context) error { return nil }, prometheus.InitExporter(views...)
+	case otlp.ExporterName:
+		return otlp.InitExporter(ctx, otlpConfig, views...)
 	default:
-		return fmt.Errorf("unsupported metrics backend: %v", metricsBackend)
+		return nil, fmt.Errorf("unsupported metrics backend: %v", metricsBackend)
 	}
 }
@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/metrics/otlp"
+	"go.opentelemetry.io/otel"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver collects the export requests and the authorization headers they were sent with
+type receiver struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+
+	mu             sync.Mutex
+	requests       []*collectormetrics.ExportMetricsServiceRequest
+	authorizations []string
+}
+
+func (r *receiver) record(req *collectormetrics.ExportMetricsServiceRequest, authorization string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.authorizations = append(r.authorizations, authorization)
+}
+
+func (r *receiver) Export(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.record(req, strings.Join(md.Get("authorization"), ","))
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.URL.Path != "/v1/metrics" {
+		http.Error(w, "unexpected request "+req.Method+" "+req.URL.Path, http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request := &collectormetrics.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.record(request, req.Header.Get("Authorization"))
+
+	data, _ := proto.Marshal(&collectormetrics.ExportMetricsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(data)
+}
+
+// startReceiver serves the receiver in-process and returns its endpoint
+func startReceiver(t *testing.T, protocol string, r *receiver) string {
+	if protocol == otlp.ProtocolHTTP {
+		server := httptest.NewServer(r)
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	collectormetrics.RegisterMetricsServiceServer(server, r)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestOTLPExporter(t *testing.T) {
+	for _, protocol := range []string{otlp.ProtocolGRPC, otlp.ProtocolHTTP} {
+		t.Run(protocol, func(t *testing.T) {
+			r := &receiver{}
+			endpoint := startReceiver(t, protocol, r)
+
+			meterProvider := otel.GetMeterProvider()
+			t.Cleanup(func() { otel.SetMeterProvider(meterProvider) })
+			ctx := context.Background()
+			shutdown, err := InitMetricsExporter(ctx, "OTLP", otlp.Config{
+				Endpoint:           endpoint,
+				Protocol:           protocol,
+				Insecure:           true,
+				Headers:            map[string]string{"authorization": "Bearer token"},
+				ResourceAttributes: map[string]string{"k8s.cluster.name": "test"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			meter := otel.GetMeterProvider().Meter("test")
+			counter, err := meter.Int64Counter("azurecs_admission")
+			if err != nil {
+				t.Fatal(err)
+			}
+			histogram, err := meter.Float64Histogram("azurecs_mutation_request")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter.Add(ctx, 2)
+			histogram.Record(ctx, 0.015)
+			// shutdown exports the metrics recorded since the last interval
+			if err := shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if len(r.requests) == 0 {
+				t.Fatal("no metrics were exported")
+			}
+			for _, authorization := range r.authorizations {
+				if authorization != "Bearer token" {
+					t.Errorf("expected authorization header %q, got %q", "Bearer token", authorization)
+				}
+			}
+
+			resourceAttributes := map[string]string{}
+			metrics := map[string]*metricsv1.Metric{}
+			for _, request := range r.requests {
+				for _, resourceMetrics := range request.ResourceMetrics {
+					for _, attribute := range resourceMetrics.GetResource().GetAttributes() {
+						resourceAttributes[attribute.Key] = attribute.Value.GetStringValue()
+					}
+					for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+						for _, m := range scopeMetrics.Metrics {
+							metrics[m.Name] = m
+						}
+					}
+				}
+			}
+			for key, want := range map[string]string{"service.name": "azure-clientid-syncer", "k8s.cluster.name": "test"} {
+				if resourceAttributes[key] != want {
+					t.Errorf("expected resource attribute %s=%q, got %q", key, want, resourceAttributes[key])
+				}
+			}
+
+			if points := metrics["azurecs_admission"].GetSum().GetDataPoints(); len(points) != 1 || points[0].GetAsInt() != 2 {
+				t.Errorf("expected azurecs_admission to be 2, got %v", points)
+			}
+			points := metrics["azurecs_mutation_request"].GetHistogram().GetDataPoints()
+			if len(points) != 1 || points[0].Count != 1 {
+				t.Fatalf("expected a single azurecs_mutation_request observation, got %v", points)
+			}
+			// the buckets are set by the view of the histogram instead of the default boundaries
+			if bounds := points[0].ExplicitBounds; len(bounds) != 34 || bounds[0] != 0.001 || bounds[len(bounds)-1] != 10 {
+				t.Errorf("expected the bucket boundaries of the view, got %v", bounds)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const (
+	// ExporterName is the name of the exporter
+	ExporterName = "otlp"
+
+	// ProtocolGRPC and ProtocolHTTP are the supported OTLP transports
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+
+	serviceName = "azure-clientid-syncer"
+)
+
+// Config configures the OTLP exporter. Empty values fall back to the standard OTEL_EXPORTER_OTLP_* environment variables.
+type Config struct {
+	// Endpoint is the host and port of the collector, e.g. "otel-collector.monitoring:4317"
+	Endpoint string
+	// Protocol is either grpc or http
+	Protocol string
+	Insecure bool
+	// Headers are sent with every export, e.g. for authentication
+	Headers map[string]string
+	// Interval between two exports
+	Interval time.Duration
+	// ResourceAttributes are added to the resource describing the syncer, e.g. the cluster name
+	ResourceAttributes map[string]string
+}
+
+// InitExporter pushes the metrics periodically to the collector. The returned function exports the remaining
+// metrics and has to be called on shutdown.
+func InitExporter(ctx context.Context, c Config, views ...metric.View) (func(context.Context) error, error) {
+	exporter, err := newExporter(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP metrics exporter: %w", err)
+	}
+
+	attributes := []attribute.KeyValue{attribute.String("service.name", serviceName)}
+	for key, value := range c.ResourceAttributes {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attributes...))
+	if err != nil {
+		return nil, err
+	}
+
+	var readerOptions []metric.PeriodicReaderOption
+	if c.Interval > 0 {
+		readerOptions = append(readerOptions, metric.WithInterval(c.Interval))
+	}
+	meterProvider := metric.NewMeterProvider(
+		metric.WithReader(metric.NewPeriodicReader(exporter, readerOptions...)),
+		metric.WithResource(res),
+		metric.WithView(views...),
+	)
+
+	otel.SetMeterProvider(meterProvider)
+
+	return meterProvider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context, c Config) (metric.Exporter, error) {
+	switch c.Protocol {
+	case ProtocolGRPC, "":
+		var options []otlpmetricgrpc.Option
+		if c.Endpoint != "" {
+			options = append(options, otlpmetricgrpc.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlpmetricgrpc.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			options = append(options, otlpmetricgrpc.WithHeaders(c.Headers))
+		}
+		return otlpmetricgrpc.New(ctx, options...)
+	case ProtocolHTTP:
+		var options []otlpmetrichttp.Option
+		if c.Endpoint != "" {
+			options = append(options, otlpmetrichttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlpmetrichttp.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			options = append(options, otlpmetrichttp.WithHeaders(c.Headers))
+		}
+		return otlpmetrichttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %s, expected %s or %s", c.Protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+}
+
+// ParseKeyValues parses a comma separated list of key=value pairs, the format of OTEL_EXPORTER_OTLP_HEADERS and OTEL_RESOURCE_ATTRIBUTES
+func ParseKeyValues(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	m := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid key=value pair: %s", pair)
+		}
+		m[key] = val
+	}
+	return m, nil
+}
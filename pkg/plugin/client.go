@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client calls a plugin
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// NewClient returns a client for the plugin at the endpoint. Every call is limited by the timeout.
+func NewClient(endpoint string, timeout time.Duration) *Client {
+	return &Client{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Query asks the plugin for the identity of the service account
+func (c *Client) Query(ctx context.Context, req QueryRequest) (*QueryResponse, error) {
+	req.APIVersion = APIVersion
+	response := &QueryResponse{}
+	if err := c.do(ctx, http.MethodPost, "/v1/query", req, response, &response.APIVersion); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Verify asks the plugin to verify the identity annotations of the service account
+func (c *Client) Verify(ctx context.Context, req QueryRequest) (*VerifyResponse, error) {
+	req.APIVersion = APIVersion
+	response := &VerifyResponse{}
+	if err := c.do(ctx, http.MethodPost, "/v1/verify", req, response, &response.APIVersion); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Health returns an error if the plugin is unreachable or not healthy
+func (c *Client) Health(ctx context.Context) error {
+	response := &HealthResponse{}
+	if err := c.do(ctx, http.MethodGet, "/v1/health", nil, response, &response.APIVersion); err != nil {
+		return err
+	}
+	if response.Status != HealthStatusOK {
+		return fmt.Errorf("plugin reported status %q", response.Status)
+	}
+	return nil
+}
+
+// do sends the request and decodes the response, which must have the supported API version
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, response interface{}, apiVersion *string) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("plugin responded with %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("failed to decode plugin response: %w", err)
+	}
+	if *apiVersion != APIVersion {
+		return fmt.Errorf("unsupported plugin API version %q, expected %q", *apiVersion, APIVersion)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// HealthChecker probes the health endpoint of all plugins periodically, so that requests to unhealthy plugins fail fast
+// instead of waiting for the timeout. Plugins are considered healthy until the first probe failed.
+type HealthChecker struct {
+	clients  map[string]*Client
+	interval time.Duration
+	timeout  time.Duration
+	logger   logr.Logger
+
+	mu        sync.RWMutex
+	unhealthy map[string]error
+}
+
+// NewHealthChecker returns a health checker for the plugins
+func NewHealthChecker(clients map[string]*Client, interval time.Duration, timeout time.Duration, logger logr.Logger) *HealthChecker {
+	return &HealthChecker{
+		clients:   clients,
+		interval:  interval,
+		timeout:   timeout,
+		logger:    logger,
+		unhealthy: map[string]error{},
+	}
+}
+
+// Start probes the plugins until the context is done
+func (h *HealthChecker) Start(ctx context.Context) error {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection is false, as each replica fails fast only for plugins its own probes found unhealthy
+func (h *HealthChecker) NeedLeaderElection() bool {
+	return false
+}
+
+// Err returns the error of the last probe of the plugin, or nil if it is healthy
+func (h *HealthChecker) Err(name string) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.unhealthy[name]
+}
+
+func (h *HealthChecker) probe(ctx context.Context) {
+	for name, client := range h.clients {
+		probeCtx, cancel := context.WithTimeout(ctx, h.timeout)
+		err := client.Health(probeCtx)
+		cancel()
+
+		h.mu.Lock()
+		previous := h.unhealthy[name]
+		if err != nil {
+			h.unhealthy[name] = err
+		} else {
+			delete(h.unhealthy, name)
+		}
+		h.mu.Unlock()
+
+		switch {
+		case err != nil && previous == nil:
+			h.logger.Error(err, "plugin became unhealthy", "plugin", name)
+		case err == nil && previous != nil:
+			h.logger.Info("plugin became healthy", "plugin", name)
+		}
+	}
+}
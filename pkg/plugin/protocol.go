@@ -0,0 +1,69 @@
+// Package plugin defines the versioned HTTP protocol between the webhook and external identity provider plugins.
+//
+// A plugin is an HTTP server implementing the following endpoints, all exchanging JSON:
+//
+//	POST /v1/query   QueryRequest  -> QueryResponse
+//	POST /v1/verify  QueryRequest  -> VerifyResponse
+//	GET  /v1/health                -> HealthResponse
+//
+// Every request and response carries APIVersion, responses with another version are rejected by the webhook.
+package plugin
+
+// APIVersion is the version of the plugin protocol
+const APIVersion = "plugin.azure.clientid.syncer/v1"
+
+// ServiceAccount describes the service account of the admission request
+type ServiceAccount struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// QueryRequest asks the plugin for the identity of the service account
+type QueryRequest struct {
+	APIVersion     string         `json:"apiVersion"`
+	ServiceAccount ServiceAccount `json:"serviceAccount"`
+	// NamespaceLabels are the labels of the namespace of the service account
+	NamespaceLabels map[string]string `json:"namespaceLabels,omitempty"`
+	// Issuer is the OIDC issuer of the cluster, if known
+	Issuer string `json:"issuer,omitempty"`
+	// DryRun is set for dry-run admission requests, the plugin must not have side effects
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// Identity describes the identity found by the plugin. It is evaluated by identity policies and expressions.
+type Identity struct {
+	ResourceID     string            `json:"resourceID,omitempty"`
+	ClientID       string            `json:"clientID,omitempty"`
+	TenantID       string            `json:"tenantID,omitempty"`
+	SubscriptionID string            `json:"subscriptionID,omitempty"`
+	ResourceGroup  string            `json:"resourceGroup,omitempty"`
+	Project        string            `json:"project,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+// QueryResponse holds the annotations to add to the service account. No annotations mean no identity was found.
+type QueryResponse struct {
+	APIVersion  string            `json:"apiVersion"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Identity    *Identity         `json:"identity,omitempty"`
+	// Warnings are returned to the client of the admission request, e.g. if the identity is about to be retired
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// VerifyResponse holds the problems found with the identity annotations of the service account
+type VerifyResponse struct {
+	APIVersion string   `json:"apiVersion"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+// HealthResponse reports the health of the plugin
+type HealthResponse struct {
+	APIVersion string `json:"apiVersion"`
+	// Status is "ok" if the plugin is healthy
+	Status string `json:"status"`
+}
+
+// HealthStatusOK is the status of a healthy plugin
+const HealthStatusOK = "ok"
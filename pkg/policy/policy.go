@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/apis/v1alpha1"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// namespacePlaceholder is replaced with the namespace of the service account in rule tags
+const namespacePlaceholder = "<NAMESPACE>"
+
+// Evaluate checks the identity found by the given provider against all policies selecting the namespace.
+// The identity is allowed if it matches at least one rule of every selecting policy. If it is denied,
+// the denying policy and the reason are returned.
+func Evaluate(policies []v1alpha1.ClusterIdentityPolicy, namespace *corev1.Namespace, providerType string, identity *provider.Identity) (*v1alpha1.ClusterIdentityPolicy, error) {
+	for i := range policies {
+		selected, err := selectsNamespace(policies[i].Spec, namespace)
+		if err != nil {
+			return &policies[i], fmt.Errorf("policy %s has an invalid namespace selector: %w", policies[i].Name, err)
+		}
+		if !selected {
+			continue
+		}
+		if identity == nil {
+			return &policies[i], fmt.Errorf("policy %s: provider %s did not describe the identity", policies[i].Name, providerType)
+		}
+		if !slices.ContainsFunc(policies[i].Spec.Rules, func(rule v1alpha1.IdentityPolicyRule) bool {
+			return matchesRule(rule, namespace.Name, providerType, identity)
+		}) {
+			return &policies[i], fmt.Errorf("policy %s does not allow identity %s in namespace %s", policies[i].Name, identity.ResourceID, namespace.Name)
+		}
+	}
+	return nil, nil
+}
+
+// SelectsNamespace reports whether any policy selects the namespace. Policies with an invalid selector select every
+// namespace, Evaluate denies all identities for them.
+func SelectsNamespace(policies []v1alpha1.ClusterIdentityPolicy, namespace *corev1.Namespace) bool {
+	return slices.ContainsFunc(policies, func(policy v1alpha1.ClusterIdentityPolicy) bool {
+		selected, err := selectsNamespace(policy.Spec, namespace)
+		return selected || err != nil
+	})
+}
+
+func selectsNamespace(spec v1alpha1.ClusterIdentityPolicySpec, namespace *corev1.Namespace) (bool, error) {
+	if slices.Contains(spec.Namespaces, namespace.Name) {
+		return true, nil
+	}
+	if spec.NamespaceSelector == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(spec.NamespaceSelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(namespace.Labels)), nil
+}
+
+func matchesRule(rule v1alpha1.IdentityPolicyRule, namespace string, providerType string, identity *provider.Identity) bool {
+	if len(rule.Providers) > 0 && !slices.Contains(rule.Providers, providerType) {
+		return false
+	}
+	// Azure IDs and names are case insensitive
+	if !containsFold(rule.TenantIDs, identity.TenantID) ||
+		!containsFold(rule.SubscriptionIDs, identity.SubscriptionID) ||
+		!containsFold(rule.ResourceGroups, identity.ResourceGroup) {
+		return false
+	}
+	if len(rule.Projects) > 0 && !slices.Contains(rule.Projects, identity.Project) {
+		return false
+	}
+	for key, value := range rule.Tags {
+		if value == namespacePlaceholder {
+			value = namespace
+		}
+		if identity.Tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold reports whether the list is empty or contains the value, ignoring case
+func containsFold(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(list, func(item string) bool {
+		return strings.EqualFold(item, value)
+	})
+}
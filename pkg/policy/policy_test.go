@@ -0,0 +1,176 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/apis/v1alpha1"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newPolicy(name string, spec v1alpha1.ClusterIdentityPolicySpec) v1alpha1.ClusterIdentityPolicy {
+	return v1alpha1.ClusterIdentityPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+}
+
+func TestEvaluate(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"env": "prod"}}}
+	identity := &provider.Identity{
+		ResourceID:     "/subscriptions/sub-1/resourceGroups/rg-team-a/providers/Microsoft.ManagedIdentity/userAssignedIdentities/app",
+		TenantID:       "Tenant-1",
+		SubscriptionID: "sub-1",
+		ResourceGroup:  "RG-Team-A",
+		Tags:           map[string]string{"namespace": "team-a", "env": "prod"},
+	}
+	prodSelector := &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}}
+
+	tests := []struct {
+		name        string
+		policies    []v1alpha1.ClusterIdentityPolicy
+		provider    string
+		identity    *provider.Identity
+		wantDenied  string
+		wantAllowed bool
+	}{
+		{
+			name:        "no policies",
+			wantAllowed: true,
+		},
+		{
+			name: "policy of another namespace",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("team-b", v1alpha1.ClusterIdentityPolicySpec{Namespaces: []string{"team-b"}, Rules: []v1alpha1.IdentityPolicyRule{{TenantIDs: []string{"other"}}}}),
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "matching rule ignoring case",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("azure", v1alpha1.ClusterIdentityPolicySpec{Namespaces: []string{"team-a"}, Rules: []v1alpha1.IdentityPolicyRule{
+					{Providers: []string{"azure"}, TenantIDs: []string{"tenant-1"}, SubscriptionIDs: []string{"SUB-1"}, ResourceGroups: []string{"rg-team-a"}},
+				}}),
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "namespace placeholder in tags",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("tags", v1alpha1.ClusterIdentityPolicySpec{NamespaceSelector: prodSelector, Rules: []v1alpha1.IdentityPolicyRule{
+					{Tags: map[string]string{"namespace": "<NAMESPACE>", "env": "prod"}},
+				}}),
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "tag of another namespace",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("tags", v1alpha1.ClusterIdentityPolicySpec{NamespaceSelector: prodSelector, Rules: []v1alpha1.IdentityPolicyRule{
+					{Tags: map[string]string{"namespace": "team-b"}},
+				}}),
+			},
+			wantDenied: "tags",
+		},
+		{
+			name: "rule of another provider",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("gcp", v1alpha1.ClusterIdentityPolicySpec{Namespaces: []string{"team-a"}, Rules: []v1alpha1.IdentityPolicyRule{{Providers: []string{"gcp"}}}}),
+			},
+			wantDenied: "gcp",
+		},
+		{
+			name: "one matching rule is enough",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("rules", v1alpha1.ClusterIdentityPolicySpec{Namespaces: []string{"team-a"}, Rules: []v1alpha1.IdentityPolicyRule{
+					{Projects: []string{"project-a"}},
+					{ResourceGroups: []string{"rg-team-a"}},
+				}}),
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "every selecting policy must allow",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("allow", v1alpha1.ClusterIdentityPolicySpec{Namespaces: []string{"team-a"}, Rules: []v1alpha1.IdentityPolicyRule{{}}}),
+				newPolicy("deny", v1alpha1.ClusterIdentityPolicySpec{NamespaceSelector: prodSelector, Rules: []v1alpha1.IdentityPolicyRule{{SubscriptionIDs: []string{"sub-2"}}}}),
+			},
+			wantDenied: "deny",
+		},
+		{
+			name: "selecting policy without rules",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("empty", v1alpha1.ClusterIdentityPolicySpec{Namespaces: []string{"team-a"}}),
+			},
+			wantDenied: "empty",
+		},
+		{
+			name: "invalid namespace selector",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("invalid", v1alpha1.ClusterIdentityPolicySpec{
+					NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "env", Operator: "Unknown"}}},
+					Rules:             []v1alpha1.IdentityPolicyRule{{}},
+				}),
+			},
+			wantDenied: "invalid",
+		},
+		{
+			name: "provider without identity",
+			policies: []v1alpha1.ClusterIdentityPolicy{
+				newPolicy("allow", v1alpha1.ClusterIdentityPolicySpec{Namespaces: []string{"team-a"}, Rules: []v1alpha1.IdentityPolicyRule{{}}}),
+			},
+			provider:   "plugin",
+			wantDenied: "allow",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providerType, id := "azure", identity
+			if tt.provider != "" {
+				providerType, id = tt.provider, tt.identity
+			}
+
+			denied, err := Evaluate(tt.policies, namespace, providerType, id)
+			if tt.wantAllowed {
+				if denied != nil || err != nil {
+					t.Fatalf("expected identity to be allowed, denied by %v: %v", denied, err)
+				}
+				return
+			}
+			if denied == nil || err == nil {
+				t.Fatal("expected identity to be denied")
+			}
+			if denied.Name != tt.wantDenied {
+				t.Errorf("expected denial by policy %s, got %s", tt.wantDenied, denied.Name)
+			}
+		})
+	}
+}
+
+func TestSelectsNamespace(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"env": "prod"}}}
+
+	tests := []struct {
+		name     string
+		spec     v1alpha1.ClusterIdentityPolicySpec
+		selected bool
+	}{
+		{name: "namespace list", spec: v1alpha1.ClusterIdentityPolicySpec{Namespaces: []string{"team-b", "team-a"}}, selected: true},
+		{name: "matching selector", spec: v1alpha1.ClusterIdentityPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}}}, selected: true},
+		{name: "other selector", spec: v1alpha1.ClusterIdentityPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "dev"}}}},
+		{name: "neither list nor selector", spec: v1alpha1.ClusterIdentityPolicySpec{}},
+		{
+			name: "invalid selector",
+			spec: v1alpha1.ClusterIdentityPolicySpec{
+				NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "env", Operator: "Unknown"}}},
+			},
+			selected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies := []v1alpha1.ClusterIdentityPolicy{newPolicy("policy", tt.spec)}
+			if selected := SelectsNamespace(policies, namespace); selected != tt.selected {
+				t.Errorf("expected selected %t, got %t", tt.selected, selected)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// alibabaRoleNameAnnotation represents the RAM role to be used with the Kubernetes service account on ACK with RRSA
+	alibabaRoleNameAnnotation = "pod-identity.alibabacloud.com/role-name"
+	// alibabaSubjectConditionKey is the condition key of the service account subject in RRSA trust policies
+	alibabaSubjectConditionKey = "oidc:sub"
+	// alibabaRoleQueryConcurrency limits the parallel GetRole calls
+	alibabaRoleQueryConcurrency = 10
+)
+
+// alibabaQueryProvider finds RAM roles whose trust policy allows the cluster's OIDC provider to assume them for the service account
+type alibabaQueryProvider struct {
+	defaultQueryProvider
+	client *alibabaRPCClient
+}
+
+func NewAlibabaQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config) (*alibabaQueryProvider, error) {
+	return &alibabaQueryProvider{
+		defaultQueryProvider: defaultQueryProvider{
+			Logger:         logger,
+			config:         config,
+			serviceAccount: serviceAccount,
+		},
+		client: &alibabaRPCClient{
+			ramEndpoint: config.AlibabaRAMEndpoint,
+			stsEndpoint: config.AlibabaSTSEndpoint,
+			httpClient:  &http.Client{Timeout: 30 * time.Second},
+		},
+	}, nil
+}
+
+// Query reads the trust policy of every RAM role with GetRole, as ListRoles doesn't return it. Roles aren't cached,
+// so every admission costs one ListRoles call per 1000 roles and one GetRole call per role.
+func (a *alibabaQueryProvider) Query(ctx context.Context) (*corev1.ServiceAccount, error) {
+	roles, err := a.client.listRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.Logger.Info("Detected RAM roles to check", "rolesCount", len(roles))
+
+	var candidates []*Identity
+	var errs []error
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	semaphore := make(chan struct{}, alibabaRoleQueryConcurrency)
+	for _, role := range roles {
+		wg.Add(1)
+		go func(roleName string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			role, err := a.client.getRole(ctx, roleName)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			if a.trusts(role) {
+				a.Logger.Info("Found matching RAM role", "role", role.RoleName)
+				candidates = append(candidates, &Identity{ResourceID: role.Arn, ClientID: role.RoleName})
+			}
+		}(role.RoleName)
+	}
+	wg.Wait()
+	// a role which couldn't be read may be the only match or make the match ambiguous, so the result would be partial
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to get %d of %d RAM roles: %w", len(errs), len(roles), errors.Join(errs...))
+	}
+
+	selected, ambiguous := a.selectCandidates(candidates)
+	if ambiguous {
+		return nil, fmt.Errorf("%w: multiple RAM roles were found, cannot decide which one to use", ErrAmbiguousIdentity)
+	}
+	if selected != nil {
+		if a.serviceAccount.Annotations == nil {
+			a.serviceAccount.Annotations = make(map[string]string)
+		}
+		a.serviceAccount.Annotations[alibabaRoleNameAnnotation] = selected.ClientID
+		a.identity = selected
+	}
+	return a.serviceAccount, nil
+}
+
+// Verify checks that the RAM role annotated on the service account trusts it
+func (a *alibabaQueryProvider) Verify(ctx context.Context) ([]string, error) {
+	roleName := a.serviceAccount.Annotations[alibabaRoleNameAnnotation]
+	if roleName == "" {
+		return nil, nil
+	}
+
+	role, err := a.client.getRole(ctx, roleName)
+	var apiErr *alibabaError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return []string{fmt.Sprintf("RAM role %s not found", roleName)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !a.trusts(role) {
+		return []string{fmt.Sprintf("RAM role %s does not allow %s to assume it for %s",
+			roleName, a.config.AlibabaOidcProviderArn, ServiceAccountSubject(a.serviceAccount))}, nil
+	}
+	return nil, nil
+}
+
+// alibabaStringList is a policy element which is either a single string or a list of strings
+type alibabaStringList []string
+
+func (l *alibabaStringList) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*l = []string{value}
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*l = values
+	return nil
+}
+
+// alibabaTrustPolicy is the AssumeRolePolicyDocument of a RAM role
+type alibabaTrustPolicy struct {
+	Statement []struct {
+		Effect    string            `json:"Effect"`
+		Action    alibabaStringList `json:"Action"`
+		Principal struct {
+			Federated alibabaStringList `json:"Federated"`
+		} `json:"Principal"`
+		Condition map[string]map[string]alibabaStringList `json:"Condition"`
+	} `json:"Statement"`
+}
+
+// trusts reports whether the trust policy of the role allows the cluster's OIDC provider to assume it for the service account.
+// Statements without a condition on the subject are ignored, as they trust every service account of the cluster.
+func (a *alibabaQueryProvider) trusts(role *alibabaRole) bool {
+	var policy alibabaTrustPolicy
+	if err := json.Unmarshal([]byte(role.AssumeRolePolicyDocument), &policy); err != nil {
+		a.Logger.Info("Failed to parse trust policy of RAM role", "role", role.RoleName, "error", err.Error())
+		return false
+	}
+
+	subject := ServiceAccountSubject(a.serviceAccount)
+	for _, statement := range policy.Statement {
+		if statement.Effect != "Allow" || !slices.Contains(statement.Action, "sts:AssumeRole") ||
+			!slices.Contains(statement.Principal.Federated, a.config.AlibabaOidcProviderArn) {
+			continue
+		}
+		if slices.Contains(statement.Condition["StringEquals"][alibabaSubjectConditionKey], subject) {
+			return true
+		}
+		if slices.ContainsFunc(statement.Condition["StringLike"][alibabaSubjectConditionKey], func(pattern string) bool {
+			matched, _ := path.Match(pattern, subject)
+			return matched
+		}) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package provider
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	alibabaRAMVersion = "2015-05-01"
+	alibabaSTSVersion = "2015-04-01"
+	// alibabaCredentialRefreshMargin renews temporary credentials before they expire
+	alibabaCredentialRefreshMargin = 5 * time.Minute
+)
+
+// alibabaCredential is an access key, optionally with the security token of temporary credentials
+type alibabaCredential struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	AccessKeySecret string `json:"AccessKeySecret"`
+	SecurityToken   string `json:"SecurityToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+var (
+	// alibabaCredentialCache holds the temporary credentials obtained with RRSA, which are shared between all requests
+	alibabaCredentialCache      *alibabaCredential
+	alibabaCredentialCacheMutex sync.Mutex
+)
+
+// alibabaRPCClient calls the RPC style APIs of Alibaba Cloud, signed with signature version 1.0
+type alibabaRPCClient struct {
+	ramEndpoint string
+	stsEndpoint string
+	httpClient  *http.Client
+}
+
+// alibabaRole is a RAM role as returned by ListRoles and GetRole
+type alibabaRole struct {
+	RoleName                 string `json:"RoleName"`
+	Arn                      string `json:"Arn"`
+	AssumeRolePolicyDocument string `json:"AssumeRolePolicyDocument"`
+}
+
+// alibabaError is the error response of the RPC APIs
+type alibabaError struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"Code"`
+	Message    string `json:"Message"`
+	RequestID  string `json:"RequestId"`
+}
+
+func (e *alibabaError) Error() string {
+	return fmt.Sprintf("alibaba cloud API error %d %s: %s (request ID %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+// listRoles returns all RAM roles of the account
+func (c *alibabaRPCClient) listRoles(ctx context.Context) ([]alibabaRole, error) {
+	var roles []alibabaRole
+	marker := ""
+	for {
+		params := map[string]string{"MaxItems": "1000"}
+		if marker != "" {
+			params["Marker"] = marker
+		}
+		var page struct {
+			Roles struct {
+				Role []alibabaRole `json:"Role"`
+			} `json:"Roles"`
+			IsTruncated bool   `json:"IsTruncated"`
+			Marker      string `json:"Marker"`
+		}
+		if err := c.call(ctx, c.ramEndpoint, alibabaRAMVersion, "ListRoles", params, true, &page); err != nil {
+			return nil, err
+		}
+		roles = append(roles, page.Roles.Role...)
+		if !page.IsTruncated || page.Marker == "" {
+			return roles, nil
+		}
+		marker = page.Marker
+	}
+}
+
+// getRole returns the RAM role including its trust policy
+func (c *alibabaRPCClient) getRole(ctx context.Context, roleName string) (*alibabaRole, error) {
+	var response struct {
+		Role alibabaRole `json:"Role"`
+	}
+	if err := c.call(ctx, c.ramEndpoint, alibabaRAMVersion, "GetRole", map[string]string{"RoleName": roleName}, true, &response); err != nil {
+		return nil, err
+	}
+	return &response.Role, nil
+}
+
+// credential returns the access key configured via ALIBABA_CLOUD_ACCESS_KEY_ID and ALIBABA_CLOUD_ACCESS_KEY_SECRET or,
+// if the webhook itself runs with RRSA, temporary credentials obtained with AssumeRoleWithOIDC
+func (c *alibabaRPCClient) credential(ctx context.Context) (*alibabaCredential, error) {
+	if accessKeyID := os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_ID"); accessKeyID != "" {
+		return &alibabaCredential{
+			AccessKeyID:     accessKeyID,
+			AccessKeySecret: os.Getenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET"),
+			SecurityToken:   os.Getenv("ALIBABA_CLOUD_SECURITY_TOKEN"),
+		}, nil
+	}
+
+	roleArn, providerArn, tokenFile := os.Getenv("ALIBABA_CLOUD_ROLE_ARN"), os.Getenv("ALIBABA_CLOUD_OIDC_PROVIDER_ARN"), os.Getenv("ALIBABA_CLOUD_OIDC_TOKEN_FILE")
+	if roleArn == "" || providerArn == "" || tokenFile == "" {
+		return nil, errors.New("no alibaba cloud credentials found, set ALIBABA_CLOUD_ACCESS_KEY_ID or enable RRSA for the webhook")
+	}
+
+	alibabaCredentialCacheMutex.Lock()
+	defer alibabaCredentialCacheMutex.Unlock()
+	if alibabaCredentialCache != nil {
+		expiration, err := time.Parse(time.RFC3339, alibabaCredentialCache.Expiration)
+		if err == nil && time.Until(expiration) > alibabaCredentialRefreshMargin {
+			return alibabaCredentialCache, nil
+		}
+	}
+
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OIDC token: %w", err)
+	}
+	var response struct {
+		Credentials alibabaCredential `json:"Credentials"`
+	}
+	if err := c.call(ctx, c.stsEndpoint, alibabaSTSVersion, "AssumeRoleWithOIDC", map[string]string{
+		"RoleArn":         roleArn,
+		"OIDCProviderArn": providerArn,
+		"OIDCToken":       strings.TrimSpace(string(token)),
+		"RoleSessionName": "azure-clientid-syncer",
+	}, false, &response); err != nil {
+		return nil, err
+	}
+	alibabaCredentialCache = &response.Credentials
+	return alibabaCredentialCache, nil
+}
+
+// call invokes the action and decodes the JSON response. Signed requests use the credential of the client.
+func (c *alibabaRPCClient) call(ctx context.Context, endpoint string, version string, action string, params map[string]string, signed bool, response interface{}) error {
+	query := map[string]string{
+		"Action":    action,
+		"Format":    "JSON",
+		"Version":   version,
+		"Timestamp": time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	for key, value := range params {
+		query[key] = value
+	}
+	if signed {
+		cred, err := c.credential(ctx)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		query["AccessKeyId"] = cred.AccessKeyID
+		query["SignatureMethod"] = "HMAC-SHA1"
+		query["SignatureVersion"] = "1.0"
+		query["SignatureNonce"] = hex.EncodeToString(nonce)
+		if cred.SecurityToken != "" {
+			query["SecurityToken"] = cred.SecurityToken
+		}
+		query["Signature"] = alibabaSignature(http.MethodGet, query, cred.AccessKeySecret)
+	}
+
+	values := url.Values{}
+	for key, value := range query {
+		values.Set(key, value)
+	}
+	ctx, end := startAPICall(ctx, "alibaba", action)
+	err := c.send(ctx, strings.TrimSuffix(endpoint, "/")+"/?"+values.Encode(), response)
+	end(err)
+	return err
+}
+
+// send sends the request and decodes the JSON response
+func (c *alibabaRPCClient) send(ctx context.Context, address string, response interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &alibabaError{StatusCode: resp.StatusCode}
+		_ = json.Unmarshal(body, apiErr)
+		return apiErr
+	}
+	return json.Unmarshal(body, response)
+}
+
+// alibabaSignature signs the canonicalized query with HMAC-SHA1 as specified by signature version 1.0 of the RPC APIs
+func alibabaSignature(method string, query map[string]string, secret string) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, alibabaPercentEncode(key)+"="+alibabaPercentEncode(query[key]))
+	}
+	stringToSign := method + "&" + alibabaPercentEncode("/") + "&" + alibabaPercentEncode(strings.Join(pairs, "&"))
+
+	mac := hmac.New(sha1.New, []byte(secret+"&"))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// alibabaPercentEncode encodes according to RFC 3986 as required by the signature
+func alibabaPercentEncode(value string) string {
+	encoded := url.QueryEscape(value)
+	encoded = strings.ReplaceAll(encoded, "+", "%20")
+	encoded = strings.ReplaceAll(encoded, "*", "%2A")
+	return strings.ReplaceAll(encoded, "%7E", "~")
+}
@@ -0,0 +1,316 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testAlibabaAccessKeyID     = "testid"
+	testAlibabaAccessKeySecret = "testsecret"
+	testAlibabaProviderArn     = "acs:ram::1234:oidc-provider/ack-rrsa-cluster"
+	// testAlibabaPageSize is the number of roles returned per ListRoles page
+	testAlibabaPageSize = 2
+)
+
+// fakeRAM serves ListRoles and GetRole for the configured roles and rejects requests with an invalid signature
+type fakeRAM struct {
+	mu sync.Mutex
+	// roles maps the role names to their trust policies
+	roles map[string]string
+	// failing are the roles for which GetRole fails
+	failing map[string]bool
+	// actions are the actions of all requests
+	actions []string
+}
+
+func newFakeRAM(t *testing.T, roles map[string]string) (*fakeRAM, *httptest.Server) {
+	ram := &fakeRAM{roles: roles, failing: map[string]bool{}}
+	server := httptest.NewServer(ram)
+	t.Cleanup(server.Close)
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_ID", testAlibabaAccessKeyID)
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", testAlibabaAccessKeySecret)
+	t.Setenv("ALIBABA_CLOUD_SECURITY_TOKEN", "")
+	return ram, server
+}
+
+func (f *fakeRAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := map[string]string{}
+	for key, values := range r.URL.Query() {
+		query[key] = values[0]
+	}
+	f.actions = append(f.actions, query["Action"])
+	signature := query["Signature"]
+	delete(query, "Signature")
+	if query["AccessKeyId"] != testAlibabaAccessKeyID || query["SignatureMethod"] != "HMAC-SHA1" || query["SignatureVersion"] != "1.0" ||
+		query["SignatureNonce"] == "" || signature != alibabaSignature(r.Method, query, testAlibabaAccessKeySecret) {
+		f.fail(w, http.StatusBadRequest, "SignatureDoesNotMatch")
+		return
+	}
+
+	switch query["Action"] {
+	case "ListRoles":
+		names := make([]string, 0, len(f.roles))
+		for name := range f.roles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		start, _ := strconv.Atoi(query["Marker"])
+		end := min(start+testAlibabaPageSize, len(names))
+		page := map[string]any{"IsTruncated": end < len(names)}
+		if end < len(names) {
+			page["Marker"] = strconv.Itoa(end)
+		}
+		var roles []alibabaRole
+		for _, name := range names[start:end] {
+			roles = append(roles, alibabaRole{RoleName: name, Arn: "acs:ram::1234:role/" + name})
+		}
+		page["Roles"] = map[string]any{"Role": roles}
+		_ = json.NewEncoder(w).Encode(page)
+	case "GetRole":
+		name := query["RoleName"]
+		policy, ok := f.roles[name]
+		switch {
+		case !ok:
+			f.fail(w, http.StatusNotFound, "EntityNotExist.Role")
+		case f.failing[name]:
+			f.fail(w, http.StatusInternalServerError, "InternalError")
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"Role": alibabaRole{RoleName: name, Arn: "acs:ram::1234:role/" + name, AssumeRolePolicyDocument: policy},
+			})
+		}
+	default:
+		f.fail(w, http.StatusBadRequest, "InvalidAction.NotFound")
+	}
+}
+
+func (f *fakeRAM) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(alibabaError{Code: code, Message: code, RequestID: "request"})
+}
+
+// alibabaTrustPolicyDocument returns a trust policy with a single statement allowing the provider to assume the role
+func alibabaTrustPolicyDocument(effect, providerArn string, condition map[string]map[string]any) string {
+	statement := map[string]any{
+		"Effect":    effect,
+		"Action":    "sts:AssumeRole",
+		"Principal": map[string]any{"Federated": []string{providerArn}},
+	}
+	if condition != nil {
+		statement["Condition"] = condition
+	}
+	document, _ := json.Marshal(map[string]any{"Version": "1", "Statement": []any{statement}})
+	return string(document)
+}
+
+func newTestAlibabaQueryProvider(t *testing.T, server *httptest.Server, serviceAccount *corev1.ServiceAccount) *alibabaQueryProvider {
+	provider, err := NewAlibabaQueryProvider(serviceAccount, logr.Discard(), config.Config{
+		AlibabaOidcProviderArn: testAlibabaProviderArn,
+		AlibabaRAMEndpoint:     server.URL,
+		AlibabaSTSEndpoint:     server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestAlibabaQuery(t *testing.T) {
+	exact := map[string]map[string]any{"StringEquals": {"oidc:sub": "system:serviceaccount:team-a:app"}}
+	glob := map[string]map[string]any{"StringLike": {"oidc:sub": []string{"system:serviceaccount:team-a:*"}}}
+	otherNamespace := map[string]map[string]any{"StringLike": {"oidc:sub": "system:serviceaccount:team-b:*"}}
+
+	tests := []struct {
+		name     string
+		roles    map[string]string
+		failing  []string
+		wantRole string
+		wantErr  error
+		// wantAPIError expects the error of a failed API call
+		wantAPIError bool
+	}{
+		{
+			name: "subject equals",
+			roles: map[string]string{
+				"app":   alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, exact),
+				"other": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, otherNamespace),
+			},
+			wantRole: "app",
+		},
+		{
+			name: "subject like",
+			roles: map[string]string{
+				"team-a": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, glob),
+				"team-b": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, otherNamespace),
+			},
+			wantRole: "team-a",
+		},
+		{
+			name:  "statement without subject condition",
+			roles: map[string]string{"cluster": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, nil)},
+		},
+		{
+			name:  "other OIDC provider",
+			roles: map[string]string{"app": alibabaTrustPolicyDocument("Allow", "acs:ram::1234:oidc-provider/other", exact)},
+		},
+		{
+			name:  "deny statement",
+			roles: map[string]string{"app": alibabaTrustPolicyDocument("Deny", testAlibabaProviderArn, exact)},
+		},
+		{
+			name:  "invalid trust policy",
+			roles: map[string]string{"app": "{"},
+		},
+		{
+			name: "roles on several pages",
+			roles: map[string]string{
+				"a": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, otherNamespace),
+				"b": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, otherNamespace),
+				"c": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, otherNamespace),
+				"d": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, otherNamespace),
+				"e": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, exact),
+			},
+			wantRole: "e",
+		},
+		{
+			name: "several matching roles",
+			roles: map[string]string{
+				"app":    alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, exact),
+				"team-a": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, glob),
+			},
+			wantErr: ErrAmbiguousIdentity,
+		},
+		{
+			name: "failing GetRole besides a match",
+			roles: map[string]string{
+				"app":    alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, exact),
+				"broken": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, glob),
+			},
+			failing:      []string{"broken"},
+			wantAPIError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ram, server := newFakeRAM(t, tt.roles)
+			for _, name := range tt.failing {
+				ram.failing[name] = true
+			}
+			serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}
+
+			_, err := newTestAlibabaQueryProvider(t, server, serviceAccount).Query(context.Background())
+			var apiErr *alibabaError
+			switch {
+			case tt.wantAPIError:
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("expected API error, got %v", err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := serviceAccount.Annotations[alibabaRoleNameAnnotation]; got != tt.wantRole {
+				t.Errorf("expected role %q, got %q", tt.wantRole, got)
+			}
+		})
+	}
+}
+
+func TestAlibabaVerify(t *testing.T) {
+	exact := map[string]map[string]any{"StringEquals": {"oidc:sub": "system:serviceaccount:team-a:app"}}
+
+	tests := []struct {
+		name         string
+		role         string
+		wantWarnings int
+	}{
+		{name: "trusting role", role: "app"},
+		{name: "role without trust", role: "other", wantWarnings: 1},
+		{name: "missing role", role: "missing", wantWarnings: 1},
+		{name: "no role annotation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, server := newFakeRAM(t, map[string]string{
+				"app":   alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, exact),
+				"other": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, nil),
+			})
+			serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}
+			if tt.role != "" {
+				serviceAccount.Annotations = map[string]string{alibabaRoleNameAnnotation: tt.role}
+			}
+
+			warnings, err := newTestAlibabaQueryProvider(t, server, serviceAccount).Verify(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("expected %d warnings, got %v", tt.wantWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestAlibabaSignedRequests(t *testing.T) {
+	ram, server := newFakeRAM(t, map[string]string{"app": alibabaTrustPolicyDocument("Allow", testAlibabaProviderArn, nil)})
+	client := newTestAlibabaQueryProvider(t, server, &corev1.ServiceAccount{}).client
+
+	if _, err := client.getRole(context.Background(), "app"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the role name needs percent encoding in the string to sign, a wrong encoding fails with a signature mismatch
+	var apiErr *alibabaError
+	if _, err := client.getRole(context.Background(), "app name/~*"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	t.Setenv("ALIBABA_CLOUD_ACCESS_KEY_SECRET", "wrong")
+	if _, err := client.listRoles(context.Background()); !errors.As(err, &apiErr) || apiErr.Code != "SignatureDoesNotMatch" {
+		t.Fatalf("expected signature mismatch, got %v", err)
+	}
+	if len(ram.actions) != 3 {
+		t.Errorf("expected 3 requests, got %v", ram.actions)
+	}
+}
+
+func TestAlibabaSignature(t *testing.T) {
+	// example of the signature documentation of the RPC APIs
+	query := map[string]string{
+		"AccessKeyId":      "testid",
+		"Action":           "DescribeRegions",
+		"Format":           "XML",
+		"SignatureMethod":  "HMAC-SHA1",
+		"SignatureNonce":   "3ee8c1b8-83d3-44af-a94f-4e0ad82fd6cf",
+		"SignatureVersion": "1.0",
+		"Timestamp":        "2016-02-23T12:46:24Z",
+		"Version":          "2014-05-26",
+	}
+	if got, want := alibabaSignature(http.MethodGet, query, "testsecret"), "OLeaidS1JvxuMvnyHOwuJ+uX5qY="; got != want {
+		t.Errorf("expected signature %s, got %s", want, got)
+	}
+
+	for value, want := range map[string]string{"a b": "a%20b", "a*b": "a%2Ab", "a~b": "a~b", "a/b": "a%2Fb", "a+b": "a%2Bb"} {
+		if got := alibabaPercentEncode(value); got != want {
+			t.Errorf("expected %q to encode as %s, got %s", value, want, got)
+		}
+	}
+}
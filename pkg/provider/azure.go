@@ -6,12 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
@@ -19,139 +23,381 @@ import (
 	arg "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
 	"github.com/go-logr/logr"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
 )
 
+// guidRegexp matches client and tenant IDs
+var guidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// errAzureIdentityNotFound is returned by the search of a tenant if no identity trusts the service account
+var errAzureIdentityNotFound = errors.New("failed to find clientid for service account")
+
+// defaultResourceManagerEndpoint is used if AZURE_RESOURCE_MANAGER_ENDPOINT is not set
+const defaultResourceManagerEndpoint = "https://management.azure.com"
+
 type azureQueryProvider struct {
 	defaultQueryProvider
-	Subscriptions                SubscriptionList
-	cred                         *azidentity.DefaultAzureCredential
+	// tenants are searched in order, the first tenant containing a matching identity wins
+	tenants []azureTenant
+	// dryRun prevents the provisioning of federated identity credentials
+	dryRun bool
 }
 
-func NewAzureQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config) (*azureQueryProvider, error) {
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		logger.Error(err, "failed to obtain a credential")
-		return nil, err
-	}
-	subscriptionList, err := retrieveCurrentSubscriptionList()
-	if err != nil {
-		logger.Error(err, "failed to retrieve current subscription list")
-		return nil, err
+// azureTenant holds the credential and the subscriptions used to search for identities in a single tenant
+type azureTenant struct {
+	ID            string
+	Subscriptions SubscriptionList
+	cred          azcore.TokenCredential
+}
+
+func NewAzureQueryProvider(ctx context.Context, serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config, dryRun bool) (*azureQueryProvider, error) {
+	var tenants []azureTenant
+	for _, tenantID := range config.AzureTenantIDs() {
+		cred, err := newAzureCredential(tenantID, config.TenantClientIDs[tenantID])
+		if err != nil {
+			logger.Error(err, "failed to obtain a credential", "tenantId", tenantID)
+			return nil, err
+		}
+		var subscriptionList *SubscriptionList
+		scoped, unscoped := config.TenantSubscriptionIDs(tenantID)
+		// plain subscription IDs are only searched in the tenants which can see them, unless there is a single tenant
+		if len(scoped) > 0 && len(unscoped) == 0 || len(unscoped) > 0 && len(config.AzureTenantIDs()) == 1 {
+			subscriptionList = newSubscriptionList(append(scoped, unscoped...))
+		} else {
+			subscriptionList, err = retrieveCurrentSubscriptionList(ctx, tenantID, cred, resourceManagerEndpoint(config))
+			if err != nil {
+				logger.Error(err, "failed to retrieve current subscription list", "tenantId", tenantID)
+				return nil, err
+			}
+			if len(unscoped) > 0 {
+				subscriptionList = filterSubscriptionList(subscriptionList, unscoped, scoped)
+			}
+		}
+		if len(config.SubscriptionIDs) > 0 && len(subscriptionList.Value) == 0 {
+			// an empty list would make Resource Graph search all subscriptions of the tenant
+			logger.Info("no configured subscription is visible in tenant, skipping it", "tenantId", tenantID)
+			continue
+		}
+		tenants = append(tenants, azureTenant{
+			ID:            tenantID,
+			Subscriptions: *subscriptionList,
+			cred:          cred,
+		})
 	}
 	return &azureQueryProvider{
 		defaultQueryProvider: defaultQueryProvider{
-			Logger: logger,
-			config: config,
+			Logger:         logger,
+			config:         config,
 			serviceAccount: serviceAccount,
 		},
-		cred: cred,
-		Subscriptions: *subscriptionList,
+		tenants: tenants,
+		dryRun:  dryRun,
 	}, nil
 }
 
-func (a *azureQueryProvider) Query() (*corev1.ServiceAccount, error) {
+// resourceManagerEndpoint returns the configured Azure Resource Manager endpoint
+func resourceManagerEndpoint(config config.Config) string {
+	if config.ResourceManagerEndpoint != "" {
+		return strings.TrimSuffix(config.ResourceManagerEndpoint, "/")
+	}
+	return defaultResourceManagerEndpoint
+}
+
+// armTransport sends the requests of all ARM clients, the default transport is used if it is nil.
+// Tests replace it to trust the certificate of a fake ARM server.
+var armTransport policy.Transporter
+
+// armClientOptions returns the options of all ARM clients, pointing them to the configured endpoint
+func armClientOptions(config config.Config) *arm.ClientOptions {
+	if config.ResourceManagerEndpoint == "" {
+		return nil
+	}
+	return &arm.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Transport: armTransport,
+			Cloud: cloud.Configuration{
+				ActiveDirectoryAuthorityHost: cloud.AzurePublic.ActiveDirectoryAuthorityHost,
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {
+						Audience: cloud.AzurePublic.Services[cloud.ResourceManager].Audience,
+						Endpoint: resourceManagerEndpoint(config),
+					},
+				},
+			},
+		},
+	}
+}
+
+// newAzureCredential returns a credential for the given tenant. If a client ID is configured for the tenant
+// a workload identity credential for that client is used, otherwise the default credential chain is used.
+// It is a variable, so that tests can replace it.
+var newAzureCredential = func(tenantID string, clientID string) (azcore.TokenCredential, error) {
+	if clientID != "" {
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientID: clientID,
+			TenantID: tenantID,
+		})
+	}
+	return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+		TenantID: tenantID,
+	})
+}
+
+func (a *azureQueryProvider) Query(ctx context.Context) (*corev1.ServiceAccount, error) {
 	a.Logger.Info("identified service account with name: " + a.serviceAccount.Name + " and namespace: " + a.serviceAccount.Namespace)
 
-	clientid, err := a.searchForClientIdInSubscriptions()
+	if a.config.AzureProvisioningEnabled && (a.serviceAccount.Annotations[azureIdentityResourceIDAnnotation] != "" || a.serviceAccount.Annotations[azureIdentitySelectorAnnotation] != "") {
+		return a.provision(ctx)
+	}
 
-	if err == nil {
-		a.Logger.Info("Setting new annotations for service account", "name", a.serviceAccount.Name, "namespace", a.serviceAccount.Namespace, azureClientidAnnotation, clientid, azureTenantIDAnnotation, a.config.TenantID)
-		if a.serviceAccount.Annotations == nil {
-			a.serviceAccount.Annotations = make(map[string]string)
+	// identities of later tenants are still used if a tenant fails, but without a match the failures are returned,
+	// so that they are reported as ambiguous identities, audience mismatches or provider errors instead of not found
+	var errs []error
+	for _, tenant := range a.tenants {
+		identity, err := a.searchForClientIdInSubscriptions(ctx, tenant)
+		if errors.Is(err, errAzureIdentityNotFound) {
+			a.Logger.Info("Failed to find clientid for service account in tenant", "name", a.serviceAccount.Name, "namespace", a.serviceAccount.Namespace, "tenantId", tenant.ID)
+			continue
+		}
+		if err != nil {
+			a.Logger.Info("Failed to search clientid for service account in tenant", "name", a.serviceAccount.Name, "namespace", a.serviceAccount.Namespace, "tenantId", tenant.ID, "reason", err.Error())
+			errs = append(errs, fmt.Errorf("tenant %s: %w", tenant.ID, err))
+			continue
 		}
-		a.serviceAccount.Annotations[azureClientidAnnotation] = *clientid
-		a.serviceAccount.Annotations[azureTenantIDAnnotation] = a.config.TenantID
-	} else {
-		a.Logger.Info("Failed to find clientid for service account. No changes will be patched.", "name", a.serviceAccount.Name, "namespace", a.serviceAccount.Namespace)
+
+		a.annotate(identity)
+		return a.serviceAccount, nil
 	}
 
+	a.Logger.Info("Failed to find clientid for service account. No changes will be patched.", "name", a.serviceAccount.Name, "namespace", a.serviceAccount.Namespace)
+	if len(errs) > 0 {
+		return a.serviceAccount, errors.Join(errs...)
+	}
 	return a.serviceAccount, nil
 }
 
-func (a azureQueryProvider) searchForClientIdInSubscriptions() (*string, error) {
-	identities, err := a.getUamis(a.cred)
-	if err != nil {
-		return nil, err
+// annotate sets the client and tenant ID of the identity on the service account
+func (a *azureQueryProvider) annotate(identity *Identity) {
+	a.Logger.Info("Setting new annotations for service account", "name", a.serviceAccount.Name, "namespace", a.serviceAccount.Namespace, azureClientidAnnotation, identity.ClientID, AzureTenantIDAnnotation, identity.TenantID)
+	if a.serviceAccount.Annotations == nil {
+		a.serviceAccount.Annotations = make(map[string]string)
 	}
+	a.serviceAccount.Annotations[azureClientidAnnotation] = identity.ClientID
+	a.serviceAccount.Annotations[AzureTenantIDAnnotation] = identity.TenantID
+	a.identity = identity
+}
 
-	ch := make(chan *string, 1)
-	var clientFactories = map[string]*armmsi.ClientFactory{}
+// Verify checks that the identity annotated on the service account has a federated identity credential trusting it
+func (a *azureQueryProvider) Verify(ctx context.Context) ([]string, error) {
+	clientID := a.serviceAccount.Annotations[azureClientidAnnotation]
+	if clientID == "" {
+		return nil, nil
+	}
+	if !guidRegexp.MatchString(clientID) {
+		return []string{fmt.Sprintf("client ID %s is not a valid GUID", clientID)}, nil
+	}
+	tenantID := a.serviceAccount.Annotations[AzureTenantIDAnnotation]
+	subject := "system:serviceaccount:" + a.serviceAccount.Namespace + ":" + a.serviceAccount.Name
 
-	for _, subscription := range a.Subscriptions.Value {
-		shortenedSubscriptionId := strings.Split(subscription.ID, "/")[2]
-		clientFactory, err := armmsi.NewClientFactory(shortenedSubscriptionId, a.cred, nil)
+	for _, tenant := range a.tenants {
+		if tenantID != "" && !strings.EqualFold(tenant.ID, tenantID) {
+			continue
+		}
+		identities, err := a.queryUamis(ctx, tenant, fmt.Sprintf("resources | where type == \"microsoft.managedidentity/userassignedidentities\" | where properties.clientId =~ '%s'", clientID))
 		if err != nil {
-			a.Logger.Error(err, "failed to create federated identity query client")
+			return nil, err
 		}
-		clientFactories[shortenedSubscriptionId] = clientFactory
+		if len(identities) == 0 {
+			continue
+		}
+
+		identity := identities[0]
+		candidates, mismatches, err := a.matchFederatedCredentials(ctx, identity, tenant, a.newClientFactories(tenant)[strings.Split(*identity.ID, "/")[2]])
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(candidates) > 0:
+			return nil, nil
+		case len(mismatches) > 0:
+			return mismatches, nil
+		default:
+			return []string{fmt.Sprintf("identity %s with client ID %s has no federated identity credential for issuer %s and subject %s",
+				*identity.ID, clientID, a.config.OidcIssuerUrl, subject)}, nil
+		}
+	}
+
+	return []string{fmt.Sprintf("no identity with client ID %s found", clientID)}, nil
+}
+
+// newAzureIdentity describes the given managed identity
+func newAzureIdentity(identity *armmsi.Identity, tenantID string) *Identity {
+	tags := map[string]string{}
+	for key, value := range identity.Tags {
+		if value != nil {
+			tags[key] = *value
+		}
+	}
+	return &Identity{
+		ResourceID:     *identity.ID,
+		ClientID:       *identity.Properties.ClientID,
+		TenantID:       tenantID,
+		SubscriptionID: strings.Split(*identity.ID, "/")[2],
+		ResourceGroup:  strings.Split(*identity.ID, "/")[4],
+		Tags:           tags,
+	}
+}
+
+// searchForClientIdInSubscriptions returns the identity with a federated identity credential trusting the service account
+// in the tenant. It fails if the credentials of any identity can't be listed, as the selected identity could be wrong.
+func (a azureQueryProvider) searchForClientIdInSubscriptions(ctx context.Context, tenant azureTenant) (*Identity, error) {
+	var candidates []*Identity
+	var mismatches []string
+	var errs []error
+	mu := sync.Mutex{}
+	err := a.visitUamis(ctx, tenant, func(identity *armmsi.Identity, clientFactory *armmsi.ClientFactory) {
+		identityCandidates, identityMismatches, err := a.matchFederatedCredentials(ctx, identity, tenant, clientFactory)
+		mu.Lock()
+		candidates = append(candidates, identityCandidates...)
+		mismatches = append(mismatches, identityMismatches...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list federated identity credentials of %s: %w", *identity.ID, err))
+		}
+		mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
+	selected, ambiguous := a.selectCandidates(candidates)
+	if selected == nil && len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return nil, fmt.Errorf("%w: %s", ErrAudienceMismatch, strings.Join(mismatches, "; "))
+	}
+	if selected == nil {
+		return nil, errAzureIdentityNotFound
+	}
+	if ambiguous {
+		return nil, fmt.Errorf("%w: multiple managed identities of the same rank were found, cannot decide which one to use", ErrAmbiguousIdentity)
+	}
+
+	return selected, nil
+}
+
+// visitUamis calls visit concurrently for every managed identity of the tenant found by the discovery query,
+// along with the client factory of its subscription
+func (a *azureQueryProvider) visitUamis(ctx context.Context, tenant azureTenant, visit func(identity *armmsi.Identity, clientFactory *armmsi.ClientFactory)) error {
+	identities, err := a.getUamis(ctx, tenant)
+	if err != nil {
+		return err
+	}
+
+	clientFactories := a.newClientFactories(tenant)
+
 	a.Logger.Info("Detected identities to check", "identitiesCount", len(identities))
 
 	wg := sync.WaitGroup{}
 	wg.Add(len(identities))
 
 	for _, identity := range identities {
-		go func(ch chan *string, identity *armmsi.Identity) {
+		go func(identity *armmsi.Identity) {
 			defer wg.Done()
-			a.Logger.Info("Checking identity", "clientId", *identity.Properties.ClientID)
-			resourceGroup := strings.Split(*identity.ID, "/")[4]
-			resourceName := strings.Split(*identity.ID, "/")[8]
-
-			federatedIdentityCredentials, err := a.getFederatedIdentityCredentialsForUami(resourceGroup, resourceName, clientFactories[strings.Split(*identity.ID, "/")[2]])
-			if err != nil || federatedIdentityCredentials == nil {
-				return
-			}
-			for _, i := range *federatedIdentityCredentials {
-				if *i.Properties.Issuer == a.config.OidcIssuerUrl && *i.Properties.Subject == "system:serviceaccount:"+a.serviceAccount.Namespace+":"+a.serviceAccount.Name {
-					a.Logger.Info("Found matching federated identity", "clientId", *identity.Properties.ClientID)
-					ch <- identity.Properties.ClientID
-				}
-			}
-			a.Logger.Info("Done checking identity: ", "clientId", *identity.Properties.ClientID)
-		}(ch, identity)
+			visit(identity, clientFactories[strings.Split(*identity.ID, "/")[2]])
+		}(identity)
 	}
 
-	go func() {
-		wg.Wait()
-		ch <- nil
-		close(ch)
-	}()
+	wg.Wait()
+	return nil
+}
 
-	v, ok := <-ch
+// newClientFactories creates a client factory for every subscription of the tenant, keyed by subscription ID
+func (a *azureQueryProvider) newClientFactories(tenant azureTenant) map[string]*armmsi.ClientFactory {
+	var clientFactories = map[string]*armmsi.ClientFactory{}
 
-	if !ok || v == nil {
-		return nil, errors.New("failed to find clientid for service account")
+	for _, subscription := range tenant.Subscriptions.Value {
+		shortenedSubscriptionId := strings.Split(subscription.ID, "/")[2]
+		clientFactory, err := armmsi.NewClientFactory(shortenedSubscriptionId, tenant.cred, armClientOptions(a.config))
+		if err != nil {
+			a.Logger.Error(err, "failed to create federated identity query client")
+		}
+		clientFactories[shortenedSubscriptionId] = clientFactory
 	}
+	return clientFactories
+}
+
+// matchFederatedCredentials returns a candidate for every federated identity credential of the identity which trusts the service account.
+// Credentials trusting the service account with the wrong audience are returned as mismatches.
+// An error is returned if the credentials can't be listed, which must not be mistaken for no trusting credential.
+func (a *azureQueryProvider) matchFederatedCredentials(ctx context.Context, identity *armmsi.Identity, tenant azureTenant, clientFactory *armmsi.ClientFactory) (candidates []*Identity, mismatches []string, err error) {
+	a.Logger.Info("Checking identity", "clientId", *identity.Properties.ClientID)
+	resourceGroup := strings.Split(*identity.ID, "/")[4]
+	resourceName := strings.Split(*identity.ID, "/")[8]
 
-	return v, nil
+	federatedIdentityCredentials, err := a.getFederatedIdentityCredentialsForUami(ctx, resourceGroup, resourceName, clientFactory)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, i := range *federatedIdentityCredentials {
+		if *i.Properties.Issuer != a.config.OidcIssuerUrl || *i.Properties.Subject != "system:serviceaccount:"+a.serviceAccount.Namespace+":"+a.serviceAccount.Name {
+			reportCredentialChecked(ctx, credentialResultOther)
+			continue
+		}
+		candidate := newAzureIdentity(identity, tenant.ID)
+		candidate.FederatedCredential = *i.Name
+		candidate.Issuer = *i.Properties.Issuer
+		candidate.Subject = *i.Properties.Subject
+		for _, audience := range i.Properties.Audiences {
+			if audience != nil {
+				candidate.Audiences = append(candidate.Audiences, *audience)
+			}
+		}
+		// a credential with a wrong audience is useless, the token exchange of the pod would fail
+		if !slices.ContainsFunc(candidate.Audiences, func(audience string) bool {
+			return slices.Contains(a.config.FederatedCredentialAudiences, audience)
+		}) {
+			a.Logger.Info("Found federated identity with mismatching audiences", "clientId", *identity.Properties.ClientID, "federatedCredential", *i.Name, "audiences", candidate.Audiences)
+			mismatches = append(mismatches, fmt.Sprintf("federated identity credential %s of identity %s has the audiences %v, expected one of %v",
+				*i.Name, *identity.ID, candidate.Audiences, a.config.FederatedCredentialAudiences))
+			reportCredentialChecked(ctx, credentialResultAudienceMismatch)
+			continue
+		}
+		a.Logger.Info("Found matching federated identity", "clientId", *identity.Properties.ClientID)
+		reportCredentialChecked(ctx, credentialResultMatched)
+		candidates = append(candidates, candidate)
+	}
+	a.Logger.Info("Done checking identity: ", "clientId", *identity.Properties.ClientID)
+	return candidates, mismatches, nil
 }
 
 // uses the resourceGroup and resourceName to return a pointer to a slice of FederatedIdentityCredentials
-func (a *azureQueryProvider) getFederatedIdentityCredentialsForUami(resourceGroup string, resourceName string, clientFactory *armmsi.ClientFactory) (*[]*armmsi.FederatedIdentityCredential, error) {
+func (a *azureQueryProvider) getFederatedIdentityCredentialsForUami(ctx context.Context, resourceGroup string, resourceName string, clientFactory *armmsi.ClientFactory) (_ *[]*armmsi.FederatedIdentityCredential, err error) {
 	federatedIdentityCredentials := []*armmsi.FederatedIdentityCredential{}
 
-	ctx := context.Background()
+	ctx, end := startAPICall(ctx, "azure", "ListFederatedIdentityCredentials", attribute.String("azure.resource_group", resourceGroup), attribute.String("azure.identity_name", resourceName))
+	defer func() { end(err) }()
 	a.Logger.Info("Getting federated identity credentials for uami", "resourceGroup", resourceGroup, "resourceName", resourceName)
 
+	if clientFactory == nil {
+		return nil, fmt.Errorf("no federated identity query client for the subscription of %s/%s", resourceGroup, resourceName)
+	}
 	pager := clientFactory.NewFederatedIdentityCredentialsClient().NewListPager(resourceGroup, resourceName, nil)
 
 	for pager.More() {
 		page, err := pager.NextPage(ctx)
-		switch {
-		case len(page.Value) == 0:
-			a.Logger.Info("No federated identity credentials found for uami", "resourceGroup", resourceGroup, "resourceName", resourceName)
-			return nil, nil
-		case err != nil && len(federatedIdentityCredentials) == 0:
-			a.Logger.Error(err, "failed to advance page and currently have no federated identity credentials")
+		if err != nil {
+			// a partial list could lack the credential trusting the service account
+			a.Logger.Error(err, "failed to advance page", "federatedIdentityCredentials", len(federatedIdentityCredentials))
 			return nil, err
-		case err != nil:
-			a.Logger.Error(err, "failed to advance page but have some federated identity credentials")
-			return &federatedIdentityCredentials, nil
 		}
 		federatedIdentityCredentials = append(federatedIdentityCredentials, page.Value...)
 	}
+	if len(federatedIdentityCredentials) == 0 {
+		a.Logger.Info("No federated identity credentials found for uami", "resourceGroup", resourceGroup, "resourceName", resourceName)
+	}
 
 	return &federatedIdentityCredentials, nil
 }
@@ -165,18 +411,39 @@ type SubscriptionList struct {
 	Value []Subscription `json:"value"`
 }
 
-func retrieveCurrentSubscriptionList() (*SubscriptionList, error) {
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		return nil, err
+// newSubscriptionList builds a subscription list from the given subscription IDs without querying the Azure API
+func newSubscriptionList(subscriptionIDs []string) *SubscriptionList {
+	subs := SubscriptionList{}
+	for _, id := range subscriptionIDs {
+		subs.Value = append(subs.Value, Subscription{ID: "/subscriptions/" + id, Name: id})
 	}
+	return &subs
+}
 
-	token, err := cred.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{"https://management.azure.com/.default"}})
+// filterSubscriptionList returns the subscriptions of the list with one of the given IDs, along with the additional subscriptions
+func filterSubscriptionList(list *SubscriptionList, subscriptionIDs []string, additional []string) *SubscriptionList {
+	filtered := newSubscriptionList(additional)
+	for _, subscription := range list.Value {
+		if slices.ContainsFunc(subscriptionIDs, func(id string) bool {
+			return strings.EqualFold(strings.TrimPrefix(subscription.ID, "/subscriptions/"), id)
+		}) {
+			filtered.Value = append(filtered.Value, subscription)
+		}
+	}
+	return filtered
+}
+
+// retrieveCurrentSubscriptionList lists the subscriptions visible in the tenant, the token is requested for the given Resource Manager endpoint
+func retrieveCurrentSubscriptionList(ctx context.Context, tenantID string, cred azcore.TokenCredential, endpoint string) (_ *SubscriptionList, err error) {
+	ctx, end := startAPICall(ctx, "azure", "ListSubscriptions", attribute.String("azure.tenant_id", tenantID))
+	defer func() { end(err) }()
+
+	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{endpoint + "/.default"}})
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("GET", "https://management.azure.com/subscriptions?api-version=2020-01-01", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/subscriptions?api-version=2020-01-01", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -202,24 +469,15 @@ func retrieveCurrentSubscriptionList() (*SubscriptionList, error) {
 	return &subs, nil
 }
 
-func (a *azureQueryProvider) getUamis(cred *azidentity.DefaultAzureCredential) ([]*armmsi.Identity, error) {
-	argClient, err := arg.NewClient(azcore.TokenCredential(cred), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	ctx := context.Background()
-
-	var subscriptionIdList []*string
-
-	for _, sub := range a.Subscriptions.Value {
-		subscriptionIdList = append(subscriptionIdList, to.Ptr(strings.Split(sub.ID, "/")[2]))
-	}
-
+func (a *azureQueryProvider) getUamis(ctx context.Context, tenant azureTenant) ([]*armmsi.Identity, error) {
 	query := "resources | where type == \"microsoft.managedidentity/userassignedidentities\""
 
 	if a.config.FilterTags != nil {
 		for tagKey, tagValue := range a.config.FilterTags {
+			// without a service account, e.g. in the inventory, the placeholders match all identities
+			if a.serviceAccount == nil && (tagValue == "<SERVICE_ACCOUNT_NAME>" || tagValue == "<NAMESPACE>") {
+				continue
+			}
 			if tagValue == "<SERVICE_ACCOUNT_NAME>" {
 				tagValue = a.serviceAccount.Name
 			} else if tagValue == "<NAMESPACE>" {
@@ -228,10 +486,32 @@ func (a *azureQueryProvider) getUamis(cred *azidentity.DefaultAzureCredential) (
 			if a.config.ClusterIdentifier != "" {
 				tagKey = a.config.ClusterIdentifier + "-" + tagKey
 			}
+			if strings.ContainsAny(tagKey+tagValue, "'\"\\") {
+				return nil, fmt.Errorf("invalid filter tag %s:%s, quotes and backslashes are not allowed", tagKey, tagValue)
+			}
 			query += fmt.Sprintf(" | where tags['%s'] == '%s'", tagKey, tagValue)
 		}
 	}
 
+	return a.queryUamis(ctx, tenant, query)
+}
+
+// queryUamis runs the given Resource Graph query in all subscriptions of the tenant and returns all pages of the result
+func (a *azureQueryProvider) queryUamis(ctx context.Context, tenant azureTenant, query string) (_ []*armmsi.Identity, err error) {
+	ctx, end := startAPICall(ctx, "azure", "ResourceGraphQuery", attribute.String("azure.tenant_id", tenant.ID), attribute.Int("azure.subscriptions", len(tenant.Subscriptions.Value)))
+	defer func() { end(err) }()
+
+	argClient, err := arg.NewClient(tenant.cred, armClientOptions(a.config))
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptionIdList []*string
+
+	for _, sub := range tenant.Subscriptions.Value {
+		subscriptionIdList = append(subscriptionIdList, to.Ptr(strings.Split(sub.ID, "/")[2]))
+	}
+
 	a.Logger.Info("Querying for identities", "query", query)
 
 	var skipToken *string = nil
@@ -249,23 +529,25 @@ func (a *azureQueryProvider) getUamis(cred *azidentity.DefaultAzureCredential) (
 		}, nil)
 
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		if skipToken != nil {
-			log.Printf("SkipToken:" + *res.SkipToken)
+		if res.SkipToken != nil {
+			a.Logger.Info("Querying next page of identities", "skipToken", *res.SkipToken)
 		}
 
 		skipToken = res.SkipToken
 
 		json_result, err := json.Marshal(res.Data)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		if err := json.Unmarshal(json_result, &identities); err != nil {
-			log.Fatalf("Failed to unmarshal result: %v", err)
+		var page []*armmsi.Identity
+		if err := json.Unmarshal(json_result, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal result: %w", err)
 		}
+		identities = append(identities, page...)
 	}
 
 	return identities, nil
@@ -0,0 +1,234 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// ProvisionedFederatedCredentialAnnotation holds the resource ID of the federated identity credential provisioned for the service account
+	ProvisionedFederatedCredentialAnnotation = "azure.clientid.syncer/provisioned-federated-credential"
+	// FederatedCredentialFinalizer blocks the deletion of a service account until its provisioned federated identity credential is deleted
+	FederatedCredentialFinalizer = "azure.clientid.syncer/federated-credential-cleanup"
+)
+
+// FederatedCredentialName returns the name of the federated identity credential provisioned for the given issuer and subject.
+// The name is deterministic, so that the credential can be found again on cleanup, and starts with the configured prefix.
+func FederatedCredentialName(prefix string, issuer string, subject string) string {
+	hash := sha256.Sum256([]byte(issuer + "\n" + subject))
+	return prefix + "-" + hex.EncodeToString(hash[:])[:20]
+}
+
+// ServiceAccountSubject returns the subject of the tokens issued for the service account
+func ServiceAccountSubject(serviceAccount *corev1.ServiceAccount) string {
+	return "system:serviceaccount:" + serviceAccount.Namespace + ":" + serviceAccount.Name
+}
+
+// provision annotates the managed identity designated by the service account annotations and creates
+// a federated identity credential on it if none trusts the service account yet
+func (a *azureQueryProvider) provision(ctx context.Context) (*corev1.ServiceAccount, error) {
+	query, err := a.targetIdentityQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tenant := range a.tenants {
+		identities, err := a.queryUamis(ctx, tenant, query)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(identities) == 0:
+			continue
+		case len(identities) > 1:
+			var ids []string
+			for _, identity := range identities {
+				ids = append(ids, *identity.ID)
+			}
+			sort.Strings(ids)
+			return nil, fmt.Errorf("the identity annotations select %d identities, expected exactly one: %s", len(identities), strings.Join(ids, ", "))
+		}
+
+		identity := identities[0]
+		clientFactory, err := armmsi.NewClientFactory(strings.Split(*identity.ID, "/")[2], tenant.cred, armClientOptions(a.config))
+		if err != nil {
+			return nil, err
+		}
+
+		// without the existing credentials a duplicate could be created
+		candidates, _, err := a.matchFederatedCredentials(ctx, identity, tenant, clientFactory)
+		if err != nil {
+			return nil, err
+		}
+		if len(candidates) > 0 {
+			a.Logger.Info("Found existing federated identity credential, nothing to provision", "clientId", candidates[0].ClientID, "federatedCredential", candidates[0].FederatedCredential)
+			a.annotate(candidates[0])
+			a.markProvisioned(candidates[0])
+			return a.serviceAccount, nil
+		}
+
+		provisioned, err := a.createFederatedCredential(ctx, identity, tenant, clientFactory)
+		if err != nil {
+			return nil, err
+		}
+		a.annotate(provisioned)
+		a.markProvisioned(provisioned)
+		return a.serviceAccount, nil
+	}
+
+	return nil, fmt.Errorf("no identity found for the query: %s", query)
+}
+
+// markProvisioned records the federated identity credential on the service account and adds the cleanup finalizer,
+// if the credential has been provisioned by the syncer. Credentials created by other means are never deleted.
+func (a *azureQueryProvider) markProvisioned(identity *Identity) {
+	if !strings.HasPrefix(identity.FederatedCredential, a.config.FederatedCredentialPrefix+"-") {
+		return
+	}
+	a.serviceAccount.Annotations[ProvisionedFederatedCredentialAnnotation] = identity.ResourceID + "/federatedIdentityCredentials/" + identity.FederatedCredential
+	controllerutil.AddFinalizer(a.serviceAccount, FederatedCredentialFinalizer)
+}
+
+// targetIdentityQuery builds the Resource Graph query for the identity designated by the service account annotations
+func (a *azureQueryProvider) targetIdentityQuery() (string, error) {
+	query := "resources | where type == \"microsoft.managedidentity/userassignedidentities\""
+
+	if resourceID := a.serviceAccount.Annotations[azureIdentityResourceIDAnnotation]; resourceID != "" {
+		if strings.ContainsAny(resourceID, "'\"\\") {
+			return "", fmt.Errorf("invalid %s annotation: %s", azureIdentityResourceIDAnnotation, resourceID)
+		}
+		return query + fmt.Sprintf(" | where id =~ '%s'", resourceID), nil
+	}
+
+	selector := a.serviceAccount.Annotations[azureIdentitySelectorAnnotation]
+	for _, pair := range strings.Split(selector, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" || strings.ContainsAny(pair, "'\"\\") {
+			return "", fmt.Errorf("invalid %s annotation, expected key=value pairs: %s", azureIdentitySelectorAnnotation, selector)
+		}
+		query += fmt.Sprintf(" | where tags['%s'] == '%s'", strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	return query, nil
+}
+
+// createFederatedCredential creates a federated identity credential trusting the service account on the identity.
+// The identity must match AZURE_IDENTITY_ALLOWLIST or the namespace must be selected by an identity policy, and the
+// identity is checked against the policy before. Nothing is created in dry-run mode.
+func (a *azureQueryProvider) createFederatedCredential(ctx context.Context, identity *armmsi.Identity, tenant azureTenant, clientFactory *armmsi.ClientFactory) (*Identity, error) {
+	provisioned := newAzureIdentity(identity, tenant.ID)
+	provisioned.Issuer = a.config.OidcIssuerUrl
+	provisioned.Subject = ServiceAccountSubject(a.serviceAccount)
+	provisioned.FederatedCredential = FederatedCredentialName(a.config.FederatedCredentialPrefix, provisioned.Issuer, provisioned.Subject)
+	provisioned.Audiences = a.config.FederatedCredentialAudiences[:1]
+
+	// without a restriction any service account could claim every identity the webhook may write to
+	if !a.policySelected && !slices.ContainsFunc(a.config.AzureIdentityAllowlist, func(pattern string) bool {
+		matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(*identity.ID))
+		return matched
+	}) {
+		return nil, fmt.Errorf("%w: identity %s is not allowed by AZURE_IDENTITY_ALLOWLIST and no identity policy selects namespace %s", ErrIdentityDenied, *identity.ID, a.serviceAccount.Namespace)
+	}
+	if a.policy != nil {
+		if err := a.policy(ProviderResult{Provider: "azure", Outcome: ProviderOutcomeMatched, Identity: provisioned}); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrIdentityDenied, err)
+		}
+	}
+
+	if a.dryRun {
+		a.Logger.Info("Skipping provisioning of federated identity credential in dry-run", "identity", *identity.ID, "federatedCredential", provisioned.FederatedCredential)
+		return provisioned, nil
+	}
+
+	a.Logger.Info("Provisioning federated identity credential", "identity", *identity.ID, "federatedCredential", provisioned.FederatedCredential, "issuer", provisioned.Issuer, "subject", provisioned.Subject)
+	ctx, end := startAPICall(ctx, "azure", "CreateFederatedIdentityCredential", attribute.String("azure.identity", *identity.ID))
+	_, err := clientFactory.NewFederatedIdentityCredentialsClient().CreateOrUpdate(ctx,
+		provisioned.ResourceGroup, strings.Split(*identity.ID, "/")[8], provisioned.FederatedCredential,
+		armmsi.FederatedIdentityCredential{
+			Properties: &armmsi.FederatedIdentityCredentialProperties{
+				Issuer:    to.Ptr(provisioned.Issuer),
+				Subject:   to.Ptr(provisioned.Subject),
+				Audiences: to.SliceOfPtrs(provisioned.Audiences...),
+			},
+		}, nil)
+	end(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to provision federated identity credential on %s: %w", *identity.ID, err)
+	}
+	reportCredentialProvisioned(ctx, "azure", provisionOperationCreate)
+	return provisioned, nil
+}
+
+// DeleteFederatedCredential deletes the federated identity credential with the given resource ID, which has been provisioned
+// for the service account. As the annotation holding the ID can be edited by anyone who can edit the service account,
+// the credential must have the name provisioned for the service account and trust its subject, otherwise it is refused.
+// Credentials which don't exist anymore are ignored.
+func DeleteFederatedCredential(ctx context.Context, config config.Config, tenantID string, credentialID string, serviceAccount *corev1.ServiceAccount) error {
+	resourceID, err := arm.ParseResourceID(credentialID)
+	if err != nil {
+		return fmt.Errorf("invalid federated identity credential ID %s: %w", credentialID, err)
+	}
+	if !strings.EqualFold(resourceID.ResourceType.Type, "userAssignedIdentities/federatedIdentityCredentials") || resourceID.Parent == nil {
+		return fmt.Errorf("%s is not a federated identity credential", credentialID)
+	}
+	subject := ServiceAccountSubject(serviceAccount)
+	if resourceID.Name != FederatedCredentialName(config.FederatedCredentialPrefix, config.OidcIssuerUrl, subject) {
+		return fmt.Errorf("federated identity credential %s has not been provisioned by the syncer for %s", credentialID, subject)
+	}
+	if !slices.Contains(config.AzureTenantIDs(), tenantID) {
+		return fmt.Errorf("tenant %s of federated identity credential %s is not configured", tenantID, credentialID)
+	}
+
+	cred, err := newAzureCredential(tenantID, config.TenantClientIDs[tenantID])
+	if err != nil {
+		return err
+	}
+	client, err := armmsi.NewFederatedIdentityCredentialsClient(resourceID.SubscriptionID, cred, armClientOptions(config))
+	if err != nil {
+		return err
+	}
+
+	// the name could still be forged for another issuer, so the credential must trust the service account
+	getCtx, end := startAPICall(ctx, "azure", "GetFederatedIdentityCredential", attribute.String("azure.federated_credential", credentialID))
+	credential, err := client.Get(getCtx, resourceID.ResourceGroupName, resourceID.Parent.Name, resourceID.Name, nil)
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound {
+		end(nil)
+		return nil
+	}
+	end(err)
+	if err != nil {
+		return err
+	}
+	if p := credential.Properties; p == nil || p.Issuer == nil || p.Subject == nil || *p.Issuer != config.OidcIssuerUrl || *p.Subject != subject {
+		return fmt.Errorf("federated identity credential %s doesn't trust %s of issuer %s", credentialID, subject, config.OidcIssuerUrl)
+	}
+
+	ctx, end = startAPICall(ctx, "azure", "DeleteFederatedIdentityCredential", attribute.String("azure.federated_credential", credentialID))
+	_, err = client.Delete(ctx, resourceID.ResourceGroupName, resourceID.Parent.Name, resourceID.Name, nil)
+	if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound {
+		end(nil)
+		return nil
+	}
+	end(err)
+	if err == nil {
+		reportCredentialProvisioned(ctx, "azure", provisionOperationDelete)
+	}
+	return err
+}
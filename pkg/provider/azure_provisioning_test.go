@@ -0,0 +1,408 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	testTenantID       = "00000000-0000-0000-0000-000000000001"
+	testSubscriptionID = "00000000-0000-0000-0000-000000000002"
+	testClientID       = "00000000-0000-0000-0000-000000000003"
+	testIssuer         = "https://oidc.example.com/"
+	testIdentityID     = "/subscriptions/" + testSubscriptionID + "/resourceGroups/team-a/providers/Microsoft.ManagedIdentity/userAssignedIdentities/app"
+)
+
+// fakeCredential returns a static token
+type fakeCredential struct{}
+
+func (fakeCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "fake", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// fakeARM serves the Resource Graph and federated identity credential APIs for a single managed identity
+type fakeARM struct {
+	mu sync.Mutex
+	// credentials maps the names of the federated identity credentials of the identity to their properties
+	credentials map[string]map[string]any
+	// requests are the methods and paths of all credential modifications
+	requests []string
+	// identities are additional managed identities found by Resource Graph, which share the credentials of the test identity
+	identities []string
+	// failGraph and failList make Resource Graph queries and credential lists fail
+	failGraph, failList bool
+}
+
+func newFakeARM(t *testing.T) (*fakeARM, *httptest.Server) {
+	arm := &fakeARM{credentials: map[string]map[string]any{}}
+	server := httptest.NewTLSServer(arm)
+	t.Cleanup(server.Close)
+	armTransport = server.Client()
+	credential := newAzureCredential
+	newAzureCredential = func(string, string) (azcore.TokenCredential, error) { return fakeCredential{}, nil }
+	t.Cleanup(func() {
+		armTransport = nil
+		newAzureCredential = credential
+	})
+	return arm, server
+}
+
+func (f *fakeARM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	credentialsPath := strings.ToLower(testIdentityID + "/federatedIdentityCredentials")
+	path := strings.ToLower(r.URL.Path)
+	identities := append([]string{testIdentityID}, f.identities...)
+	for _, identity := range f.identities {
+		if trimmed, ok := strings.CutPrefix(path, strings.ToLower(identity)); ok && strings.HasPrefix(trimmed, "/federatedidentitycredentials") {
+			path = credentialsPath + trimmed[len("/federatedidentitycredentials"):]
+		}
+	}
+	switch {
+	case r.URL.Path == "/providers/Microsoft.ResourceGraph/resources" && f.failGraph,
+		path == credentialsPath && f.failList:
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":{"code":"AuthorizationFailed","message":"forbidden"}}`))
+	case r.URL.Path == "/providers/Microsoft.ResourceGraph/resources":
+		var data []map[string]any
+		for i, identity := range identities {
+			data = append(data, map[string]any{
+				"id":         identity,
+				"name":       identity[strings.LastIndex(identity, "/")+1:],
+				"type":       "microsoft.managedidentity/userassignedidentities",
+				"properties": map[string]any{"clientId": fmt.Sprintf("00000000-0000-0000-0001-%012d", i), "tenantId": testTenantID},
+			})
+		}
+		data[0]["properties"] = map[string]any{"clientId": testClientID, "tenantId": testTenantID}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"totalRecords":    len(data),
+			"count":           len(data),
+			"resultTruncated": "false",
+			"data":            data,
+		})
+	case path == credentialsPath && r.Method == http.MethodGet:
+		var value []map[string]any
+		for name, properties := range f.credentials {
+			value = append(value, map[string]any{"id": testIdentityID + "/federatedIdentityCredentials/" + name, "name": name, "properties": properties})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"value": value})
+	case strings.HasPrefix(path, credentialsPath+"/"):
+		name := r.URL.Path[len(credentialsPath)+1:]
+		f.requests = append(f.requests, r.Method+" "+name)
+		switch r.Method {
+		case http.MethodGet:
+			properties, ok := f.credentials[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error":{"code":"NotFound","message":"not found"}}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"id": testIdentityID + "/federatedIdentityCredentials/" + name, "name": name, "properties": properties})
+		case http.MethodPut:
+			body := struct {
+				Properties map[string]any `json:"properties"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.credentials[name] = body.Properties
+			_ = json.NewEncoder(w).Encode(map[string]any{"id": testIdentityID + "/federatedIdentityCredentials/" + name, "name": name, "properties": body.Properties})
+		case http.MethodDelete:
+			if _, ok := f.credentials[name]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error":{"code":"NotFound","message":"not found"}}`))
+				return
+			}
+			delete(f.credentials, name)
+		}
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotImplemented)
+	}
+}
+
+func TestProvisionFederatedCredential(t *testing.T) {
+	subject := "system:serviceaccount:team-a:app"
+	provisionedName := FederatedCredentialName("azure-clientid-syncer", testIssuer, subject)
+	allowPolicy := func(ProviderResult) error { return nil }
+	denyPolicy := func(ProviderResult) error { return errors.New("not allowed") }
+
+	tests := []struct {
+		name string
+		// existing are the federated identity credentials of the identity
+		existing       map[string]map[string]any
+		allowlist      []string
+		policy         PolicyFunc
+		policySelected bool
+		dryRun         bool
+		wantErr        error
+		wantRequests   []string
+		wantFinalizer  bool
+	}{
+		{
+			name:          "allowlisted identity",
+			allowlist:     []string{"/subscriptions/*/resourcegroups/team-a/providers/microsoft.managedidentity/userassignedidentities/*"},
+			wantRequests:  []string{"PUT " + provisionedName},
+			wantFinalizer: true,
+		},
+		{
+			name:    "identity without allowlist and policy",
+			wantErr: ErrIdentityDenied,
+		},
+		{
+			name:      "identity outside of the allowlist",
+			allowlist: []string{"/subscriptions/*/resourcegroups/team-b/providers/microsoft.managedidentity/userassignedidentities/*"},
+			wantErr:   ErrIdentityDenied,
+		},
+		{
+			name:           "identity allowed by a policy selecting the namespace",
+			policy:         allowPolicy,
+			policySelected: true,
+			wantRequests:   []string{"PUT " + provisionedName},
+			wantFinalizer:  true,
+		},
+		{
+			name:           "allowlisted identity denied by a policy",
+			allowlist:      []string{testIdentityID},
+			policy:         denyPolicy,
+			policySelected: true,
+			wantErr:        ErrIdentityDenied,
+		},
+		{
+			name:          "allowlisted identity in dry-run",
+			allowlist:     []string{testIdentityID},
+			dryRun:        true,
+			wantFinalizer: true,
+		},
+		{
+			name: "existing credential",
+			existing: map[string]map[string]any{
+				"manual": {"issuer": testIssuer, "subject": subject, "audiences": []string{"api://AzureADTokenExchange"}},
+			},
+		},
+		{
+			name: "existing provisioned credential",
+			existing: map[string]map[string]any{
+				provisionedName: {"issuer": testIssuer, "subject": subject, "audiences": []string{"api://AzureADTokenExchange"}},
+			},
+			wantFinalizer: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arm, server := newFakeARM(t)
+			for name, properties := range tt.existing {
+				arm.credentials[name] = properties
+			}
+			serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "team-a",
+				Annotations: map[string]string{azureIdentityResourceIDAnnotation: testIdentityID},
+			}}
+			a := &azureQueryProvider{
+				defaultQueryProvider: defaultQueryProvider{
+					Logger: logr.Discard(),
+					config: config.Config{
+						OidcIssuerUrl:                testIssuer,
+						AzureProvisioningEnabled:     true,
+						AzureIdentityAllowlist:       tt.allowlist,
+						FederatedCredentialPrefix:    "azure-clientid-syncer",
+						FederatedCredentialAudiences: []string{"api://AzureADTokenExchange"},
+						ResourceManagerEndpoint:      server.URL,
+					},
+					serviceAccount: serviceAccount,
+					policy:         tt.policy,
+					policySelected: tt.policySelected,
+				},
+				tenants: []azureTenant{{ID: testTenantID, Subscriptions: *newSubscriptionList([]string{testSubscriptionID}), cred: fakeCredential{}}},
+				dryRun:  tt.dryRun,
+			}
+
+			_, err := a.Query(context.Background())
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprint(arm.requests) != fmt.Sprint(tt.wantRequests) {
+				t.Errorf("expected requests %v, got %v", tt.wantRequests, arm.requests)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if got := serviceAccount.Annotations[azureClientidAnnotation]; got != testClientID {
+				t.Errorf("expected client ID %s, got %q", testClientID, got)
+			}
+			if got := controllerutil.ContainsFinalizer(serviceAccount, FederatedCredentialFinalizer); got != tt.wantFinalizer {
+				t.Errorf("expected finalizer %t, got %t", tt.wantFinalizer, got)
+			}
+			if tt.wantFinalizer && serviceAccount.Annotations[ProvisionedFederatedCredentialAnnotation] != testIdentityID+"/federatedIdentityCredentials/"+provisionedName {
+				t.Errorf("unexpected provisioned annotation %q", serviceAccount.Annotations[ProvisionedFederatedCredentialAnnotation])
+			}
+			if len(tt.wantRequests) > 0 {
+				properties := arm.credentials[provisionedName]
+				if properties["issuer"] != testIssuer || properties["subject"] != subject || fmt.Sprint(properties["audiences"]) != "[api://AzureADTokenExchange]" {
+					t.Errorf("unexpected provisioned credential %v", properties)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteFederatedCredential(t *testing.T) {
+	subject := "system:serviceaccount:team-a:app"
+	provisionedName := FederatedCredentialName("azure-clientid-syncer", testIssuer, subject)
+	otherName := FederatedCredentialName("azure-clientid-syncer", testIssuer, "system:serviceaccount:team-b:app")
+	trusted := map[string]any{"issuer": testIssuer, "subject": subject}
+
+	tests := []struct {
+		name         string
+		credentialID string
+		tenantID     string
+		// existing maps the names of the federated identity credentials of the identity to their properties
+		existing     map[string]map[string]any
+		wantErr      bool
+		wantRequests []string
+	}{
+		{
+			name:         "provisioned credential",
+			credentialID: testIdentityID + "/federatedIdentityCredentials/" + provisionedName,
+			existing:     map[string]map[string]any{provisionedName: trusted},
+			wantRequests: []string{"GET " + provisionedName, "DELETE " + provisionedName},
+		},
+		{
+			name:         "already deleted credential",
+			credentialID: testIdentityID + "/federatedIdentityCredentials/" + provisionedName,
+			wantRequests: []string{"GET " + provisionedName},
+		},
+		{
+			name:         "forged annotation of a credential provisioned for another service account",
+			credentialID: testIdentityID + "/federatedIdentityCredentials/" + otherName,
+			existing:     map[string]map[string]any{otherName: {"issuer": testIssuer, "subject": "system:serviceaccount:team-b:app"}},
+			wantErr:      true,
+		},
+		{
+			name:         "credential with the provisioned name trusting another subject",
+			credentialID: testIdentityID + "/federatedIdentityCredentials/" + provisionedName,
+			existing:     map[string]map[string]any{provisionedName: {"issuer": testIssuer, "subject": "system:serviceaccount:team-b:app"}},
+			wantErr:      true,
+			wantRequests: []string{"GET " + provisionedName},
+		},
+		{
+			name:         "credential with the provisioned name trusting another issuer",
+			credentialID: testIdentityID + "/federatedIdentityCredentials/" + provisionedName,
+			existing:     map[string]map[string]any{provisionedName: {"issuer": "https://other.example.com/", "subject": subject}},
+			wantErr:      true,
+			wantRequests: []string{"GET " + provisionedName},
+		},
+		{
+			name:         "unconfigured tenant",
+			credentialID: testIdentityID + "/federatedIdentityCredentials/" + provisionedName,
+			tenantID:     "00000000-0000-0000-0000-000000000009",
+			existing:     map[string]map[string]any{provisionedName: trusted},
+			wantErr:      true,
+		},
+		{
+			name:         "credential without prefix",
+			credentialID: testIdentityID + "/federatedIdentityCredentials/manual",
+			existing:     map[string]map[string]any{"manual": trusted},
+			wantErr:      true,
+		},
+		{
+			name:         "identity instead of credential",
+			credentialID: testIdentityID,
+			wantErr:      true,
+		},
+		{
+			name:         "invalid resource ID",
+			credentialID: "not-a-resource-id",
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arm, server := newFakeARM(t)
+			for name, properties := range tt.existing {
+				arm.credentials[name] = properties
+			}
+			tenantID := tt.tenantID
+			if tenantID == "" {
+				tenantID = testTenantID
+			}
+			c := config.Config{
+				TenantID:                  testTenantID,
+				OidcIssuerUrl:             testIssuer,
+				FederatedCredentialPrefix: "azure-clientid-syncer",
+				ResourceManagerEndpoint:   server.URL,
+			}
+			serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}
+
+			err := DeleteFederatedCredential(context.Background(), c, tenantID, tt.credentialID, serviceAccount)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if fmt.Sprint(arm.requests) != fmt.Sprint(tt.wantRequests) {
+				t.Errorf("expected requests %v, got %v", tt.wantRequests, arm.requests)
+			}
+			for name := range tt.existing {
+				if _, ok := arm.credentials[name]; !ok && tt.wantErr {
+					t.Errorf("expected credential %s to be kept", name)
+				}
+			}
+			if _, ok := arm.credentials[provisionedName]; ok && !tt.wantErr {
+				t.Errorf("expected credential %s to be deleted", provisionedName)
+			}
+		})
+	}
+}
+
+func TestFederatedCredentialName(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  string
+		issuer  string
+		subject string
+	}{
+		{name: "default prefix", prefix: "azure-clientid-syncer", issuer: testIssuer, subject: "system:serviceaccount:team-a:app"},
+		{name: "other subject", prefix: "azure-clientid-syncer", issuer: testIssuer, subject: "system:serviceaccount:team-a:worker"},
+		{name: "other issuer", prefix: "azure-clientid-syncer", issuer: "https://other.example.com/", subject: "system:serviceaccount:team-a:app"},
+		{name: "custom prefix", prefix: "cluster-1", issuer: testIssuer, subject: "system:serviceaccount:team-a:app"},
+	}
+	// hashes maps the hash part of the names to the test which produced it
+	hashes := map[string]string{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := FederatedCredentialName(tt.prefix, tt.issuer, tt.subject)
+			if name != FederatedCredentialName(tt.prefix, tt.issuer, tt.subject) {
+				t.Errorf("expected the name to be deterministic")
+			}
+			hash, ok := strings.CutPrefix(name, tt.prefix+"-")
+			if !ok || len(hash) != 20 {
+				t.Fatalf("expected %s- followed by 20 hex characters, got %s", tt.prefix, name)
+			}
+			if other, ok := hashes[hash]; ok && tt.prefix == "azure-clientid-syncer" {
+				t.Errorf("expected a different name than %q, got %s", other, name)
+			}
+			hashes[hash] = tt.name
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testOtherIdentityID = "/subscriptions/" + testSubscriptionID + "/resourceGroups/team-a/providers/Microsoft.ManagedIdentity/userAssignedIdentities/other"
+
+// newTestAzureProvider returns an Azure provider for the service account team-a/app searching the fake ARM server in the given tenants
+func newTestAzureProvider(server *httptest.Server, annotations map[string]string, tenantIDs ...string) *azureQueryProvider {
+	a := &azureQueryProvider{
+		defaultQueryProvider: defaultQueryProvider{
+			Logger: logr.Discard(),
+			config: config.Config{
+				OidcIssuerUrl:                testIssuer,
+				FederatedCredentialAudiences: []string{"api://AzureADTokenExchange"},
+				ResourceManagerEndpoint:      server.URL,
+			},
+			serviceAccount: &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a", Annotations: annotations}},
+		},
+	}
+	for _, tenantID := range tenantIDs {
+		a.tenants = append(a.tenants, azureTenant{ID: tenantID, Subscriptions: *newSubscriptionList([]string{testSubscriptionID}), cred: fakeCredential{}})
+	}
+	return a
+}
+
+func TestAzureQuery(t *testing.T) {
+	trusted := map[string]any{"issuer": testIssuer, "subject": "system:serviceaccount:team-a:app", "audiences": []string{"api://AzureADTokenExchange"}}
+
+	tests := []struct {
+		name         string
+		tenants      []string
+		credentials  map[string]map[string]any
+		identities   []string
+		failGraph    bool
+		failList     bool
+		wantErr      error
+		wantAPIError bool
+		wantClientID string
+	}{
+		{
+			name:         "trusting credential",
+			tenants:      []string{testTenantID},
+			credentials:  map[string]map[string]any{"app": trusted},
+			wantClientID: testClientID,
+		},
+		{
+			name:        "no trusting credential",
+			tenants:     []string{testTenantID},
+			credentials: map[string]map[string]any{"other": {"issuer": testIssuer, "subject": "system:serviceaccount:team-b:app", "audiences": []string{"api://AzureADTokenExchange"}}},
+		},
+		{
+			name:        "audience mismatch",
+			tenants:     []string{testTenantID},
+			credentials: map[string]map[string]any{"app": {"issuer": testIssuer, "subject": "system:serviceaccount:team-a:app", "audiences": []string{"api://other"}}},
+			wantErr:     ErrAudienceMismatch,
+		},
+		{
+			name:        "identities of the same rank",
+			tenants:     []string{testTenantID},
+			credentials: map[string]map[string]any{"app": trusted},
+			identities:  []string{testOtherIdentityID},
+			wantErr:     ErrAmbiguousIdentity,
+		},
+		{
+			name:        "identities of the same rank in several tenants",
+			tenants:     []string{testTenantID, "00000000-0000-0000-0000-000000000009"},
+			credentials: map[string]map[string]any{"app": trusted},
+			identities:  []string{testOtherIdentityID},
+			wantErr:     ErrAmbiguousIdentity,
+		},
+		{
+			name:         "failing Resource Graph query",
+			tenants:      []string{testTenantID},
+			failGraph:    true,
+			wantAPIError: true,
+		},
+		{
+			name:         "failing credential list",
+			tenants:      []string{testTenantID},
+			credentials:  map[string]map[string]any{"app": trusted},
+			failList:     true,
+			wantAPIError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arm, server := newFakeARM(t)
+			arm.credentials, arm.identities, arm.failGraph, arm.failList = tt.credentials, tt.identities, tt.failGraph, tt.failList
+			a := newTestAzureProvider(server, nil, tt.tenants...)
+
+			annotated, err := a.Query(context.Background())
+			switch {
+			case tt.wantAPIError:
+				// API errors must be reported as provider errors, neither as not found nor as one of the other outcomes
+				if err == nil || errors.Is(err, ErrAudienceMismatch) || errors.Is(err, ErrAmbiguousIdentity) {
+					t.Fatalf("expected an API error, got %v", err)
+				}
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := annotated.Annotations[azureClientidAnnotation]; got != tt.wantClientID {
+				t.Errorf("expected client ID %q, got %q", tt.wantClientID, got)
+			}
+		})
+	}
+}
+
+func TestAzureVerify(t *testing.T) {
+	tests := []struct {
+		name         string
+		credentials  map[string]map[string]any
+		failGraph    bool
+		failList     bool
+		wantProblems int
+		wantErr      bool
+	}{
+		{
+			name:        "trusting credential",
+			credentials: map[string]map[string]any{"app": {"issuer": testIssuer, "subject": "system:serviceaccount:team-a:app", "audiences": []string{"api://AzureADTokenExchange"}}},
+		},
+		{
+			name:         "no trusting credential",
+			wantProblems: 1,
+		},
+		{
+			name:      "failing Resource Graph query",
+			failGraph: true,
+			wantErr:   true,
+		},
+		{
+			// unverifiable service accounts are admitted with a warning instead of being denied
+			name:     "failing credential list",
+			failList: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arm, server := newFakeARM(t)
+			arm.credentials, arm.failGraph, arm.failList = tt.credentials, tt.failGraph, tt.failList
+			if arm.credentials == nil {
+				arm.credentials = map[string]map[string]any{}
+			}
+			a := newTestAzureProvider(server, map[string]string{azureClientidAnnotation: testClientID}, testTenantID)
+
+			problems, err := a.Verify(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if len(problems) != tt.wantProblems {
+				t.Errorf("expected %d problems, got %v", tt.wantProblems, problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/apis/v1alpha1"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// bindingQueryProvider annotates service accounts with the identities declared in IdentityBinding resources.
+// Its precedence relative to the cloud discovery providers is defined by its position in PROVIDER_TYPES.
+type bindingQueryProvider struct {
+	defaultQueryProvider
+	client client.Client
+}
+
+func NewBindingQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config, kubeClient client.Client) (*bindingQueryProvider, error) {
+	if kubeClient == nil {
+		return nil, fmt.Errorf("binding provider requires a kubernetes client")
+	}
+	return &bindingQueryProvider{
+		defaultQueryProvider: defaultQueryProvider{
+			Logger:         logger,
+			config:         config,
+			serviceAccount: serviceAccount,
+		},
+		client: kubeClient,
+	}, nil
+}
+
+// Query annotates the service account with the identity of the binding selecting it. The status of the bindings
+// is maintained by the identity binding controller, the admission has no side effects on them.
+func (b *bindingQueryProvider) Query(ctx context.Context) (*corev1.ServiceAccount, error) {
+	bindings := &v1alpha1.IdentityBindingList{}
+	if err := b.client.List(ctx, bindings, client.InNamespace(b.serviceAccount.Namespace)); err != nil {
+		return nil, err
+	}
+
+	binding := SelectIdentityBinding(b.Logger, bindings.Items, b.serviceAccount)
+	if binding == nil {
+		b.Logger.Info("No identity binding found for service account", "name", b.serviceAccount.Name, "namespace", b.serviceAccount.Namespace)
+		return b.serviceAccount, nil
+	}
+
+	if b.serviceAccount.Annotations == nil {
+		b.serviceAccount.Annotations = make(map[string]string)
+	}
+	for annotation, value := range IdentityBindingAnnotations(binding) {
+		b.serviceAccount.Annotations[annotation] = value
+	}
+	b.identity = &Identity{
+		ResourceID: "identitybindings/" + binding.Namespace + "/" + binding.Name,
+		ClientID:   binding.Spec.AzureClientID,
+		TenantID:   binding.Spec.AzureTenantID,
+	}
+	if b.identity.ClientID == "" {
+		b.identity.ClientID = binding.Spec.GCPServiceAccount
+	}
+	if b.identity.ClientID == "" {
+		b.identity.ClientID = binding.Spec.AWSRoleARN
+	}
+	b.Logger.Info("Setting annotations from identity binding", "name", b.serviceAccount.Name, "namespace", b.serviceAccount.Namespace, "identityBinding", binding.Name)
+
+	return b.serviceAccount, nil
+}
+
+// SelectIdentityBinding returns the binding of the service account out of the bindings of its namespace, or nil if none selects it.
+// The oldest binding wins if several bindings select the same service account, bindings with an invalid selector are skipped.
+func SelectIdentityBinding(logger logr.Logger, bindings []v1alpha1.IdentityBinding, serviceAccount *corev1.ServiceAccount) *v1alpha1.IdentityBinding {
+	var matching []*v1alpha1.IdentityBinding
+	for i := range bindings {
+		selected, err := selectsServiceAccount(bindings[i].Spec.ServiceAccountSelector, serviceAccount)
+		if err != nil {
+			logger.Error(err, "invalid service account selector", "identityBinding", bindings[i].Name)
+			continue
+		}
+		if selected {
+			matching = append(matching, &bindings[i])
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		if !matching[i].CreationTimestamp.Equal(&matching[j].CreationTimestamp) {
+			return matching[i].CreationTimestamp.Before(&matching[j].CreationTimestamp)
+		}
+		return matching[i].Name < matching[j].Name
+	})
+	if len(matching) > 1 {
+		logger.Info("Multiple identity bindings select the service account, using the oldest one", "name", serviceAccount.Name, "namespace", serviceAccount.Namespace, "identityBinding", matching[0].Name)
+	}
+	return matching[0]
+}
+
+// IdentityBindingAnnotations returns the service account annotations set by the binding
+func IdentityBindingAnnotations(binding *v1alpha1.IdentityBinding) map[string]string {
+	annotations := map[string]string{}
+	for annotation, value := range map[string]string{
+		azureClientidAnnotation:     binding.Spec.AzureClientID,
+		AzureTenantIDAnnotation:     binding.Spec.AzureTenantID,
+		gcpServiceAccountAnnotation: binding.Spec.GCPServiceAccount,
+		awsRoleArnAnnotation:        binding.Spec.AWSRoleARN,
+	} {
+		if value != "" {
+			annotations[annotation] = value
+		}
+	}
+	return annotations
+}
+
+// selectsServiceAccount checks if the service account is selected by name or by labels
+func selectsServiceAccount(selector v1alpha1.ServiceAccountSelector, serviceAccount *corev1.ServiceAccount) (bool, error) {
+	if slices.Contains(selector.Names, serviceAccount.Name) {
+		return true, nil
+	}
+	if selector.LabelSelector == nil {
+		return false, nil
+	}
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector.LabelSelector)
+	if err != nil {
+		return false, err
+	}
+	return labelSelector.Matches(labels.Set(serviceAccount.Labels)), nil
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"sort"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/expression"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// selectCandidates filters the candidate identities with MATCH_EXPRESSION and returns the candidate with the highest
+// rank according to RANK_EXPRESSION. ambiguous is true if several candidates share the highest rank.
+// Without expressions all candidates match with the same rank. The candidates are ordered by resource ID within a rank.
+// Candidates for which an expression fails to evaluate (e.g. because of a missing tag) are treated as not matching.
+func (d *defaultQueryProvider) selectCandidates(candidates []*Identity) (selected *Identity, ambiguous bool) {
+	matchProgram, rankProgram := d.config.MatchProgram(), d.config.RankProgram()
+
+	type rankedIdentity struct {
+		identity *Identity
+		rank     float64
+	}
+	var ranked []rankedIdentity
+	for _, candidate := range candidates {
+		d.candidates = append(d.candidates, candidate.ResourceID)
+		vars := d.expressionVariables(candidate)
+		if matchProgram != nil {
+			match, err := matchProgram.Match(vars)
+			if err != nil {
+				d.Logger.Error(err, "failed to evaluate match expression", "resourceId", candidate.ResourceID)
+				continue
+			}
+			if !match {
+				d.Logger.Info("Candidate identity filtered by match expression", "resourceId", candidate.ResourceID)
+				continue
+			}
+		}
+		rank := 0.0
+		if rankProgram != nil {
+			var err error
+			if rank, err = rankProgram.Rank(vars); err != nil {
+				d.Logger.Error(err, "failed to evaluate rank expression", "resourceId", candidate.ResourceID)
+				continue
+			}
+		}
+		ranked = append(ranked, rankedIdentity{identity: candidate, rank: rank})
+	}
+	if len(ranked) == 0 {
+		return nil, false
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].rank != ranked[j].rank {
+			return ranked[i].rank > ranked[j].rank
+		}
+		return ranked[i].identity.ResourceID < ranked[j].identity.ResourceID
+	})
+	return ranked[0].identity, len(ranked) > 1 && ranked[0].rank == ranked[1].rank
+}
+
+// expressionVariables returns the variables passed to the CEL expressions for the given candidate
+func (d *defaultQueryProvider) expressionVariables(candidate *Identity) map[string]any {
+	namespace := &corev1.Namespace{}
+	namespace.Name = d.serviceAccount.Namespace
+	if d.namespace != nil {
+		namespace = d.namespace
+	}
+	return map[string]any{
+		expression.ServiceAccountVariable: map[string]any{
+			"name":        d.serviceAccount.Name,
+			"namespace":   d.serviceAccount.Namespace,
+			"labels":      nonNil(d.serviceAccount.Labels),
+			"annotations": nonNil(d.serviceAccount.Annotations),
+		},
+		expression.NamespaceVariable: map[string]any{
+			"name":        namespace.Name,
+			"labels":      nonNil(namespace.Labels),
+			"annotations": nonNil(namespace.Annotations),
+		},
+		expression.IdentityVariable: map[string]any{
+			"id":                  candidate.ResourceID,
+			"clientId":            candidate.ClientID,
+			"tenantId":            candidate.TenantID,
+			"subscriptionId":      candidate.SubscriptionID,
+			"resourceGroup":       candidate.ResourceGroup,
+			"project":             candidate.Project,
+			"tags":                nonNil(candidate.Tags),
+			"federatedCredential": candidate.FederatedCredential,
+			"issuer":              candidate.Issuer,
+			"subject":             candidate.Subject,
+			"audiences":           append([]string{}, candidate.Audiences...),
+		},
+	}
+}
+
+func nonNil(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
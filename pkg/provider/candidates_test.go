@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSelectCandidates(t *testing.T) {
+	candidates := []*Identity{
+		{ResourceID: "/identities/b", Tags: map[string]string{"env": "dev", "priority": "1"}},
+		{ResourceID: "/identities/a", Tags: map[string]string{"env": "dev", "priority": "1"}},
+		{ResourceID: "/identities/c", Tags: map[string]string{"env": "prod", "priority": "2"}},
+		{ResourceID: "/identities/untagged"},
+	}
+
+	tests := []struct {
+		name            string
+		matchExpression string
+		rankExpression  string
+		candidates      []*Identity
+		wantSelected    string
+		wantAmbiguous   bool
+	}{
+		{
+			name: "no candidates",
+		},
+		{
+			name:         "single candidate without expressions",
+			candidates:   candidates[:1],
+			wantSelected: "/identities/b",
+		},
+		{
+			name:          "several candidates without expressions",
+			candidates:    candidates,
+			wantSelected:  "/identities/a",
+			wantAmbiguous: true,
+		},
+		{
+			name:            "match expression filters",
+			matchExpression: `has(identity.tags.env) && identity.tags.env == namespaceObject.labels.env`,
+			candidates:      candidates,
+			wantSelected:    "/identities/c",
+		},
+		{
+			name:            "match expression filters all",
+			matchExpression: `serviceAccount.name == "other"`,
+			candidates:      candidates,
+		},
+		{
+			name:           "highest rank wins",
+			rankExpression: `has(identity.tags.priority) ? int(identity.tags.priority) : 0`,
+			candidates:     candidates,
+			wantSelected:   "/identities/c",
+		},
+		{
+			name:            "tie of the highest rank",
+			matchExpression: `has(identity.tags.env) && identity.tags.env == "dev"`,
+			rankExpression:  `int(identity.tags.priority)`,
+			candidates:      candidates,
+			wantSelected:    "/identities/a",
+			wantAmbiguous:   true,
+		},
+		{
+			// the untagged candidate fails to evaluate and is treated as not matching
+			name:           "rank expression failing for a candidate",
+			rankExpression: `-int(identity.tags.priority)`,
+			candidates:     candidates,
+			wantSelected:   "/identities/a",
+			wantAmbiguous:  true,
+		},
+		{
+			name:           "rank expression failing for all candidates",
+			rankExpression: `int(identity.tags.missing)`,
+			candidates:     candidates,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AZURE_TENANT_ID", testTenantID)
+			t.Setenv("OIDC_ISSUER_URL", testIssuer)
+			t.Setenv("MATCH_EXPRESSION", tt.matchExpression)
+			t.Setenv("RANK_EXPRESSION", tt.rankExpression)
+			c, err := config.ParseConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &defaultQueryProvider{
+				Logger:         logr.Discard(),
+				config:         *c,
+				serviceAccount: &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}},
+				namespace:      &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"env": "prod"}}},
+			}
+
+			selected, ambiguous := d.selectCandidates(tt.candidates)
+			var selectedID string
+			if selected != nil {
+				selectedID = selected.ResourceID
+			}
+			if selectedID != tt.wantSelected || ambiguous != tt.wantAmbiguous {
+				t.Errorf("expected %q (ambiguous %t), got %q (ambiguous %t)", tt.wantSelected, tt.wantAmbiguous, selectedID, ambiguous)
+			}
+			// all candidates are recorded, including those filtered by the expressions
+			var wantCandidates []string
+			for _, candidate := range tt.candidates {
+				wantCandidates = append(wantCandidates, candidate.ResourceID)
+			}
+			if !reflect.DeepEqual(d.Candidates(), wantCandidates) {
+				t.Errorf("expected candidates %v, got %v", wantCandidates, d.Candidates())
+			}
+		})
+	}
+}
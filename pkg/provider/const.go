@@ -3,13 +3,28 @@ package provider
 const (
 	// clientidAnnotation represents the clientid to be used with pod
 	azureClientidAnnotation = "azure.workload.identity/client-id"
-	// TenantIDAnnotation represent the tenantID to be used with pod
-	azureTenantIDAnnotation = "azure.workload.identity/tenant-id"
+	// AzureTenantIDAnnotation represents the tenantID to be used with pod
+	AzureTenantIDAnnotation = "azure.workload.identity/tenant-id"
 
 	// gcpRoleName represents the role associated with service accounts in GCP allowing them to use workload identity
 	gcpRoleName = "roles/iam.workloadIdentityUser"
 	// gcpResourceAssetType represents the Asset Inventory resource type for GCP service accounts
 	gcpResourceAssetType = "iam.googleapis.com/ServiceAccount"
+	// gcpServiceAccountRequestAnnotation requests a GCP service account on which the workload identity user role is granted to the service account
+	gcpServiceAccountRequestAnnotation = "azure.clientid.syncer/gcp-service-account"
 	// gcpServiceAccountAnnotation represents the GCP service account name to be used with the Kubernetes service account
 	gcpServiceAccountAnnotation = "iam.gke.io/gcp-service-account"
+
+	// azureIdentityResourceIDAnnotation designates the managed identity a federated identity credential is provisioned on
+	azureIdentityResourceIDAnnotation = "azure.clientid.syncer/identity-resource-id"
+	// azureIdentitySelectorAnnotation designates the managed identity by its tags, e.g. "team=a,app=b", it must select exactly one identity
+	azureIdentitySelectorAnnotation = "azure.clientid.syncer/identity-selector"
+
+	// gcpWorkloadIdentityProviderAnnotation and gcpServiceAccountEmailAnnotation describe the credential configuration used by
+	// Workload Identity Federation on non-GKE clusters, e.g. by the gcp-workload-identity-federation-webhook
+	gcpWorkloadIdentityProviderAnnotation = "cloud.google.com/workload-identity-provider"
+	gcpServiceAccountEmailAnnotation      = "cloud.google.com/service-account-email"
+
+	// awsRoleArnAnnotation represents the IAM role to be used with the Kubernetes service account on EKS
+	awsRoleArnAnnotation = "eks.amazonaws.com/role-arn"
 )
@@ -2,74 +2,169 @@ package provider
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	asset "cloud.google.com/go/asset/apiv1"
 	"cloud.google.com/go/asset/apiv1/assetpb"
+	"cloud.google.com/go/iam/apiv1/iampb"
 	"github.com/go-logr/logr"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
-	"google.golang.org/api/iterator"
 	corev1 "k8s.io/api/core/v1"
 )
 
 type gcpQueryProvider struct {
 	defaultQueryProvider
+	// dryRun prevents the provisioning of workload identity bindings
+	dryRun bool
+	// assets is the shared asset inventory client and cache, may be nil
+	assets *GCPAssetCache
 }
 
-func NewGCPQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config) (*gcpQueryProvider, error) {
+func NewGCPQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config, dryRun bool, assets *GCPAssetCache) (*gcpQueryProvider, error) {
 	return &gcpQueryProvider{
 		defaultQueryProvider: defaultQueryProvider{
 			Logger:         logger,
 			config:         config,
 			serviceAccount: serviceAccount,
 		},
+		dryRun: dryRun,
+		assets: assets,
 	}, nil
 }
 
-func (g *gcpQueryProvider) Query() (*corev1.ServiceAccount, error) {
-	// Create a new Asset Inventory client
-	ctx := context.Background()
-	assetClient, err := asset.NewClient(ctx)
-	if err != nil {
-		return nil, err
+func (g *gcpQueryProvider) Query(ctx context.Context) (*corev1.ServiceAccount, error) {
+	if g.config.GcpProvisioningEnabled && g.serviceAccount.Annotations[gcpServiceAccountRequestAnnotation] != "" {
+		return g.provision(ctx)
 	}
 
-	// Find GCP service account that can be impersonated by Kubernetes account using the GCP Asset Inventory
-	// the query looks for all resources on which the Kubernetes service account has the 'roles/iam.workloadIdentityUser' role assigned
-	req := &assetpb.SearchAllIamPoliciesRequest{
-		Scope: fmt.Sprintf("projects/%s", g.config.GcpProjectId),
-		Query: fmt.Sprintf("policy:%s.svc.id.goog[%s/%s] roles:%s", g.config.GcpProjectId, g.serviceAccount.Namespace, g.serviceAccount.Name, gcpRoleName),
-	}
-	it := assetClient.SearchAllIamPolicies(ctx, req)
-
-	// Iterate through all results and find service account
-	gcpServiceAccountMail := ""
-	for {
-		res, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
+	// scopes are searched in order, the first scope containing a matching service account wins
+	for _, scope := range g.config.GcpSearchScopes() {
+		candidates, err := g.searchCandidates(ctx, scope)
 		if err != nil {
 			return nil, err
 		}
 
-		// The service account resource is returned in the format: //iam.googleapis.com/projects/<project-id>/serviceAccounts/<sa-name>@<project-id>.iam.gserviceaccount.com
-		// extract relevant account mail that can be used in the annotation
-		if res.AssetType == gcpResourceAssetType {
-			// Fail if two or more service accounts were found
-			if gcpServiceAccountMail != "" {
-				return nil, errors.New("multiple service accounts were found, cannot decide which one to use")
-			} else {
-				gcpServiceAccountMail = strings.Split(res.Resource, "/")[6]
-				if g.serviceAccount.Annotations == nil {
-					g.serviceAccount.Annotations = make(map[string]string)
-				}
-				g.serviceAccount.Annotations[gcpServiceAccountAnnotation] = gcpServiceAccountMail
-			}
+		selected, ambiguous := g.selectCandidates(candidates)
+		// Fail if two or more service accounts were found and the rank expression can't decide between them
+		if ambiguous {
+			return nil, fmt.Errorf("%w: multiple service accounts were found in %s, cannot decide which one to use", ErrAmbiguousIdentity, scope)
+		}
+		if selected != nil {
+			g.annotate(selected)
+			return g.serviceAccount, nil
 		}
 	}
 
 	return g.serviceAccount, nil
 }
+
+// Verify checks that the GCP service account annotated on the service account grants the workload identity user role to it
+func (g *gcpQueryProvider) Verify(ctx context.Context) ([]string, error) {
+	gcpServiceAccountMail := g.serviceAccount.Annotations[gcpServiceAccountAnnotation]
+	if gcpServiceAccountMail == "" {
+		return nil, nil
+	}
+
+	for _, scope := range g.config.GcpSearchScopes() {
+		candidates, err := g.searchCandidates(ctx, scope)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range candidates {
+			if candidate.ClientID == gcpServiceAccountMail {
+				return nil, nil
+			}
+		}
+	}
+	return []string{fmt.Sprintf("GCP service account %s does not grant %s to %s",
+		gcpServiceAccountMail, gcpRoleName, gcpMember(g.config, g.serviceAccount))}, nil
+}
+
+// gcpMember returns the IAM member of the Kubernetes service account in the workload identity pool of the cluster.
+// GKE's default pool uses serviceAccount:<project>.svc.id.goog[<namespace>/<name>], fleet pools and custom pools of
+// Workload Identity Federation use principal://iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/subject/<subject>.
+func gcpMember(config config.Config, serviceAccount *corev1.ServiceAccount) string {
+	pool := config.GcpWorkloadIdentityPool
+	if pool == "" {
+		return fmt.Sprintf("serviceAccount:%s.svc.id.goog[%s/%s]", config.GcpPoolProject(), serviceAccount.Namespace, serviceAccount.Name)
+	}
+	subject := ServiceAccountSubject(serviceAccount)
+	// fleet pools use their own subject format
+	if strings.HasSuffix(pool, ".svc.id.goog") {
+		subject = fmt.Sprintf("ns/%s/sa/%s", serviceAccount.Namespace, serviceAccount.Name)
+	}
+	return fmt.Sprintf("principal://iam.googleapis.com/projects/%s/locations/global/workloadIdentityPools/%s/subject/%s",
+		config.GcpWorkloadIdentityPoolProjectNumber, pool, subject)
+}
+
+// gcpMemberQuery returns the Asset Inventory query term matching policies which contain the member
+func gcpMemberQuery(member string) string {
+	if strings.HasPrefix(member, "principal://") {
+		return fmt.Sprintf("policy:%q", member)
+	}
+	return "policy:" + strings.TrimPrefix(member, "serviceAccount:")
+}
+
+// annotate sets the GCP service account annotation and, if configured, the credential configuration annotations required by non-GKE clusters
+func (g *gcpQueryProvider) annotate(identity *Identity) {
+	if g.serviceAccount.Annotations == nil {
+		g.serviceAccount.Annotations = make(map[string]string)
+	}
+	g.serviceAccount.Annotations[gcpServiceAccountAnnotation] = identity.ClientID
+	if g.config.GcpWorkloadIdentityProvider != "" {
+		g.serviceAccount.Annotations[gcpWorkloadIdentityProviderAnnotation] = fmt.Sprintf("projects/%s/locations/global/workloadIdentityPools/%s/providers/%s",
+			g.config.GcpWorkloadIdentityPoolProjectNumber, g.config.GcpWorkloadIdentityPool, g.config.GcpWorkloadIdentityProvider)
+		g.serviceAccount.Annotations[gcpServiceAccountEmailAnnotation] = identity.ClientID
+	}
+	g.identity = identity
+}
+
+// searchCandidates returns all GCP service accounts in the scope which can be impersonated by the Kubernetes service account.
+// Cached bindings are used if available, otherwise the scope is searched with the shared client or a client created for the call.
+func (g *gcpQueryProvider) searchCandidates(ctx context.Context, scope string) ([]*Identity, error) {
+	member := gcpMember(g.config, g.serviceAccount)
+	if g.assets != nil {
+		if candidates, ok := g.assets.lookup(scope, member); ok {
+			return candidates, nil
+		}
+	}
+
+	var assetClient *asset.Client
+	if g.assets != nil {
+		assetClient = g.assets.client
+	} else {
+		var err error
+		if assetClient, err = asset.NewClient(ctx); err != nil {
+			return nil, err
+		}
+		defer assetClient.Close()
+	}
+
+	// Find GCP service account that can be impersonated by Kubernetes account using the GCP Asset Inventory
+	// the query looks for all resources on which the Kubernetes service account has the 'roles/iam.workloadIdentityUser' role assigned
+	var candidates []*Identity
+	err := searchWorkloadIdentityPolicies(ctx, assetClient, scope, fmt.Sprintf("%s roles:%s", gcpMemberQuery(member), gcpRoleName), func(res *assetpb.IamPolicySearchResult) {
+		// the query matches substrings, so the member must be checked, e.g. '.../sa/app' would match '.../sa/app2' as well
+		if grantsWorkloadIdentityUser(res.Policy, member) {
+			candidate := newGCPIdentity(res.Resource)
+			candidates = append(candidates, &candidate)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+// grantsWorkloadIdentityUser reports whether the policy grants the workload identity user role to the member
+func grantsWorkloadIdentityUser(policy *iampb.Policy, member string) bool {
+	if policy == nil {
+		return false
+	}
+	return slices.ContainsFunc(policy.Bindings, func(binding *iampb.Binding) bool {
+		return binding.Role == gcpRoleName && slices.Contains(binding.Members, member)
+	})
+}
@@ -0,0 +1,175 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	asset "cloud.google.com/go/asset/apiv1"
+	"cloud.google.com/go/asset/apiv1/assetpb"
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+)
+
+// GCPAssetCache shares a single Asset Inventory client between all requests and caches the workload identity user
+// bindings of the configured scopes, which are refreshed in the background. It is run by the manager, which closes
+// the client on shutdown.
+type GCPAssetCache struct {
+	client   *asset.Client
+	scopes   []string
+	interval time.Duration
+	logger   logr.Logger
+
+	mu sync.RWMutex
+	// bindings maps the scope and the member to the service accounts granting the workload identity user role to the member
+	bindings map[string]map[string][]Identity
+	// refreshed is the time of the last successful refresh of each scope
+	refreshed map[string]time.Time
+}
+
+// newGCPAssetCache creates the GCP asset cache, which has to be run by the manager
+func newGCPAssetCache(c *config.Config, logger logr.Logger) (*GCPAssetCache, error) {
+	client, err := asset.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create asset inventory client: %w", err)
+	}
+	cache := &GCPAssetCache{
+		client:   client,
+		scopes:   c.GcpSearchScopes(),
+		interval: c.GcpCacheRefreshInterval,
+		logger:   logger.WithName("gcp-asset-cache"),
+	}
+	registerIndex(cache)
+	return cache, nil
+}
+
+// Start refreshes the cache periodically until the context is done and closes the client afterwards.
+// The bindings aren't cached if GCP_CACHE_REFRESH_INTERVAL is 0, but the client is still shared.
+func (c *GCPAssetCache) Start(ctx context.Context) error {
+	defer c.client.Close()
+	if c.interval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			c.logger.Info("stopping gcp asset cache")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection is false, as lookups are served from the memory of each replica
+func (c *GCPAssetCache) NeedLeaderElection() bool {
+	return false
+}
+
+// refresh searches all workload identity user bindings of the scopes. Scopes which fail keep their previous bindings.
+func (c *GCPAssetCache) refresh(ctx context.Context) {
+	for _, scope := range c.scopes {
+		bindings := map[string][]Identity{}
+		err := searchWorkloadIdentityPolicies(ctx, c.client, scope, "roles:"+gcpRoleName, func(res *assetpb.IamPolicySearchResult) {
+			for _, binding := range res.Policy.GetBindings() {
+				if binding.Role != gcpRoleName {
+					continue
+				}
+				for _, member := range binding.Members {
+					bindings[member] = append(bindings[member], newGCPIdentity(res.Resource))
+				}
+			}
+		})
+		if err != nil {
+			c.logger.Error(err, "failed to refresh workload identity bindings", "scope", scope)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.bindings == nil {
+			c.bindings = map[string]map[string][]Identity{}
+			c.refreshed = map[string]time.Time{}
+		}
+		c.bindings[scope] = bindings
+		c.refreshed[scope] = time.Now()
+		c.mu.Unlock()
+		c.logger.V(1).Info("refreshed workload identity bindings", "scope", scope, "members", len(bindings))
+	}
+}
+
+// lookup returns copies of the cached service accounts of the member in the scope. Members without bindings in a cached
+// scope have no service accounts. It returns false if the scope hasn't been cached yet, in which case the caller has to
+// search the scope itself.
+func (c *GCPAssetCache) lookup(scope string, member string) ([]*Identity, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.refreshed[scope]; !ok {
+		return nil, false
+	}
+	identities := c.bindings[scope][member]
+	candidates := make([]*Identity, 0, len(identities))
+	for _, identity := range identities {
+		candidate := identity
+		candidates = append(candidates, &candidate)
+	}
+	return candidates, true
+}
+
+// indexStats reports the number of GCP service accounts with workload identity user bindings of every cached scope
+func (c *GCPAssetCache) indexStats() []indexStat {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := make([]indexStat, 0, len(c.bindings))
+	for scope, bindings := range c.bindings {
+		serviceAccounts := map[string]struct{}{}
+		for _, identities := range bindings {
+			for _, identity := range identities {
+				serviceAccounts[identity.ResourceID] = struct{}{}
+			}
+		}
+		stats = append(stats, indexStat{cache: "gcp", scope: scope, identities: len(serviceAccounts), refreshed: c.refreshed[scope]})
+	}
+	return stats
+}
+
+// searchWorkloadIdentityPolicies calls visit for all IAM policies of GCP service accounts in the scope matching the query
+func searchWorkloadIdentityPolicies(ctx context.Context, client *asset.Client, scope string, query string, visit func(res *assetpb.IamPolicySearchResult)) (err error) {
+	ctx, end := startAPICall(ctx, "gcp", "SearchAllIamPolicies", attribute.String("gcp.scope", scope))
+	defer func() { end(err) }()
+
+	it := client.SearchAllIamPolicies(ctx, &assetpb.SearchAllIamPoliciesRequest{
+		Scope:      scope,
+		Query:      query,
+		AssetTypes: []string{gcpResourceAssetType},
+	})
+	for {
+		res, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if res.AssetType == gcpResourceAssetType {
+			visit(res)
+		}
+	}
+}
+
+// newGCPIdentity describes the GCP service account with the given resource name.
+// The service account resource is returned in the format: //iam.googleapis.com/projects/<project-id>/serviceAccounts/<sa-name>@<project-id>.iam.gserviceaccount.com
+func newGCPIdentity(resource string) Identity {
+	return Identity{
+		ResourceID: resource,
+		ClientID:   strings.Split(resource, "/")[6],
+		Project:    strings.Split(resource, "/")[4],
+	}
+}
@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/googleapi"
+	iam "google.golang.org/api/iam/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// ProvisionedGCPBindingAnnotation holds the GCP service account on which the workload identity user role was granted to the service account
+	ProvisionedGCPBindingAnnotation = "azure.clientid.syncer/provisioned-gcp-binding"
+	// GCPBindingFinalizer blocks the deletion of a service account until its provisioned workload identity user binding is removed
+	GCPBindingFinalizer = "azure.clientid.syncer/gcp-binding-cleanup"
+
+	// gcpPolicyUpdateAttempts limits the retries of concurrent IAM policy modifications
+	gcpPolicyUpdateAttempts = 5
+)
+
+// provision grants the workload identity user role on the GCP service account requested by the service account annotation
+// and annotates it. The GCP service account must be allowed by GCP_SERVICE_ACCOUNT_ALLOWLIST and the policy.
+func (g *gcpQueryProvider) provision(ctx context.Context) (*corev1.ServiceAccount, error) {
+	email := g.serviceAccount.Annotations[gcpServiceAccountRequestAnnotation]
+	if !slices.ContainsFunc(g.config.GcpServiceAccountAllowlist, func(pattern string) bool {
+		matched, _ := path.Match(pattern, email)
+		return matched
+	}) {
+		return nil, fmt.Errorf("%w: GCP service account %s is not allowed by GCP_SERVICE_ACCOUNT_ALLOWLIST", ErrIdentityDenied, email)
+	}
+	if !strings.Contains(email, "@") {
+		return nil, fmt.Errorf("invalid %s annotation: %s", gcpServiceAccountRequestAnnotation, email)
+	}
+
+	// the domain of the email doesn't always name the project, e.g. for default service accounts
+	serviceAccount, err := getGCPServiceAccount(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCP service account %s: %w", email, err)
+	}
+	identity := &Identity{
+		ResourceID: fmt.Sprintf("//iam.googleapis.com/projects/%s/serviceAccounts/%s", serviceAccount.ProjectId, email),
+		ClientID:   email,
+		Project:    serviceAccount.ProjectId,
+	}
+	if g.policy != nil {
+		if err := g.policy(ProviderResult{Provider: "gcp", Outcome: ProviderOutcomeMatched, Identity: identity}); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrIdentityDenied, err)
+		}
+	}
+
+	added := false
+	if g.dryRun {
+		g.Logger.Info("Skipping provisioning of workload identity binding in dry-run", "gcpServiceAccount", email)
+	} else {
+		added, err = updateWorkloadIdentityBinding(ctx, email, gcpMember(g.config, g.serviceAccount), true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to grant %s on %s: %w", gcpRoleName, email, err)
+		}
+	}
+
+	g.annotate(identity)
+	// bindings which existed before are never removed
+	if added {
+		g.Logger.Info("Granted workload identity user role", "gcpServiceAccount", email)
+		g.serviceAccount.Annotations[ProvisionedGCPBindingAnnotation] = email
+		controllerutil.AddFinalizer(g.serviceAccount, GCPBindingFinalizer)
+	}
+	return g.serviceAccount, nil
+}
+
+// RemoveGCPWorkloadIdentityBinding revokes the workload identity user role granted to the service account on the GCP service account
+func RemoveGCPWorkloadIdentityBinding(ctx context.Context, config config.Config, email string, serviceAccount *corev1.ServiceAccount) error {
+	_, err := updateWorkloadIdentityBinding(ctx, email, gcpMember(config, serviceAccount), false)
+	return err
+}
+
+// gcpServiceAccountResource returns the resource name of the GCP service account, the wildcard lets IAM infer the project from the email
+func gcpServiceAccountResource(email string) string {
+	return "projects/-/serviceAccounts/" + email
+}
+
+// getGCPServiceAccount reads the GCP service account with the given email
+func getGCPServiceAccount(ctx context.Context, email string) (_ *iam.ServiceAccount, err error) {
+	service, err := iam.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, end := startAPICall(ctx, "gcp", "GetServiceAccount", attribute.String("gcp.service_account", email))
+	defer func() { end(err) }()
+	return service.Projects.ServiceAccounts.Get(gcpServiceAccountResource(email)).Context(ctx).Do()
+}
+
+// updateWorkloadIdentityBinding adds or removes the member from the workload identity user binding of the GCP service account.
+// The IAM policy is modified with read-modify-write using its etag, concurrent modifications are retried.
+// It returns true if the policy has been changed.
+func updateWorkloadIdentityBinding(ctx context.Context, email string, member string, add bool) (bool, error) {
+	service, err := iam.NewService(ctx)
+	if err != nil {
+		return false, err
+	}
+	resource := gcpServiceAccountResource(email)
+
+	for attempt := 1; ; attempt++ {
+		getCtx, end := startAPICall(ctx, "gcp", "GetIamPolicy", attribute.String("gcp.service_account", email))
+		policy, err := service.Projects.ServiceAccounts.GetIamPolicy(resource).OptionsRequestedPolicyVersion(3).Context(getCtx).Do()
+		end(err)
+		if err != nil {
+			return false, err
+		}
+		if !modifyBinding(policy, member, add) {
+			return false, nil
+		}
+
+		// the etag of the policy makes the update fail if the policy has been changed in the meantime
+		setCtx, end := startAPICall(ctx, "gcp", "SetIamPolicy", attribute.String("gcp.service_account", email), attribute.Int("gcp.attempt", attempt))
+		_, err = service.Projects.ServiceAccounts.SetIamPolicy(resource, &iam.SetIamPolicyRequest{Policy: policy}).Context(setCtx).Do()
+		end(err)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict && attempt < gcpPolicyUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		operation := provisionOperationDelete
+		if add {
+			operation = provisionOperationCreate
+		}
+		reportCredentialProvisioned(ctx, "gcp", operation)
+		return true, nil
+	}
+}
+
+// modifyBinding adds or removes the member from the workload identity user binding of the policy and reports whether the policy changed
+func modifyBinding(policy *iam.Policy, member string, add bool) bool {
+	for i, binding := range policy.Bindings {
+		if binding.Role != gcpRoleName || binding.Condition != nil {
+			continue
+		}
+		index := slices.Index(binding.Members, member)
+		switch {
+		case add && index >= 0, !add && index < 0:
+			return false
+		case add:
+			binding.Members = append(binding.Members, member)
+		case len(binding.Members) == 1:
+			policy.Bindings = slices.Delete(policy.Bindings, i, i+1)
+		default:
+			binding.Members = slices.Delete(binding.Members, index, index+1)
+		}
+		return true
+	}
+	if !add {
+		return false
+	}
+	policy.Bindings = append(policy.Bindings, &iam.Binding{Role: gcpRoleName, Members: []string{member}})
+	return true
+}
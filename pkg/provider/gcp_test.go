@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGCPMember(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    config.Config
+		want      string
+		wantQuery string
+	}{
+		{
+			name:      "GKE pool of the project",
+			config:    config.Config{GcpProjectId: "project-a"},
+			want:      "serviceAccount:project-a.svc.id.goog[team-a/app]",
+			wantQuery: "policy:project-a.svc.id.goog[team-a/app]",
+		},
+		{
+			name:      "GKE pool of another project",
+			config:    config.Config{GcpProjectId: "project-a", GcpWorkloadIdentityPoolProject: "project-b"},
+			want:      "serviceAccount:project-b.svc.id.goog[team-a/app]",
+			wantQuery: "policy:project-b.svc.id.goog[team-a/app]",
+		},
+		{
+			name:      "fleet pool",
+			config:    config.Config{GcpWorkloadIdentityPool: "fleet-project.svc.id.goog", GcpWorkloadIdentityPoolProjectNumber: "123"},
+			want:      "principal://iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/fleet-project.svc.id.goog/subject/ns/team-a/sa/app",
+			wantQuery: `policy:"principal://iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/fleet-project.svc.id.goog/subject/ns/team-a/sa/app"`,
+		},
+		{
+			name:      "custom pool",
+			config:    config.Config{GcpWorkloadIdentityPool: "clusters", GcpWorkloadIdentityPoolProjectNumber: "123"},
+			want:      "principal://iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/clusters/subject/system:serviceaccount:team-a:app",
+			wantQuery: `policy:"principal://iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/clusters/subject/system:serviceaccount:team-a:app"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}
+
+			member := gcpMember(tt.config, serviceAccount)
+			if member != tt.want {
+				t.Errorf("expected member %s, got %s", tt.want, member)
+			}
+			if query := gcpMemberQuery(member); query != tt.wantQuery {
+				t.Errorf("expected query %s, got %s", tt.wantQuery, query)
+			}
+		})
+	}
+}
+
+func TestGCPAssetCacheLookup(t *testing.T) {
+	member := "serviceAccount:project-a.svc.id.goog[team-a/app]"
+	identity := newGCPIdentity("//iam.googleapis.com/projects/project-a/serviceAccounts/app@project-a.iam.gserviceaccount.com")
+	cache := &GCPAssetCache{
+		bindings:  map[string]map[string][]Identity{"projects/project-a": {member: {identity}}},
+		refreshed: map[string]time.Time{"projects/project-a": time.Now()},
+	}
+
+	tests := []struct {
+		name       string
+		scope      string
+		member     string
+		wantCached bool
+		wantCount  int
+	}{
+		{name: "bound member", scope: "projects/project-a", member: member, wantCached: true, wantCount: 1},
+		{name: "member without binding in a cached scope", scope: "projects/project-a", member: "serviceAccount:project-a.svc.id.goog[team-a/other]", wantCached: true},
+		{name: "scope not cached yet", scope: "projects/project-b", member: member},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates, cached := cache.lookup(tt.scope, tt.member)
+			if cached != tt.wantCached {
+				t.Fatalf("expected cached %t, got %t", tt.wantCached, cached)
+			}
+			if len(candidates) != tt.wantCount {
+				t.Errorf("expected %d candidates, got %v", tt.wantCount, candidates)
+			}
+		})
+	}
+
+	// the candidates are copies, so that the cache can't be modified by the caller
+	candidates, _ := cache.lookup("projects/project-a", member)
+	candidates[0].ClientID = "modified"
+	if cache.bindings["projects/project-a"][member][0].ClientID != identity.ClientID {
+		t.Error("expected the cached identity to be unchanged")
+	}
+}
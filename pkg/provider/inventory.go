@@ -0,0 +1,274 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/kuberneteshelper"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/tracing"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// serviceAccountSubjectPrefix is the prefix of the subjects of all service account tokens
+const serviceAccountSubjectPrefix = "system:serviceaccount:"
+
+// Inventory periodically compares the federated identity credentials trusting the cluster issuer with the service accounts
+// of the cluster, using the same discovery as the azure provider. It is run by the manager and reports
+//   - matched pairs: service accounts annotated with the client ID of an identity trusting them
+//   - orphaned credentials: federated identity credentials trusting service accounts which don't exist
+//   - mismatched credentials: federated identity credentials trusting service accounts annotated with another client ID
+//   - dangling annotations: service accounts annotated with the client ID of an identity which doesn't exist
+type Inventory struct {
+	reader           client.Reader
+	config           *config.Config
+	kubernetesHelper *kuberneteshelper.KubernetesHelper
+	logger           logr.Logger
+
+	mu sync.RWMutex
+	// report is the result of the last successful run, nil before the first one
+	report    *inventoryReport
+	refreshed time.Time
+}
+
+// inventoryReport is the result of a single inventory run
+type inventoryReport struct {
+	// identities is the number of discovered managed identities
+	identities int
+	matched    []inventoryEntry
+	orphaned   []inventoryEntry
+	mismatched []inventoryEntry
+	dangling   []inventoryEntry
+}
+
+// inventoryEntry relates a service account to an identity, the fields which don't apply are empty
+type inventoryEntry struct {
+	namespace           string
+	serviceAccount      string
+	clientID            string
+	identity            string
+	federatedCredential string
+}
+
+// SetupInventory adds the inventory to the manager. Nothing is added if INVENTORY_INTERVAL is 0 or the azure provider isn't used.
+func SetupInventory(mgr manager.Manager, logger logr.Logger) error {
+	c, err := config.ParseConfig()
+	if err != nil {
+		return err
+	}
+	if c.InventoryInterval <= 0 || !c.HasProvider("azure") {
+		return nil
+	}
+
+	kubernetesHelper, err := kuberneteshelper.NewKubernetesHelper(mgr.GetConfig(), mgr.GetHTTPClient(), logger)
+	if err != nil {
+		return err
+	}
+	inventory := &Inventory{
+		reader:           mgr.GetAPIReader(),
+		config:           c,
+		kubernetesHelper: kubernetesHelper,
+		logger:           logger.WithName("inventory"),
+	}
+	registerIndex(inventory)
+	registerInventory(inventory)
+	return mgr.Add(inventory)
+}
+
+// Start takes the inventory periodically until the context is done
+func (i *Inventory) Start(ctx context.Context) error {
+	ticker := time.NewTicker(i.config.InventoryInterval)
+	defer ticker.Stop()
+	for {
+		if err := i.run(ctx); err != nil {
+			i.logger.Error(err, "failed to take inventory, keeping the previous result")
+		}
+		select {
+		case <-ctx.Done():
+			i.logger.Info("stopping inventory")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection runs the inventory only on the replica holding the leader lease, so that the cloud APIs are
+// queried and the findings are exported once. With leader election disabled every replica runs it.
+func (i *Inventory) NeedLeaderElection() bool {
+	return true
+}
+
+// run discovers the federated identity credentials trusting the cluster issuer and compares them with the service accounts
+func (i *Inventory) run(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "inventory")
+	defer func() { tracing.End(span, err) }()
+
+	c := *i.config
+	if c.AutoDetectOidcIssuerUrl {
+		if c.OidcIssuerUrl, err = i.kubernetesHelper.GetOidcIssuerUrl(ctx); err != nil {
+			return fmt.Errorf("failed to get OIDC issuer URL: %w", err)
+		}
+	}
+	azure, err := NewAzureQueryProvider(ctx, nil, i.logger, c, true)
+	if err != nil {
+		return err
+	}
+	identities, credentials, err := azure.discoverCredentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	serviceAccounts := &corev1.ServiceAccountList{}
+	if err := i.reader.List(ctx, serviceAccounts); err != nil {
+		return fmt.Errorf("failed to list service accounts: %w", err)
+	}
+
+	report := &inventoryReport{identities: len(identities)}
+	report.classifyCredentials(serviceAccounts.Items, credentials)
+
+	// client IDs of identities outside of the discovery, e.g. excluded by FILTER_TAGS, are looked up before reporting them
+	known := map[string]bool{}
+	for _, identity := range identities {
+		known[strings.ToLower(identity.ClientID)] = true
+	}
+	var unknown []string
+	for _, serviceAccount := range serviceAccounts.Items {
+		clientID := serviceAccount.Annotations[azureClientidAnnotation]
+		if clientID != "" && !known[strings.ToLower(clientID)] && guidRegexp.MatchString(clientID) {
+			unknown = append(unknown, clientID)
+		}
+	}
+	found, err := azure.findClientIDs(ctx, unknown)
+	if err != nil {
+		return err
+	}
+	for _, serviceAccount := range serviceAccounts.Items {
+		clientID := serviceAccount.Annotations[azureClientidAnnotation]
+		if clientID != "" && !known[strings.ToLower(clientID)] && !found[strings.ToLower(clientID)] {
+			report.dangling = append(report.dangling, inventoryEntry{namespace: serviceAccount.Namespace, serviceAccount: serviceAccount.Name, clientID: clientID})
+		}
+	}
+
+	i.logger.Info("took inventory", "identities", report.identities, "matched", len(report.matched), "orphaned", len(report.orphaned), "mismatched", len(report.mismatched), "dangling", len(report.dangling))
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.report, i.refreshed = report, time.Now()
+	return nil
+}
+
+// classifyCredentials reports every federated identity credential as matched, orphaned or mismatched by the service account it trusts
+func (r *inventoryReport) classifyCredentials(serviceAccounts []corev1.ServiceAccount, credentials []*Identity) {
+	// annotated maps the subjects of all service accounts to their annotated client ID, which may be empty
+	annotated := map[string]string{}
+	for j := range serviceAccounts {
+		annotated[ServiceAccountSubject(&serviceAccounts[j])] = serviceAccounts[j].Annotations[azureClientidAnnotation]
+	}
+	for _, credential := range credentials {
+		namespace, name, _ := strings.Cut(strings.TrimPrefix(credential.Subject, serviceAccountSubjectPrefix), ":")
+		entry := inventoryEntry{namespace: namespace, serviceAccount: name, clientID: credential.ClientID, identity: credential.ResourceID, federatedCredential: credential.FederatedCredential}
+		clientID, ok := annotated[credential.Subject]
+		switch {
+		case !ok:
+			r.orphaned = append(r.orphaned, entry)
+		case strings.EqualFold(clientID, credential.ClientID):
+			entry.federatedCredential = ""
+			r.matched = append(r.matched, entry)
+		case clientID != "":
+			// the service account uses another identity, the trust is stale or the annotation is wrong
+			r.mismatched = append(r.mismatched, entry)
+		}
+	}
+}
+
+// get returns the result of the last successful run or nil
+func (i *Inventory) get() *inventoryReport {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.report
+}
+
+// indexStats reports the number of discovered managed identities
+func (i *Inventory) indexStats() []indexStat {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.report == nil {
+		return nil
+	}
+	return []indexStat{{cache: "inventory", scope: "azure", identities: i.report.identities, refreshed: i.refreshed}}
+}
+
+// discoverCredentials returns all managed identities found by the discovery query in all tenants, and an identity
+// for every federated identity credential of them trusting a service account of the cluster issuer
+func (a *azureQueryProvider) discoverCredentials(ctx context.Context) (identities []*Identity, credentials []*Identity, err error) {
+	var errs []error
+	mu := sync.Mutex{}
+	for _, tenant := range a.tenants {
+		err := a.visitUamis(ctx, tenant, func(identity *armmsi.Identity, clientFactory *armmsi.ClientFactory) {
+			resourceGroup := strings.Split(*identity.ID, "/")[4]
+			resourceName := strings.Split(*identity.ID, "/")[8]
+			federatedIdentityCredentials, err := a.getFederatedIdentityCredentialsForUami(ctx, resourceGroup, resourceName, clientFactory)
+
+			mu.Lock()
+			defer mu.Unlock()
+			identities = append(identities, newAzureIdentity(identity, tenant.ID))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to list federated identity credentials of %s: %w", *identity.ID, err))
+				return
+			}
+			if federatedIdentityCredentials == nil {
+				return
+			}
+			for _, i := range *federatedIdentityCredentials {
+				if *i.Properties.Issuer != a.config.OidcIssuerUrl || !strings.HasPrefix(*i.Properties.Subject, serviceAccountSubjectPrefix) {
+					continue
+				}
+				credential := newAzureIdentity(identity, tenant.ID)
+				credential.FederatedCredential = *i.Name
+				credential.Issuer = *i.Properties.Issuer
+				credential.Subject = *i.Properties.Subject
+				credentials = append(credentials, credential)
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// a partial result would report the service accounts of the missing credentials as dangling
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return identities, credentials, nil
+}
+
+// findClientIDs returns the lowercased client IDs of the given ones which belong to a managed identity in any tenant
+func (a *azureQueryProvider) findClientIDs(ctx context.Context, clientIDs []string) (map[string]bool, error) {
+	found := map[string]bool{}
+	if len(clientIDs) == 0 {
+		return found, nil
+	}
+	quoted := make([]string, 0, len(clientIDs))
+	for _, clientID := range clientIDs {
+		quoted = append(quoted, "'"+clientID+"'")
+	}
+	sort.Strings(quoted)
+	query := fmt.Sprintf("resources | where type == \"microsoft.managedidentity/userassignedidentities\" | where properties.clientId in~ (%s)", strings.Join(quoted, ","))
+	for _, tenant := range a.tenants {
+		identities, err := a.queryUamis(ctx, tenant, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, identity := range identities {
+			found[strings.ToLower(*identity.Properties.ClientID)] = true
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestClassifyCredentials(t *testing.T) {
+	serviceAccount := func(namespace string, name string, clientID string) corev1.ServiceAccount {
+		serviceAccount := corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+		if clientID != "" {
+			serviceAccount.Annotations = map[string]string{azureClientidAnnotation: clientID}
+		}
+		return serviceAccount
+	}
+	credential := func(namespace string, name string, clientID string) *Identity {
+		return &Identity{
+			ResourceID:          "identities/" + clientID,
+			ClientID:            clientID,
+			Subject:             "system:serviceaccount:" + namespace + ":" + name,
+			FederatedCredential: namespace + "-" + name,
+		}
+	}
+
+	report := &inventoryReport{}
+	report.classifyCredentials(
+		[]corev1.ServiceAccount{
+			serviceAccount("team-a", "app", "CLIENT-A"),
+			serviceAccount("team-a", "worker", "client-b"),
+			serviceAccount("team-b", "unannotated", ""),
+		},
+		[]*Identity{
+			credential("team-a", "app", "client-a"),
+			credential("team-a", "worker", "client-a"),
+			credential("team-b", "unannotated", "client-a"),
+			credential("team-b", "deleted", "client-a"),
+		},
+	)
+
+	wantMatched := []inventoryEntry{{namespace: "team-a", serviceAccount: "app", clientID: "client-a", identity: "identities/client-a"}}
+	wantOrphaned := []inventoryEntry{{namespace: "team-b", serviceAccount: "deleted", clientID: "client-a", identity: "identities/client-a", federatedCredential: "team-b-deleted"}}
+	wantMismatched := []inventoryEntry{{namespace: "team-a", serviceAccount: "worker", clientID: "client-a", identity: "identities/client-a", federatedCredential: "team-a-worker"}}
+	if !reflect.DeepEqual(report.matched, wantMatched) {
+		t.Errorf("expected matched %+v, got %+v", wantMatched, report.matched)
+	}
+	if !reflect.DeepEqual(report.orphaned, wantOrphaned) {
+		t.Errorf("expected orphaned %+v, got %+v", wantOrphaned, report.orphaned)
+	}
+	if !reflect.DeepEqual(report.mismatched, wantMismatched) {
+		t.Errorf("expected mismatched %+v, got %+v", wantMismatched, report.mismatched)
+	}
+}
+
+func TestInventoryFindings(t *testing.T) {
+	entries := []inventoryEntry{
+		{namespace: "team-b", serviceAccount: "app", clientID: "client-a", identity: "identities/a", federatedCredential: "fic-1"},
+		{namespace: "team-a", serviceAccount: "app", clientID: "client-a", identity: "identities/a", federatedCredential: "fic-2"},
+		{namespace: "team-b", serviceAccount: "worker", clientID: "client-b", identity: "identities/b", federatedCredential: "fic-3"},
+	}
+
+	tests := []struct {
+		name     string
+		detailed bool
+		keys     []string
+		want     []string
+	}{
+		{
+			name: "per namespace",
+			keys: []string{clientIDKey, identityKey},
+			want: []string{"namespace=team-a: 1", "namespace=team-b: 2"},
+		},
+		{
+			name:     "detailed",
+			detailed: true,
+			keys:     []string{clientIDKey, federatedCredentialKey},
+			want: []string{
+				"namespace=team-b,service_account=app,client_id=client-a,federated_credential=fic-1: 1",
+				"namespace=team-a,service_account=app,client_id=client-a,federated_credential=fic-2: 1",
+				"namespace=team-b,service_account=worker,client_id=client-b,federated_credential=fic-3: 1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, finding := range inventoryFindings(entries, tt.detailed, tt.keys...) {
+				series := ""
+				for j, attribute := range finding.attributes {
+					if j > 0 {
+						series += ","
+					}
+					series += string(attribute.Key) + "=" + attribute.Value.AsString()
+				}
+				got = append(got, fmt.Sprintf("%s: %d", series, finding.count))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected series %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package provider
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	apiRequestMetricName           = "azurecs_provider_api_request"
+	apiErrorMetricName             = "azurecs_provider_api_error"
+	identitiesIndexedMetricName    = "azurecs_identities_indexed"
+	cacheAgeMetricName             = "azurecs_cache_age"
+	credentialsCheckedMetricName   = "azurecs_federated_credentials_checked"
+	credentialsProvisionMetricName = "azurecs_federated_credentials_provisioned"
+	inventoryMatchedMetricName     = "azurecs_inventory_matched"
+	inventoryOrphanedMetricName    = "azurecs_inventory_orphaned_federated_credential"
+	inventoryMismatchedMetricName  = "azurecs_inventory_mismatched_federated_credential"
+	inventoryDanglingMetricName    = "azurecs_inventory_dangling_annotation"
+
+	providerKey  = "provider"
+	apiKey       = "api"
+	cacheKey     = "cache"
+	scopeKey     = "scope"
+	resultKey    = "result"
+	operationKey = "operation"
+
+	namespaceKey           = "namespace"
+	serviceAccountKey      = "service_account"
+	clientIDKey            = "client_id"
+	identityKey            = "identity"
+	federatedCredentialKey = "federated_credential"
+
+	// credentialResultMatched, credentialResultAudienceMismatch and credentialResultOther classify the federated identity credentials checked for a service account
+	credentialResultMatched          = "matched"
+	credentialResultAudienceMismatch = "audience_mismatch"
+	credentialResultOther            = "other"
+
+	// provisionOperationCreate and provisionOperationDelete are the operations of the provisioning
+	provisionOperationCreate = "create"
+	provisionOperationDelete = "delete"
+)
+
+var (
+	metricsOnce          sync.Once
+	apiRequest           metric.Float64Histogram
+	apiError             metric.Int64Counter
+	credentialsChecked   metric.Int64Counter
+	credentialsProvision metric.Int64Counter
+
+	indexesMu sync.Mutex
+	// indexes are the caches whose size and age are reported
+	indexes []index
+	// inventories are the inventories whose results are reported
+	inventories []*Inventory
+)
+
+// index is implemented by the caches of identities
+type index interface {
+	indexStats() []indexStat
+}
+
+// indexStat describes the cached identities of a single scope
+type indexStat struct {
+	cache      string
+	scope      string
+	identities int
+	// refreshed is the time of the last successful refresh, it is zero if the scope hasn't been loaded yet
+	refreshed time.Time
+}
+
+// registerIndex reports the size and age of the cache
+func registerIndex(i index) {
+	initMetrics()
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	indexes = append(indexes, i)
+}
+
+// registerInventory reports the results of the inventory
+func registerInventory(i *Inventory) {
+	initMetrics()
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	inventories = append(inventories, i)
+}
+
+// initMetrics creates the instruments of the providers on first use, failures leave no-op instruments
+func initMetrics() {
+	metricsOnce.Do(func() {
+		meter := otel.Meter("provider")
+		apiRequest, _ = meter.Float64Histogram(apiRequestMetricName,
+			metric.WithDescription("Distribution of how long the calls of cloud and identity APIs took in seconds, by provider and API"))
+		apiError, _ = meter.Int64Counter(apiErrorMetricName,
+			metric.WithDescription("Number of failed calls of cloud and identity APIs by provider and API"))
+		credentialsChecked, _ = meter.Int64Counter(credentialsCheckedMetricName,
+			metric.WithDescription("Number of federated identity credentials checked for service accounts by result"))
+		credentialsProvision, _ = meter.Int64Counter(credentialsProvisionMetricName,
+			metric.WithDescription("Number of federated identity credentials and workload identity bindings created or deleted by the syncer"))
+
+		identitiesIndexed, _ := meter.Int64ObservableGauge(identitiesIndexedMetricName,
+			metric.WithDescription("Number of identities held by the caches by cache and scope"))
+		cacheAge, _ := meter.Float64ObservableGauge(cacheAgeMetricName,
+			metric.WithDescription("Seconds since the last successful refresh of the caches by cache and scope"))
+		inventoryMatched, _ := meter.Int64ObservableGauge(inventoryMatchedMetricName,
+			metric.WithDescription("Service accounts annotated with the client ID of a managed identity trusting them"))
+		inventoryOrphaned, _ := meter.Int64ObservableGauge(inventoryOrphanedMetricName,
+			metric.WithDescription("Federated identity credentials trusting service accounts of the cluster which don't exist"))
+		inventoryMismatched, _ := meter.Int64ObservableGauge(inventoryMismatchedMetricName,
+			metric.WithDescription("Federated identity credentials trusting service accounts annotated with the client ID of another managed identity"))
+		inventoryDangling, _ := meter.Int64ObservableGauge(inventoryDanglingMetricName,
+			metric.WithDescription("Service accounts annotated with the client ID of a managed identity which doesn't exist"))
+		if identitiesIndexed == nil || cacheAge == nil || inventoryMatched == nil || inventoryOrphaned == nil || inventoryMismatched == nil || inventoryDangling == nil {
+			return
+		}
+		_, _ = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+			indexesMu.Lock()
+			defer indexesMu.Unlock()
+			for _, i := range indexes {
+				for _, stat := range i.indexStats() {
+					attributes := metric.WithAttributes(attribute.String(cacheKey, stat.cache), attribute.String(scopeKey, stat.scope))
+					o.ObserveInt64(identitiesIndexed, int64(stat.identities), attributes)
+					if !stat.refreshed.IsZero() {
+						o.ObserveFloat64(cacheAge, time.Since(stat.refreshed).Seconds(), attributes)
+					}
+				}
+			}
+			for _, i := range inventories {
+				report := i.get()
+				if report == nil {
+					continue
+				}
+				detailed := i.config.InventoryDetailedMetrics
+				observeInventoryFindings(o, inventoryMatched, report.matched, detailed, clientIDKey, identityKey)
+				observeInventoryFindings(o, inventoryOrphaned, report.orphaned, detailed, clientIDKey, identityKey, federatedCredentialKey)
+				observeInventoryFindings(o, inventoryMismatched, report.mismatched, detailed, clientIDKey, identityKey, federatedCredentialKey)
+				observeInventoryFindings(o, inventoryDangling, report.dangling, detailed, clientIDKey)
+			}
+			return nil
+		}, identitiesIndexed, cacheAge, inventoryMatched, inventoryOrphaned, inventoryMismatched, inventoryDangling)
+	})
+}
+
+// observeInventoryFindings reports the number of findings per namespace. If detailed, every finding is reported with
+// the value 1 and its service account along with the given keys, which keeps the number of series unbounded.
+func observeInventoryFindings(o metric.Observer, gauge metric.Int64ObservableGauge, entries []inventoryEntry, detailed bool, keys ...string) {
+	for _, finding := range inventoryFindings(entries, detailed, keys...) {
+		o.ObserveInt64(gauge, finding.count, metric.WithAttributes(finding.attributes...))
+	}
+}
+
+// inventoryFinding is the value and the attributes of a single series of an inventory gauge
+type inventoryFinding struct {
+	attributes []attribute.KeyValue
+	count      int64
+}
+
+// inventoryFindings aggregates the entries into the series of an inventory gauge, ordered by namespace
+func inventoryFindings(entries []inventoryEntry, detailed bool, keys ...string) []inventoryFinding {
+	if detailed {
+		findings := make([]inventoryFinding, 0, len(entries))
+		for _, entry := range entries {
+			attributes := []attribute.KeyValue{attribute.String(namespaceKey, entry.namespace), attribute.String(serviceAccountKey, entry.serviceAccount)}
+			values := map[string]string{clientIDKey: entry.clientID, identityKey: entry.identity, federatedCredentialKey: entry.federatedCredential}
+			for _, key := range keys {
+				attributes = append(attributes, attribute.String(key, values[key]))
+			}
+			findings = append(findings, inventoryFinding{attributes: attributes, count: 1})
+		}
+		return findings
+	}
+
+	counts := map[string]int64{}
+	for _, entry := range entries {
+		counts[entry.namespace]++
+	}
+	namespaces := make([]string, 0, len(counts))
+	for namespace := range counts {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	findings := make([]inventoryFinding, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		findings = append(findings, inventoryFinding{attributes: []attribute.KeyValue{attribute.String(namespaceKey, namespace)}, count: counts[namespace]})
+	}
+	return findings
+}
+
+// startAPICall starts the span of a call of a cloud or identity API. The returned function ends the span and
+// records the latency and the error of the call.
+func startAPICall(ctx context.Context, provider string, api string, attributes ...attribute.KeyValue) (context.Context, func(error)) {
+	initMetrics()
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, provider+"."+api, attributes...)
+	return ctx, func(err error) {
+		tracing.End(span, err)
+		l := metric.WithAttributes(attribute.String(providerKey, provider), attribute.String(apiKey, api))
+		apiRequest.Record(ctx, time.Since(start).Seconds(), l)
+		if err != nil {
+			apiError.Add(ctx, 1, l)
+		}
+	}
+}
+
+// reportCredentialChecked reports a federated identity credential checked for a service account
+func reportCredentialChecked(ctx context.Context, result string) {
+	initMetrics()
+	credentialsChecked.Add(ctx, 1, metric.WithAttributes(attribute.String(resultKey, result)))
+}
+
+// reportCredentialProvisioned reports a federated identity credential or workload identity binding created or deleted by the syncer
+func reportCredentialProvisioned(ctx context.Context, provider string, operation string) {
+	initMetrics()
+	credentialsProvision.Add(ctx, 1, metric.WithAttributes(attribute.String(providerKey, provider), attribute.String(operationKey, operation)))
+}
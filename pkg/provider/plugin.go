@@ -0,0 +1,122 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pluginQueryProvider delegates to an external provider plugin speaking the protocol of the plugin package
+type pluginQueryProvider struct {
+	defaultQueryProvider
+	name   string
+	client *plugin.Client
+	health *plugin.HealthChecker
+	dryRun bool
+}
+
+// NewPluginQueryProvider returns a provider calling the plugin with the given name. The shared client is used if available.
+func NewPluginQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config, name string, shared *SharedClients, dryRun bool) (*pluginQueryProvider, error) {
+	client := shared.plugin(name)
+	if client == nil {
+		endpoint, ok := config.PluginEndpoints[name]
+		if !ok {
+			return nil, fmt.Errorf("no endpoint configured for plugin %s", name)
+		}
+		client = plugin.NewClient(endpoint, config.PluginTimeout)
+	}
+	return &pluginQueryProvider{
+		defaultQueryProvider: defaultQueryProvider{
+			Logger:         logger,
+			config:         config,
+			serviceAccount: serviceAccount,
+		},
+		name:   name,
+		client: client,
+		health: shared.pluginHealth(),
+		dryRun: dryRun,
+	}, nil
+}
+
+func (p *pluginQueryProvider) Query(ctx context.Context) (*corev1.ServiceAccount, error) {
+	if err := p.healthy(); err != nil {
+		return nil, err
+	}
+
+	callCtx, end := startAPICall(ctx, p.name, "Query")
+	response, err := p.client.Query(callCtx, p.request())
+	end(err)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	p.warnings = response.Warnings
+	if len(response.Annotations) == 0 {
+		return p.serviceAccount, nil
+	}
+
+	p.Logger.Info("Setting new annotations from plugin", "plugin", p.name, "name", p.serviceAccount.Name, "namespace", p.serviceAccount.Namespace)
+	if p.serviceAccount.Annotations == nil {
+		p.serviceAccount.Annotations = make(map[string]string)
+	}
+	for key, value := range response.Annotations {
+		p.serviceAccount.Annotations[key] = value
+	}
+	if response.Identity != nil {
+		p.identity = &Identity{
+			ResourceID:     response.Identity.ResourceID,
+			ClientID:       response.Identity.ClientID,
+			TenantID:       response.Identity.TenantID,
+			SubscriptionID: response.Identity.SubscriptionID,
+			ResourceGroup:  response.Identity.ResourceGroup,
+			Project:        response.Identity.Project,
+			Tags:           response.Identity.Tags,
+		}
+	}
+	return p.serviceAccount, nil
+}
+
+// Verify asks the plugin to verify the identity annotations of the service account
+func (p *pluginQueryProvider) Verify(ctx context.Context) ([]string, error) {
+	if err := p.healthy(); err != nil {
+		return nil, err
+	}
+	callCtx, end := startAPICall(ctx, p.name, "Verify")
+	response, err := p.client.Verify(callCtx, p.request())
+	end(err)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	return response.Problems, nil
+}
+
+// healthy fails fast if the last health probe of the plugin failed
+func (p *pluginQueryProvider) healthy() error {
+	if p.health == nil {
+		return nil
+	}
+	if err := p.health.Err(p.name); err != nil {
+		return fmt.Errorf("plugin %s is unhealthy: %w", p.name, err)
+	}
+	return nil
+}
+
+func (p *pluginQueryProvider) request() plugin.QueryRequest {
+	req := plugin.QueryRequest{
+		ServiceAccount: plugin.ServiceAccount{
+			Name:        p.serviceAccount.Name,
+			Namespace:   p.serviceAccount.Namespace,
+			Labels:      p.serviceAccount.Labels,
+			Annotations: p.serviceAccount.Annotations,
+		},
+		Issuer: p.config.OidcIssuerUrl,
+		DryRun: p.dryRun,
+	}
+	if p.namespace != nil {
+		req.NamespaceLabels = p.namespace.Labels
+	}
+	return req
+}
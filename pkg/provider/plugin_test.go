@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPluginQuery(t *testing.T) {
+	tests := []struct {
+		name            string
+		response        plugin.QueryResponse
+		delay           time.Duration
+		wantOutcome     string
+		wantAnnotations map[string]string
+		wantWarnings    []string
+	}{
+		{
+			name: "identity with warnings",
+			response: plugin.QueryResponse{
+				APIVersion:  plugin.APIVersion,
+				Annotations: map[string]string{"example.com/role": "app"},
+				Identity:    &plugin.Identity{ResourceID: "roles/app", ClientID: "app"},
+				Warnings:    []string{"role app is deprecated"},
+			},
+			wantOutcome:     ProviderOutcomeMatched,
+			wantAnnotations: map[string]string{"example.com/role": "app"},
+			wantWarnings:    []string{"role app is deprecated"},
+		},
+		{
+			name:         "warnings without identity",
+			response:     plugin.QueryResponse{APIVersion: plugin.APIVersion, Warnings: []string{"no role for namespace default"}},
+			wantOutcome:  ProviderOutcomeNotFound,
+			wantWarnings: []string{"no role for namespace default"},
+		},
+		{
+			name:        "version mismatch",
+			response:    plugin.QueryResponse{APIVersion: "plugin.azure.clientid.syncer/v2", Annotations: map[string]string{"example.com/role": "app"}},
+			wantOutcome: ProviderOutcomeError,
+		},
+		{
+			name:        "timeout",
+			response:    plugin.QueryResponse{APIVersion: plugin.APIVersion, Annotations: map[string]string{"example.com/role": "app"}},
+			delay:       time.Second,
+			wantOutcome: ProviderOutcomeError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.delay):
+				case <-r.Context().Done():
+					return
+				}
+				_ = json.NewEncoder(w).Encode(tt.response)
+			}))
+			t.Cleanup(server.Close)
+			serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+			provider, err := NewQueryProvider(serviceAccount, logr.Discard(), config.Config{
+				ProviderTypes:   []string{"fake"},
+				PluginEndpoints: map[string]string{"fake": server.URL},
+				PluginTimeout:   100 * time.Millisecond,
+			}, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _ = provider.Query(context.Background())
+			result := provider.Results()[0]
+			if result.Outcome != tt.wantOutcome {
+				t.Fatalf("expected outcome %s, got %s (%v)", tt.wantOutcome, result.Outcome, result.Err)
+			}
+			if !reflect.DeepEqual(result.Annotations, tt.wantAnnotations) {
+				t.Errorf("expected annotations %v, got %v", tt.wantAnnotations, result.Annotations)
+			}
+			if !reflect.DeepEqual(result.Warnings, tt.wantWarnings) {
+				t.Errorf("expected warnings %v, got %v", tt.wantWarnings, result.Warnings)
+			}
+		})
+	}
+}
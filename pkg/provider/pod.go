@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// vaultAgentInjectAnnotation enables the vault agent injector for a pod
+	vaultAgentInjectAnnotation = "vault.hashicorp.com/agent-inject"
+
+	// azureUseLabel enables the azure workload identity webhook for a pod
+	azureUseLabel = "azure.workload.identity/use"
+
+	// awsRoleArnEnv, awsWebIdentityTokenFileEnv and the token volume mirror the configuration of the EKS pod identity webhook
+	awsRoleArnEnv              = "AWS_ROLE_ARN"
+	awsWebIdentityTokenFileEnv = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	awsTokenVolumeName         = "aws-iam-token"
+	awsTokenMountPath          = "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+	awsTokenAudience           = "sts.amazonaws.com"
+	awsTokenExpirationSeconds  = 86400
+)
+
+// MutatePod adds the workload identity configuration required by the identities annotated on the service account to the pod.
+// It returns true if the pod has been changed.
+func MutatePod(pod *corev1.Pod, serviceAccount *corev1.ServiceAccount) bool {
+	mutated := false
+
+	// the azure workload identity webhook injects the environment and the projected token for labeled pods
+	if serviceAccount.Annotations[azureClientidAnnotation] != "" && pod.Labels[azureUseLabel] == "" {
+		if pod.Labels == nil {
+			pod.Labels = make(map[string]string)
+		}
+		pod.Labels[azureUseLabel] = "true"
+		mutated = true
+	}
+
+	if roleArn := serviceAccount.Annotations[awsRoleArnAnnotation]; roleArn != "" {
+		mutated = mutateAWSPod(pod, roleArn) || mutated
+	}
+
+	// the vault agent injector reads the role from the pod annotations of pods which enabled the injection
+	if pod.Annotations[vaultAgentInjectAnnotation] == "true" && pod.Annotations[vaultRoleAnnotation] == "" && serviceAccount.Annotations[vaultRoleAnnotation] != "" {
+		pod.Annotations[vaultRoleAnnotation] = serviceAccount.Annotations[vaultRoleAnnotation]
+		if authPath := serviceAccount.Annotations[vaultAuthPathAnnotation]; authPath != "" && pod.Annotations[vaultAuthPathAnnotation] == "" {
+			pod.Annotations[vaultAuthPathAnnotation] = authPath
+		}
+		mutated = true
+	}
+
+	return mutated
+}
+
+// mutateAWSPod injects the role ARN and a projected token for the sts.amazonaws.com audience into all containers,
+// unless the pod has already been configured, e.g. by the EKS pod identity webhook
+func mutateAWSPod(pod *corev1.Pod, roleArn string) bool {
+	if slices.ContainsFunc(pod.Spec.Volumes, func(volume corev1.Volume) bool { return volume.Name == awsTokenVolumeName }) {
+		return false
+	}
+
+	expirationSeconds := int64(awsTokenExpirationSeconds)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: awsTokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{
+					ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+						Audience:          awsTokenAudience,
+						ExpirationSeconds: &expirationSeconds,
+						Path:              "token",
+					},
+				}},
+			},
+		},
+	})
+
+	mutateContainer := func(container *corev1.Container) {
+		if slices.ContainsFunc(container.Env, func(env corev1.EnvVar) bool { return env.Name == awsRoleArnEnv }) {
+			return
+		}
+		container.Env = append(container.Env,
+			corev1.EnvVar{Name: awsRoleArnEnv, Value: roleArn},
+			corev1.EnvVar{Name: awsWebIdentityTokenFileEnv, Value: awsTokenMountPath + "/token"},
+		)
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      awsTokenVolumeName,
+			MountPath: awsTokenMountPath,
+			ReadOnly:  true,
+		})
+	}
+	for i := range pod.Spec.InitContainers {
+		mutateContainer(&pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		mutateContainer(&pod.Spec.Containers[i])
+	}
+	return true
+}
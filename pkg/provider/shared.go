@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/plugin"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// SharedClients holds the long-lived clients which are shared by all requests. Background work, like refreshing
+// caches and probing plugins, is run by the manager. All fields may be nil.
+type SharedClients struct {
+	GCPAssets      *GCPAssetCache
+	StaticMappings *StaticMappings
+	Plugins        map[string]*plugin.Client
+	PluginHealth   *plugin.HealthChecker
+}
+
+// SetupSharedClients creates the shared clients of the configured providers and adds their background work to the manager
+func SetupSharedClients(mgr manager.Manager, logger logr.Logger) (*SharedClients, error) {
+	c, err := config.ParseConfig()
+	if err != nil {
+		return nil, err
+	}
+	shared := &SharedClients{}
+
+	if c.HasProvider("gcp") {
+		if shared.GCPAssets, err = newGCPAssetCache(c, logger); err != nil {
+			return nil, err
+		}
+		if err := mgr.Add(shared.GCPAssets); err != nil {
+			shared.GCPAssets.client.Close()
+			return nil, err
+		}
+	}
+
+	if c.HasProvider("static") {
+		if shared.StaticMappings, err = newStaticMappings(c.StaticMappingFile, logger); err != nil {
+			return nil, err
+		}
+		if err := mgr.Add(shared.StaticMappings); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.PluginEndpoints) > 0 {
+		shared.Plugins = map[string]*plugin.Client{}
+		for name, endpoint := range c.PluginEndpoints {
+			if slices.Contains(supportedProviders, name) {
+				return nil, fmt.Errorf("plugin %s conflicts with the built-in provider of the same name", name)
+			}
+			shared.Plugins[name] = plugin.NewClient(endpoint, c.PluginTimeout)
+		}
+		shared.PluginHealth = plugin.NewHealthChecker(shared.Plugins, c.PluginHealthInterval, c.PluginTimeout, logger.WithName("plugin-health"))
+		if err := mgr.Add(shared.PluginHealth); err != nil {
+			return nil, err
+		}
+	}
+
+	return shared, nil
+}
+
+// gcpAssets returns the shared GCP asset cache or nil
+func (s *SharedClients) gcpAssets() *GCPAssetCache {
+	if s == nil {
+		return nil
+	}
+	return s.GCPAssets
+}
+
+// staticMappings returns the shared static mappings or nil
+func (s *SharedClients) staticMappings() *StaticMappings {
+	if s == nil {
+		return nil
+	}
+	return s.StaticMappings
+}
+
+// plugin returns the shared client of the plugin, or nil if there is none
+func (s *SharedClients) plugin(name string) *plugin.Client {
+	if s == nil {
+		return nil
+	}
+	return s.Plugins[name]
+}
+
+// pluginHealth returns the shared plugin health checker or nil
+func (s *SharedClients) pluginHealth() *plugin.HealthChecker {
+	if s == nil {
+		return nil
+	}
+	return s.PluginHealth
+}
@@ -0,0 +1,98 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// staticQueryProvider annotates service accounts from the mappings of STATIC_MAPPING_FILE without querying any cloud API,
+// e.g. in air-gapped or test clusters
+type staticQueryProvider struct {
+	defaultQueryProvider
+	// mappings are the shared, hot-reloaded mappings, the file is read on every call if nil
+	mappings *StaticMappings
+}
+
+func NewStaticQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config, mappings *StaticMappings) (*staticQueryProvider, error) {
+	return &staticQueryProvider{
+		defaultQueryProvider: defaultQueryProvider{
+			Logger:         logger,
+			config:         config,
+			serviceAccount: serviceAccount,
+		},
+		mappings: mappings,
+	}, nil
+}
+
+// Query annotates the service account with the first mapping matching it
+func (s *staticQueryProvider) Query(ctx context.Context) (*corev1.ServiceAccount, error) {
+	mapping, err := s.match()
+	if err != nil || mapping == nil {
+		return s.serviceAccount, err
+	}
+	s.Logger.Info("Found matching static mapping", "mapping", mapping.Name)
+
+	if s.serviceAccount.Annotations == nil {
+		s.serviceAccount.Annotations = make(map[string]string)
+	}
+	for key, value := range mapping.Annotations {
+		s.serviceAccount.Annotations[key] = value
+	}
+	s.identity = &Identity{ResourceID: mapping.Name, ClientID: staticClientID(mapping)}
+	return s.serviceAccount, nil
+}
+
+// Verify reports annotations of the service account differing from the first mapping matching it
+func (s *staticQueryProvider) Verify(ctx context.Context) ([]string, error) {
+	mapping, err := s.match()
+	if err != nil || mapping == nil {
+		return nil, err
+	}
+
+	var problems []string
+	for key, value := range mapping.Annotations {
+		if actual, ok := s.serviceAccount.Annotations[key]; ok && actual != value {
+			problems = append(problems, fmt.Sprintf("annotation %s is %s, but static mapping %s sets %s", key, actual, mapping.Name, value))
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// match returns the first mapping matching the service account or nil
+func (s *staticQueryProvider) match() (*StaticMapping, error) {
+	var mappings []StaticMapping
+	if s.mappings != nil {
+		mappings = s.mappings.get()
+	} else {
+		var err error
+		if mappings, err = loadStaticMappings(s.config.StaticMappingFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range mappings {
+		if mappings[i].matches(s.serviceAccount.Namespace, s.serviceAccount.Name) {
+			return &mappings[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// staticClientID returns the client ID of the mapping, or the value of the first identity annotation it sets
+func staticClientID(mapping *StaticMapping) string {
+	if mapping.ClientID != "" {
+		return mapping.ClientID
+	}
+	for _, annotation := range []string{azureClientidAnnotation, gcpServiceAccountAnnotation, awsRoleArnAnnotation, alibabaRoleNameAnnotation, vaultRoleAnnotation} {
+		if value := mapping.Annotations[annotation]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/yaml"
+)
+
+// StaticMapping maps service accounts matching the namespace and name patterns to fixed annotations
+type StaticMapping struct {
+	// Name identifies the mapping in logs and is used as the resource ID of the identity, defaults to the index in the file
+	Name string `json:"name,omitempty"`
+	// Namespace and ServiceAccount are glob patterns, e.g. "team-*". Empty patterns match every value.
+	Namespace      string `json:"namespace,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// ClientID is passed to policies and expressions, defaults to the first known identity annotation
+	ClientID    string            `json:"clientID,omitempty"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// staticMappingFile is the format of STATIC_MAPPING_FILE, which may be YAML or JSON
+type staticMappingFile struct {
+	Mappings []StaticMapping `json:"mappings"`
+}
+
+// matches reports whether the patterns of the mapping match the namespace and name of the service account
+func (m *StaticMapping) matches(namespace, name string) bool {
+	return matchesPattern(m.Namespace, namespace) && matchesPattern(m.ServiceAccount, name)
+}
+
+func matchesPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+// loadStaticMappings reads and validates the mapping file
+func loadStaticMappings(file string) ([]StaticMapping, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var mappingFile staticMappingFile
+	if err := yaml.UnmarshalStrict(data, &mappingFile); err != nil {
+		return nil, fmt.Errorf("invalid static mapping file %s: %w", file, err)
+	}
+	// an empty file is most likely written right now, "mappings: []" removes all mappings on purpose
+	if mappingFile.Mappings == nil {
+		return nil, fmt.Errorf("invalid static mapping file %s: no mappings key", file)
+	}
+	for i := range mappingFile.Mappings {
+		m := &mappingFile.Mappings[i]
+		if m.Name == "" {
+			m.Name = fmt.Sprintf("mappings[%d]", i)
+		}
+		for _, pattern := range []string{m.Namespace, m.ServiceAccount} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q in static mapping %s: %w", pattern, m.Name, err)
+			}
+		}
+		if len(m.Annotations) == 0 {
+			return nil, fmt.Errorf("static mapping %s has no annotations", m.Name)
+		}
+	}
+	return mappingFile.Mappings, nil
+}
+
+// StaticMappings holds the mappings of STATIC_MAPPING_FILE and reloads them whenever the file changes.
+// It is run by the manager. A file which can't be loaded is logged and the previous mappings are kept.
+type StaticMappings struct {
+	file   string
+	logger logr.Logger
+
+	mu       sync.RWMutex
+	mappings []StaticMapping
+	// loaded is the time the mappings were last loaded successfully
+	loaded time.Time
+}
+
+// newStaticMappings loads the mapping file, which has to be valid on startup
+func newStaticMappings(file string, logger logr.Logger) (*StaticMappings, error) {
+	mappings, err := loadStaticMappings(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &StaticMappings{
+		file:     file,
+		logger:   logger.WithName("static-mappings"),
+		mappings: mappings,
+		loaded:   time.Now(),
+	}
+	registerIndex(s)
+	return s, nil
+}
+
+// Start watches the directory of the mapping file until the context is done. The directory is watched instead of
+// the file, as mounted ConfigMaps are updated by replacing a symlink.
+func (s *StaticMappings) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch static mapping file: %w", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(s.file)); err != nil {
+		return fmt.Errorf("failed to watch static mapping file: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("stopping static mapping watcher")
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			s.reload()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			s.logger.Error(err, "failed to watch static mapping file")
+		}
+	}
+}
+
+// NeedLeaderElection is false, as each replica reloads its own copy of the mappings
+func (s *StaticMappings) NeedLeaderElection() bool {
+	return false
+}
+
+// reload replaces the mappings if the file can be loaded
+func (s *StaticMappings) reload() {
+	mappings, err := loadStaticMappings(s.file)
+	if err != nil {
+		s.logger.Error(err, "failed to reload static mapping file, keeping the previous mappings")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mappings = mappings
+	s.loaded = time.Now()
+	s.logger.Info("reloaded static mapping file", "file", s.file, "mappingsCount", len(mappings))
+}
+
+// get returns the current mappings, which must not be modified
+func (s *StaticMappings) get() []StaticMapping {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mappings
+}
+
+// indexStats reports the number of mappings
+func (s *StaticMappings) indexStats() []indexStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return []indexStat{{cache: "static", scope: s.file, identities: len(s.mappings), refreshed: s.loaded}}
+}
@@ -0,0 +1,197 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testStaticMappings = `
+mappings:
+- name: app
+  namespace: team-a
+  serviceAccount: app
+  annotations:
+    azure.workload.identity/client-id: app-client-id
+- namespace: team-*
+  serviceAccount: worker-*
+  clientID: workers
+  annotations:
+    example.com/role: worker
+- name: fallback
+  annotations:
+    iam.gke.io/gcp-service-account: fallback@project.iam.gserviceaccount.com
+`
+
+// writeStaticMappings writes the mapping file into a temporary directory and returns its path
+func writeStaticMappings(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "mappings.yaml")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestStaticQuery(t *testing.T) {
+	file := writeStaticMappings(t, testStaticMappings)
+
+	tests := []struct {
+		name            string
+		namespace       string
+		serviceAccount  string
+		wantAnnotations map[string]string
+		wantIdentity    *Identity
+	}{
+		{
+			name:            "exact patterns",
+			namespace:       "team-a",
+			serviceAccount:  "app",
+			wantAnnotations: map[string]string{"azure.workload.identity/client-id": "app-client-id"},
+			wantIdentity:    &Identity{ResourceID: "app", ClientID: "app-client-id"},
+		},
+		{
+			name:            "glob patterns with client ID and default name",
+			namespace:       "team-b",
+			serviceAccount:  "worker-1",
+			wantAnnotations: map[string]string{"example.com/role": "worker"},
+			wantIdentity:    &Identity{ResourceID: "mappings[1]", ClientID: "workers"},
+		},
+		{
+			name:            "empty patterns match every service account",
+			namespace:       "other",
+			serviceAccount:  "app",
+			wantAnnotations: map[string]string{"iam.gke.io/gcp-service-account": "fallback@project.iam.gserviceaccount.com"},
+			wantIdentity:    &Identity{ResourceID: "fallback", ClientID: "fallback@project.iam.gserviceaccount.com"},
+		},
+	}
+	for _, tt := range tests {
+		for _, shared := range []bool{false, true} {
+			name := tt.name
+			if shared {
+				name += " with shared mappings"
+			}
+			t.Run(name, func(t *testing.T) {
+				var mappings *StaticMappings
+				if shared {
+					var err error
+					if mappings, err = newStaticMappings(file, logr.Discard()); err != nil {
+						t.Fatal(err)
+					}
+				}
+				serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: tt.serviceAccount, Namespace: tt.namespace}}
+				provider, err := NewStaticQueryProvider(serviceAccount, logr.Discard(), config.Config{StaticMappingFile: file}, mappings)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				annotated, err := provider.Query(context.Background())
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !reflect.DeepEqual(annotated.Annotations, tt.wantAnnotations) {
+					t.Errorf("expected annotations %v, got %v", tt.wantAnnotations, annotated.Annotations)
+				}
+				if !reflect.DeepEqual(provider.Identity(), tt.wantIdentity) {
+					t.Errorf("expected identity %+v, got %+v", tt.wantIdentity, provider.Identity())
+				}
+			})
+		}
+	}
+}
+
+func TestStaticVerify(t *testing.T) {
+	file := writeStaticMappings(t, testStaticMappings)
+	serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:        "app",
+		Namespace:   "team-a",
+		Annotations: map[string]string{"azure.workload.identity/client-id": "other", "example.com/unrelated": "value"},
+	}}
+	provider, err := NewStaticQueryProvider(serviceAccount, logr.Discard(), config.Config{StaticMappingFile: file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := provider.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(problems) != 1 {
+		t.Errorf("expected one problem, got %v", problems)
+	}
+}
+
+func TestLoadStaticMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: testStaticMappings},
+		{name: "json", content: `{"mappings": [{"namespace": "team-a", "annotations": {"example.com/role": "a"}}]}`},
+		{name: "no mappings", content: `mappings: []`},
+		{name: "empty file", content: "", wantErr: true},
+		{name: "invalid pattern", content: "mappings:\n- namespace: \"team-[\"\n  annotations:\n    example.com/role: a\n", wantErr: true},
+		{name: "no annotations", content: "mappings:\n- namespace: team-a\n", wantErr: true},
+		{name: "unknown field", content: "mappings:\n- namespaces: team-a\n  annotations:\n    example.com/role: a\n", wantErr: true},
+		{name: "invalid yaml", content: "mappings: [", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadStaticMappings(writeStaticMappings(t, tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestStaticMappingsReload(t *testing.T) {
+	file := writeStaticMappings(t, testStaticMappings)
+	mappings, err := newStaticMappings(file, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- mappings.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	// mounted ConfigMaps are updated by renaming a new file over the old one. The update is repeated until the
+	// watcher, which is started asynchronously, picks it up.
+	update := filepath.Join(filepath.Dir(file), "update.yaml")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mappings.get()) != 1 && time.Now().Before(deadline) {
+		if err := os.WriteFile(update, []byte("mappings:\n- name: updated\n  annotations:\n    example.com/role: updated\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(update, file); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := mappings.get(); len(got) != 1 || got[0].Name != "updated" {
+		t.Fatalf("expected the updated mappings, got %+v", got)
+	}
+
+	// invalid content keeps the previous mappings
+	if err := os.WriteFile(file, []byte("mappings: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mappings.reload()
+	if got := mappings.get(); len(got) != 1 || got[0].Name != "updated" {
+		t.Errorf("expected the previous mappings to be kept, got %+v", got)
+	}
+}
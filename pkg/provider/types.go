@@ -1,30 +1,415 @@
 package provider
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/go-logr/logr"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// ProviderOutcomeMatched is reported if the provider added or changed annotations
+	ProviderOutcomeMatched = "matched"
+	// ProviderOutcomeNotFound is reported if the provider did not find an identity for the service account
+	ProviderOutcomeNotFound = "not_found"
+	// ProviderOutcomeError is reported if the provider failed
+	ProviderOutcomeError = "error"
+	// ProviderOutcomeSkipped is reported if the provider was not enabled for the service account via its opt-in label
+	ProviderOutcomeSkipped = "skipped"
+	// ProviderOutcomeDenied is reported if the identity found by the provider was rejected by a policy
+	ProviderOutcomeDenied = "denied"
+	// ProviderOutcomeAudienceMismatch is reported if only federated credentials with the wrong audience trust the service account
+	ProviderOutcomeAudienceMismatch = "audience_mismatch"
+	// ProviderOutcomeAmbiguous is reported if several identities of the same rank were found and the provider cannot decide which one to use
+	ProviderOutcomeAmbiguous = "ambiguous"
+
+	// providerLabelPrefix is the prefix of the per-provider labels on service accounts, e.g. 'azure.clientid.syncer/provider-gcp: "true"'
+	providerLabelPrefix = "azure.clientid.syncer/provider-"
 )
 
 type queryProvider interface {
-	Query() (*corev1.ServiceAccount, error)
+	Query(ctx context.Context) (*corev1.ServiceAccount, error)
+	// Identity returns the identity annotated by the last Query call, or nil if none was found
+	Identity() *Identity
+	// Candidates returns the resource IDs of the candidate identities considered by the last Query call
+	Candidates() []string
+	// Warnings returns the warnings of the last Query call, which are returned to the client of the admission request
+	Warnings() []string
+	setNamespace(namespace *corev1.Namespace)
+	setPolicy(policy PolicyFunc, selected bool)
+}
+
+var (
+	// ErrAudienceMismatch is returned by a provider if federated credentials trust the service account, but none of them has the expected audience
+	ErrAudienceMismatch = errors.New("federated identity credential audience mismatch")
+	// ErrIdentityDenied is returned by a provider if the policy denied an identity before it was provisioned
+	ErrIdentityDenied = errors.New("identity denied by policy")
+	// ErrAmbiguousIdentity is returned by a provider if several identities of the same rank were found
+	ErrAmbiguousIdentity = errors.New("ambiguous identity")
+)
+
+// verifiedAnnotations are the identity annotations checked by the verifiers
+var verifiedAnnotations = []string{azureClientidAnnotation, gcpServiceAccountAnnotation, alibabaRoleNameAnnotation, vaultRoleAnnotation}
+
+// HasIdentityAnnotations reports whether the service account carries any identity annotation which can be verified
+func HasIdentityAnnotations(serviceAccount *corev1.ServiceAccount) bool {
+	for _, annotation := range verifiedAnnotations {
+		if serviceAccount.Annotations[annotation] != "" {
+			return true
+		}
+	}
+	return false
 }
 
-func NewQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config) (queryProvider, error) {
-	switch config.ProviderType {
+// IdentityAnnotationsChanged reports whether the identity annotations, or the annotations the verification depends on, differ between both service accounts
+func IdentityAnnotationsChanged(oldServiceAccount, serviceAccount *corev1.ServiceAccount) bool {
+	for _, annotation := range append(slices.Clone(verifiedAnnotations), AzureTenantIDAnnotation, vaultAuthPathAnnotation) {
+		if oldServiceAccount.Annotations[annotation] != serviceAccount.Annotations[annotation] {
+			return true
+		}
+	}
+	return false
+}
+
+// verifier is implemented by providers which can verify identity annotations which have been set manually
+type verifier interface {
+	// Verify checks the identity annotations of the service account and returns the problems found.
+	// An error is returned if the annotations could not be verified, e.g. because the cloud API is unavailable.
+	Verify(ctx context.Context) ([]string, error)
+}
+
+// Identity describes the identity a provider annotated on a service account
+type Identity struct {
+	// ResourceID is the ID of the resource the identity was taken from, e.g. the Azure resource ID or the GCP resource name
+	ResourceID string
+	// ClientID is the Azure client ID, the GCP service account email or the AWS role ARN
+	ClientID       string
+	TenantID       string
+	SubscriptionID string
+	ResourceGroup  string
+	Project        string
+	Tags           map[string]string
+	// FederatedCredential is the name of the federated identity credential trusting the service account
+	FederatedCredential string
+	Issuer              string
+	Subject             string
+	Audiences           []string
+}
+
+// ProviderResult describes the outcome of a single provider for a service account
+type ProviderResult struct {
+	Provider    string
+	Outcome     string
+	Annotations map[string]string
+	// Finalizers added by the provider, e.g. to clean up provisioned resources
+	Finalizers []string
+	Identity   *Identity
+	// Candidates are the resource IDs of the candidate identities the provider considered
+	Candidates []string
+	// Warnings reported by the provider, e.g. by a plugin
+	Warnings []string
+	Err      error
+}
+
+// PolicyFunc decides whether the identity found by a provider may be annotated on the service account.
+// A non-nil error denies the identity and is recorded as the result error.
+type PolicyFunc func(result ProviderResult) error
+
+// multiQueryProvider runs all configured providers for a service account and merges their annotations.
+// If several providers set the same annotation, the provider listed first wins.
+type multiQueryProvider struct {
+	defaultQueryProvider
+	client  client.Client
+	dryRun  bool
+	policy  PolicyFunc
+	shared  *SharedClients
+	results []ProviderResult
+}
+
+// NewQueryProvider returns a provider querying all configured providers for the service account.
+// The kubernetes client is used by providers reading cluster resources, which must not have side effects if dryRun is set.
+func NewQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config, kubeClient client.Client, dryRun bool) (*multiQueryProvider, error) {
+	for _, providerType := range config.Providers() {
+		if _, ok := config.PluginEndpoints[providerType]; !ok && !slices.Contains(supportedProviders, providerType) {
+			return nil, errors.New("unknown provider type: " + providerType)
+		}
+	}
+	return &multiQueryProvider{
+		defaultQueryProvider: defaultQueryProvider{
+			Logger:         logger,
+			config:         config,
+			serviceAccount: serviceAccount,
+		},
+		client: kubeClient,
+		dryRun: dryRun,
+	}, nil
+}
+
+var supportedProviders = []string{"azure", "gcp", "binding", "alibaba", "vault", "static"}
+
+// newSingleQueryProvider creates the provider of the given type operating on the given service account
+func (m *multiQueryProvider) newSingleQueryProvider(ctx context.Context, providerType string, serviceAccount *corev1.ServiceAccount, logger logr.Logger) (queryProvider, error) {
+	switch providerType {
 	case "azure":
-		return NewAzureQueryProvider(serviceAccount, logger, config)
+		return NewAzureQueryProvider(ctx, serviceAccount, logger, m.config, m.dryRun)
 	case "gcp":
-		return NewGCPQueryProvider(serviceAccount, logger, config)
+		return NewGCPQueryProvider(serviceAccount, logger, m.config, m.dryRun, m.shared.gcpAssets())
+	case "binding":
+		return NewBindingQueryProvider(serviceAccount, logger, m.config, m.client)
+	case "alibaba":
+		return NewAlibabaQueryProvider(serviceAccount, logger, m.config)
+	case "vault":
+		return NewVaultQueryProvider(serviceAccount, logger, m.config)
+	case "static":
+		return NewStaticQueryProvider(serviceAccount, logger, m.config, m.shared.staticMappings())
 	default:
-		return nil, errors.New("unknown provider type: " + config.ProviderType)
+		if _, ok := m.config.PluginEndpoints[providerType]; ok {
+			return NewPluginQueryProvider(serviceAccount, logger, m.config, providerType, m.shared, m.dryRun)
+		}
+		return nil, errors.New("unknown provider type: " + providerType)
+	}
+}
+
+func (m *multiQueryProvider) Query(ctx context.Context) (*corev1.ServiceAccount, error) {
+	providers := m.config.Providers()
+	m.results = make([]ProviderResult, len(providers))
+
+	wg := sync.WaitGroup{}
+	for i, providerType := range providers {
+		if !m.enabled(providerType) {
+			m.results[i] = ProviderResult{Provider: providerType, Outcome: ProviderOutcomeSkipped}
+			continue
+		}
+		if !m.config.ProviderParallel {
+			m.results[i] = m.run(ctx, providerType)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, providerType string) {
+			defer wg.Done()
+			m.results[i] = m.run(ctx, providerType)
+		}(i, providerType)
+	}
+	wg.Wait()
+
+	if m.policy != nil {
+		for i, result := range m.results {
+			if result.Outcome != ProviderOutcomeMatched {
+				continue
+			}
+			if err := m.policy(result); err != nil {
+				m.Logger.Info("identity denied by policy", "provider", result.Provider, "name", m.serviceAccount.Name, "namespace", m.serviceAccount.Namespace, "reason", err.Error())
+				m.results[i].Outcome, m.results[i].Err, m.results[i].Annotations, m.results[i].Finalizers = ProviderOutcomeDenied, err, nil, nil
+			}
+		}
+	}
+
+	var errs []error
+	active := 0
+	for _, result := range m.results {
+		m.Logger.Info("provider finished", "provider", result.Provider, "outcome", result.Outcome, "name", m.serviceAccount.Name, "namespace", m.serviceAccount.Namespace)
+		switch result.Outcome {
+		case ProviderOutcomeSkipped:
+			continue
+		case ProviderOutcomeError, ProviderOutcomeAmbiguous:
+			errs = append(errs, fmt.Errorf("%s: %w", result.Provider, result.Err))
+		}
+		active++
+	}
+	if active > 0 && len(errs) == active {
+		return nil, errors.Join(errs...)
+	}
+
+	// iterate in reverse order, so that the annotations of the first provider take precedence
+	for i := len(m.results) - 1; i >= 0; i-- {
+		if len(m.results[i].Annotations) == 0 {
+			continue
+		}
+		if m.serviceAccount.Annotations == nil {
+			m.serviceAccount.Annotations = make(map[string]string)
+		}
+		for key, value := range m.results[i].Annotations {
+			m.serviceAccount.Annotations[key] = value
+		}
+		for _, finalizer := range m.results[i].Finalizers {
+			controllerutil.AddFinalizer(m.serviceAccount, finalizer)
+		}
+	}
+
+	return m.serviceAccount, nil
+}
+
+// WithNamespace sets the namespace of the service account, which is passed to the expressions evaluated by the providers
+func (m *multiQueryProvider) WithNamespace(namespace *corev1.Namespace) *multiQueryProvider {
+	m.namespace = namespace
+	return m
+}
+
+// WithPolicy sets the policy every matched identity is checked against before its annotations are merged.
+// selected reports whether any policy selects the namespace of the service account, which is required to provision identities
+// outside of the provisioning allowlists.
+func (m *multiQueryProvider) WithPolicy(policy PolicyFunc, selected bool) *multiQueryProvider {
+	m.policy = policy
+	m.policySelected = selected
+	return m
+}
+
+// WithSharedClients sets the long-lived clients shared by all requests
+func (m *multiQueryProvider) WithSharedClients(shared *SharedClients) *multiQueryProvider {
+	m.shared = shared
+	return m
+}
+
+// Verify checks the identity annotations of the service account with all enabled providers supporting verification
+func (m *multiQueryProvider) Verify(ctx context.Context) ([]string, error) {
+	var problems []string
+	for _, providerType := range m.config.Providers() {
+		if !m.enabled(providerType) {
+			continue
+		}
+		logger := m.Logger.WithValues("provider", providerType)
+		provider, err := m.newSingleQueryProvider(ctx, providerType, m.serviceAccount.DeepCopy(), logger)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", providerType, err)
+		}
+		v, ok := provider.(verifier)
+		if !ok {
+			continue
+		}
+		providerProblems, err := v.Verify(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", providerType, err)
+		}
+		problems = append(problems, providerProblems...)
 	}
+	return problems, nil
+}
+
+// Results returns the per-provider outcomes of the last Query call
+func (m *multiQueryProvider) Results() []ProviderResult {
+	return m.results
+}
+
+// enabled checks the per-provider label of the service account. A label with the value "false" always disables the provider,
+// if PROVIDER_OPT_IN is set the provider is only enabled if the label is set to "true".
+func (m *multiQueryProvider) enabled(providerType string) bool {
+	value, ok := m.serviceAccount.Labels[providerLabelPrefix+providerType]
+	if ok && strings.EqualFold(value, "false") {
+		return false
+	}
+	if m.config.ProviderOptIn {
+		return ok && strings.EqualFold(value, "true")
+	}
+	return true
+}
+
+// run queries a single provider on a copy of the service account and collects the annotations it added or changed
+func (m *multiQueryProvider) run(ctx context.Context, providerType string) (result ProviderResult) {
+	result = ProviderResult{Provider: providerType}
+	logger := m.Logger.WithValues("provider", providerType)
+	ctx, span := tracing.Start(ctx, "provider."+providerType, attribute.String("provider", providerType))
+	defer func() {
+		span.SetAttributes(attribute.String("outcome", result.Outcome))
+		tracing.End(span, result.Err)
+	}()
+
+	provider, err := m.newSingleQueryProvider(ctx, providerType, m.serviceAccount.DeepCopy(), logger)
+	if err != nil {
+		logger.Error(err, "failed to create query provider")
+		result.Outcome, result.Err = ProviderOutcomeError, err
+		return result
+	}
+	provider.setNamespace(m.namespace)
+	provider.setPolicy(m.policy, m.policySelected)
+	annotatedServiceAccount, err := provider.Query(ctx)
+	result.Candidates = provider.Candidates()
+	result.Warnings = provider.Warnings()
+	if errors.Is(err, ErrIdentityDenied) {
+		result.Outcome, result.Err = ProviderOutcomeDenied, err
+		return result
+	}
+	if errors.Is(err, ErrAudienceMismatch) {
+		logger.Info("found federated identity credentials with mismatching audiences", "reason", err.Error())
+		result.Outcome, result.Err = ProviderOutcomeAudienceMismatch, err
+		return result
+	}
+	if errors.Is(err, ErrAmbiguousIdentity) {
+		logger.Info("found several identities of the same rank", "reason", err.Error())
+		result.Outcome, result.Err = ProviderOutcomeAmbiguous, err
+		return result
+	}
+	if err != nil {
+		logger.Error(err, "failed to query service account")
+		result.Outcome, result.Err = ProviderOutcomeError, err
+		return result
+	}
+
+	for key, value := range annotatedServiceAccount.Annotations {
+		if original, ok := m.serviceAccount.Annotations[key]; !ok || original != value {
+			if result.Annotations == nil {
+				result.Annotations = make(map[string]string)
+			}
+			result.Annotations[key] = value
+		}
+	}
+	for _, finalizer := range annotatedServiceAccount.Finalizers {
+		if !slices.Contains(m.serviceAccount.Finalizers, finalizer) {
+			result.Finalizers = append(result.Finalizers, finalizer)
+		}
+	}
+	if len(result.Annotations) > 0 {
+		result.Outcome = ProviderOutcomeMatched
+		result.Identity = provider.Identity()
+	} else {
+		result.Outcome = ProviderOutcomeNotFound
+	}
+	return result
 }
 
 type defaultQueryProvider struct {
-	Logger logr.Logger
-	config config.Config
+	Logger         logr.Logger
+	config         config.Config
 	serviceAccount *corev1.ServiceAccount
+	// namespace of the service account, may be nil if it is unknown
+	namespace *corev1.Namespace
+	// policy is checked by providers before they provision an identity, may be nil
+	policy PolicyFunc
+	// policySelected is true if a policy selects the namespace of the service account
+	policySelected bool
+	identity       *Identity
+	// candidates are the resource IDs of all identities passed to selectCandidates
+	candidates []string
+	// warnings are returned to the client of the admission request
+	warnings []string
+}
+
+func (d *defaultQueryProvider) setNamespace(namespace *corev1.Namespace) {
+	d.namespace = namespace
+}
+
+func (d *defaultQueryProvider) setPolicy(policy PolicyFunc, selected bool) {
+	d.policy = policy
+	d.policySelected = selected
+}
+
+func (d *defaultQueryProvider) Identity() *Identity {
+	return d.identity
+}
+
+func (d *defaultQueryProvider) Candidates() []string {
+	return d.candidates
+}
+
+func (d *defaultQueryProvider) Warnings() []string {
+	return d.warnings
 }
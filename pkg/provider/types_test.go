@@ -0,0 +1,183 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/plugin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestPlugin serves the annotations as the plugin response, nil annotations fail every query
+func newTestPlugin(t *testing.T, annotations map[string]string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if annotations == nil {
+			http.Error(w, "backend unavailable", http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(plugin.QueryResponse{
+			APIVersion:  plugin.APIVersion,
+			Annotations: annotations,
+			Identity:    &plugin.Identity{ResourceID: "identities/" + annotations["example.com/role"]},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestMultiQueryProvider(t *testing.T) {
+	plugins := map[string]map[string]string{
+		"first":  {"example.com/role": "first", "example.com/first": "true"},
+		"second": {"example.com/role": "second", "example.com/second": "true"},
+		"empty":  {},
+		"broken": nil,
+	}
+	denySecond := func(result ProviderResult) error {
+		if result.Provider == "second" {
+			return errors.New("second is not allowed")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name            string
+		providers       []string
+		labels          map[string]string
+		annotations     map[string]string
+		optIn           bool
+		policy          PolicyFunc
+		wantOutcomes    []string
+		wantAnnotations map[string]string
+		wantErr         bool
+	}{
+		{
+			name:            "first provider takes precedence",
+			providers:       []string{"first", "second"},
+			wantOutcomes:    []string{ProviderOutcomeMatched, ProviderOutcomeMatched},
+			wantAnnotations: map[string]string{"example.com/role": "first", "example.com/first": "true", "example.com/second": "true"},
+		},
+		{
+			name:            "failing provider besides a match",
+			providers:       []string{"broken", "second"},
+			wantOutcomes:    []string{ProviderOutcomeError, ProviderOutcomeMatched},
+			wantAnnotations: map[string]string{"example.com/role": "second", "example.com/second": "true"},
+		},
+		{
+			name:         "failing provider besides not found",
+			providers:    []string{"broken", "empty"},
+			wantOutcomes: []string{ProviderOutcomeError, ProviderOutcomeNotFound},
+		},
+		{
+			name:         "all providers failing",
+			providers:    []string{"broken"},
+			wantOutcomes: []string{ProviderOutcomeError},
+			wantErr:      true,
+		},
+		{
+			name:            "unchanged annotations are not found",
+			providers:       []string{"first"},
+			annotations:     map[string]string{"example.com/role": "first", "example.com/first": "true"},
+			wantOutcomes:    []string{ProviderOutcomeNotFound},
+			wantAnnotations: map[string]string{"example.com/role": "first", "example.com/first": "true"},
+		},
+		{
+			name:            "provider disabled by label",
+			providers:       []string{"first", "second"},
+			labels:          map[string]string{"azure.clientid.syncer/provider-first": "false"},
+			wantOutcomes:    []string{ProviderOutcomeSkipped, ProviderOutcomeMatched},
+			wantAnnotations: map[string]string{"example.com/role": "second", "example.com/second": "true"},
+		},
+		{
+			name:            "opt-in",
+			providers:       []string{"first", "second"},
+			labels:          map[string]string{"azure.clientid.syncer/provider-second": "true"},
+			optIn:           true,
+			wantOutcomes:    []string{ProviderOutcomeSkipped, ProviderOutcomeMatched},
+			wantAnnotations: map[string]string{"example.com/role": "second", "example.com/second": "true"},
+		},
+		{
+			name:         "all providers skipped",
+			providers:    []string{"broken"},
+			optIn:        true,
+			wantOutcomes: []string{ProviderOutcomeSkipped},
+		},
+		{
+			name:            "denied identity isn't merged",
+			providers:       []string{"first", "second"},
+			policy:          denySecond,
+			wantOutcomes:    []string{ProviderOutcomeMatched, ProviderOutcomeDenied},
+			wantAnnotations: map[string]string{"example.com/role": "first", "example.com/first": "true"},
+		},
+		{
+			name:         "denied identity besides a failing provider",
+			providers:    []string{"broken", "second"},
+			policy:       denySecond,
+			wantOutcomes: []string{ProviderOutcomeError, ProviderOutcomeDenied},
+		},
+	}
+	for _, tt := range tests {
+		for _, parallel := range []bool{false, true} {
+			name := tt.name
+			if parallel {
+				name += " in parallel"
+			}
+			t.Run(name, func(t *testing.T) {
+				endpoints := map[string]string{}
+				for _, name := range tt.providers {
+					endpoints[name] = newTestPlugin(t, plugins[name])
+				}
+				serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+					Name:        "app",
+					Namespace:   "default",
+					Labels:      tt.labels,
+					Annotations: tt.annotations,
+				}}
+				provider, err := NewQueryProvider(serviceAccount, logr.Discard(), config.Config{
+					ProviderTypes:    tt.providers,
+					ProviderOptIn:    tt.optIn,
+					ProviderParallel: parallel,
+					PluginEndpoints:  endpoints,
+					PluginTimeout:    time.Second,
+				}, nil, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				provider.WithPolicy(tt.policy, tt.policy != nil)
+
+				annotated, err := provider.Query(context.Background())
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+				}
+				var outcomes []string
+				for _, result := range provider.Results() {
+					outcomes = append(outcomes, result.Outcome)
+				}
+				if !reflect.DeepEqual(outcomes, tt.wantOutcomes) {
+					t.Errorf("expected outcomes %v, got %v", tt.wantOutcomes, outcomes)
+				}
+				if tt.wantErr {
+					return
+				}
+				if !reflect.DeepEqual(annotated.Annotations, tt.wantAnnotations) {
+					t.Errorf("expected annotations %v, got %v", tt.wantAnnotations, annotated.Annotations)
+				}
+			})
+		}
+	}
+}
+
+func TestNewQueryProviderUnknownProvider(t *testing.T) {
+	_, err := NewQueryProvider(&corev1.ServiceAccount{}, logr.Discard(), config.Config{ProviderTypes: []string{"azure", "unknown"}}, nil, false)
+	if err == nil {
+		t.Fatal("expected error for unknown provider")
+	}
+}
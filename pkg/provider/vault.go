@@ -0,0 +1,188 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// vaultRoleAnnotation and vaultAuthPathAnnotation are the annotations of the Vault agent injector selecting the role and the auth mount
+	vaultRoleAnnotation     = "vault.hashicorp.com/role"
+	vaultAuthPathAnnotation = "vault.hashicorp.com/auth-path"
+	// vaultRoleQueryConcurrency limits the parallel role reads
+	vaultRoleQueryConcurrency = 10
+)
+
+// vaultQueryProvider finds Vault Kubernetes or JWT auth roles which are bound to the service account
+type vaultQueryProvider struct {
+	defaultQueryProvider
+	client *vaultClient
+}
+
+func NewVaultQueryProvider(serviceAccount *corev1.ServiceAccount, logger logr.Logger, config config.Config) (*vaultQueryProvider, error) {
+	return &vaultQueryProvider{
+		defaultQueryProvider: defaultQueryProvider{
+			Logger:         logger,
+			config:         config,
+			serviceAccount: serviceAccount,
+		},
+		client: &vaultClient{
+			address:    config.VaultAddress,
+			namespace:  config.VaultNamespace,
+			token:      config.VaultToken,
+			loginMount: config.VaultLoginMount,
+			loginRole:  config.VaultLoginRole,
+			httpClient: &http.Client{Timeout: 30 * time.Second},
+		},
+	}, nil
+}
+
+// Query searches the auth mounts in order, the first mount containing a bound role wins
+func (v *vaultQueryProvider) Query(ctx context.Context) (*corev1.ServiceAccount, error) {
+	for _, mount := range v.config.VaultAuthMounts {
+		candidates, err := v.searchRoles(ctx, mount)
+		if err != nil {
+			return nil, err
+		}
+
+		selected, ambiguous := v.selectCandidates(candidates)
+		if ambiguous {
+			return nil, fmt.Errorf("%w: multiple vault roles were found in auth/%s, cannot decide which one to use", ErrAmbiguousIdentity, mount)
+		}
+		if selected != nil {
+			if v.serviceAccount.Annotations == nil {
+				v.serviceAccount.Annotations = make(map[string]string)
+			}
+			v.serviceAccount.Annotations[vaultRoleAnnotation] = selected.ClientID
+			v.serviceAccount.Annotations[vaultAuthPathAnnotation] = "auth/" + mount
+			v.identity = selected
+			return v.serviceAccount, nil
+		}
+	}
+	return v.serviceAccount, nil
+}
+
+// Verify checks that the Vault role annotated on the service account is bound to it
+func (v *vaultQueryProvider) Verify(ctx context.Context) ([]string, error) {
+	roleName := v.serviceAccount.Annotations[vaultRoleAnnotation]
+	if roleName == "" {
+		return nil, nil
+	}
+	mount := strings.TrimPrefix(v.serviceAccount.Annotations[vaultAuthPathAnnotation], "auth/")
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	// the annotations are user-controlled, they must not reach other Vault paths with the token of the webhook
+	if !slices.Contains(v.config.VaultAuthMounts, mount) {
+		return nil, fmt.Errorf("auth mount %s of the %s annotation is not one of VAULT_AUTH_MOUNTS", mount, vaultAuthPathAnnotation)
+	}
+	if roleName == "." || roleName == ".." {
+		return []string{fmt.Sprintf("vault role name %s is invalid", roleName)}, nil
+	}
+
+	role, err := v.client.getRole(ctx, mount, roleName)
+	var apiErr *vaultError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return []string{fmt.Sprintf("vault role %s not found in auth/%s", roleName, mount)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !v.bound(role) {
+		return []string{fmt.Sprintf("vault role %s in auth/%s is not bound to %s", roleName, mount, ServiceAccountSubject(v.serviceAccount))}, nil
+	}
+	return nil, nil
+}
+
+// searchRoles returns all roles of the auth mount which are bound to the service account
+func (v *vaultQueryProvider) searchRoles(ctx context.Context, mount string) ([]*Identity, error) {
+	names, err := v.client.listRoles(ctx, mount)
+	if err != nil {
+		return nil, err
+	}
+	v.Logger.Info("Detected vault roles to check", "mount", mount, "rolesCount", len(names))
+
+	var candidates []*Identity
+	var errs []error
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	semaphore := make(chan struct{}, vaultRoleQueryConcurrency)
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			role, err := v.client.getRole(ctx, mount, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			if v.bound(role) {
+				v.Logger.Info("Found matching vault role", "mount", mount, "role", name)
+				candidates = append(candidates, &Identity{ResourceID: "auth/" + mount + "/role/" + name, ClientID: name})
+			}
+		}(name)
+	}
+	wg.Wait()
+	// a role which couldn't be read may be the only match or make the match ambiguous, so the result would be partial
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to read %d of %d vault roles in auth/%s: %w", len(errs), len(names), mount, errors.Join(errs...))
+	}
+	return candidates, nil
+}
+
+// bound reports whether the role is bound to the service account, either by the service account names and namespaces
+// of a Kubernetes auth role or by the subject of a JWT auth role. Roles bound to every service account are ignored.
+func (v *vaultQueryProvider) bound(role *vaultRole) bool {
+	if len(role.BoundServiceAccountNames) > 0 {
+		return matchesSpecific(role.BoundServiceAccountNames, v.serviceAccount.Name) && matchesGlob(role.BoundServiceAccountNamespaces, v.serviceAccount.Namespace)
+	}
+
+	subject := ServiceAccountSubject(v.serviceAccount)
+	if role.BoundSubject != "" {
+		return role.BoundSubject == subject
+	}
+	var subjects []string
+	switch claim := role.BoundClaims["sub"].(type) {
+	case string:
+		subjects = []string{claim}
+	case []interface{}:
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				subjects = append(subjects, s)
+			}
+		}
+	}
+	if role.BoundClaimsType == "glob" {
+		return matchesSpecific(subjects, subject)
+	}
+	return slices.Contains(subjects, subject)
+}
+
+// matchesGlob reports whether one of the glob patterns matches the value
+func matchesGlob(patterns []string, value string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		matched, _ := path.Match(pattern, value)
+		return matched
+	})
+}
+
+// matchesSpecific is matchesGlob ignoring the wildcard "*", which would bind every service account
+func matchesSpecific(patterns []string, value string) bool {
+	return matchesGlob(slices.DeleteFunc(slices.Clone(patterns), func(pattern string) bool { return pattern == "*" }), value)
+}
@@ -0,0 +1,201 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// vaultTokenRefreshMargin renews the login token before it expires
+	vaultTokenRefreshMargin = time.Minute
+)
+
+// vaultServiceAccountTokenFile is a variable, so that tests can replace it
+var vaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+var (
+	// vaultTokenCache holds the token obtained by the login of the webhook, which is shared between all requests.
+	// Tokens without a lease duration don't expire, their expiration is zero.
+	vaultTokenCache           string
+	vaultTokenCacheExpiration time.Time
+	vaultTokenCacheMutex      sync.Mutex
+)
+
+// vaultClient calls the HTTP API of Vault
+type vaultClient struct {
+	address    string
+	namespace  string
+	token      string
+	loginMount string
+	loginRole  string
+	httpClient *http.Client
+}
+
+// vaultError is returned for responses with an unexpected status code
+type vaultError struct {
+	StatusCode int
+	Errors     []string `json:"errors"`
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("vault API error %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// vaultRole holds the fields of Kubernetes and JWT auth roles which bind a role to service accounts
+type vaultRole struct {
+	BoundServiceAccountNames      []string               `json:"bound_service_account_names"`
+	BoundServiceAccountNamespaces []string               `json:"bound_service_account_namespaces"`
+	BoundSubject                  string                 `json:"bound_subject"`
+	BoundClaims                   map[string]interface{} `json:"bound_claims"`
+	BoundClaimsType               string                 `json:"bound_claims_type"`
+}
+
+// listRoles returns the names of all roles of the auth mount
+func (c *vaultClient) listRoles(ctx context.Context, mount string) (_ []string, err error) {
+	ctx, end := startAPICall(ctx, "vault", "ListRoles")
+	defer func() { end(err) }()
+
+	var response struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	err = c.call(ctx, "LIST", "/v1/auth/"+mount+"/role", nil, &response)
+	var apiErr *vaultError
+	// Vault responds with 404 if the mount has no roles
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return response.Data.Keys, err
+}
+
+// getRole returns the role of the auth mount
+func (c *vaultClient) getRole(ctx context.Context, mount string, name string) (_ *vaultRole, err error) {
+	ctx, end := startAPICall(ctx, "vault", "ReadRole")
+	defer func() { end(err) }()
+
+	var response struct {
+		Data vaultRole `json:"data"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/v1/auth/"+mount+"/role/"+url.PathEscape(name), nil, &response); err != nil {
+		return nil, err
+	}
+	return &response.Data, nil
+}
+
+// authToken returns VAULT_TOKEN or, if VAULT_LOGIN_ROLE is set, a token obtained by logging in with the service account of the webhook
+func (c *vaultClient) authToken(ctx context.Context) (string, error) {
+	if c.token != "" {
+		return c.token, nil
+	}
+	if c.loginRole == "" {
+		return "", errors.New("no vault credentials found, set VAULT_TOKEN or VAULT_LOGIN_ROLE")
+	}
+
+	vaultTokenCacheMutex.Lock()
+	defer vaultTokenCacheMutex.Unlock()
+	if vaultTokenCache != "" && (vaultTokenCacheExpiration.IsZero() || time.Until(vaultTokenCacheExpiration) > vaultTokenRefreshMargin) {
+		return vaultTokenCache, nil
+	}
+
+	jwt, err := os.ReadFile(vaultServiceAccountTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %w", err)
+	}
+	var response struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	loginCtx, end := startAPICall(ctx, "vault", "Login")
+	err = c.do(loginCtx, http.MethodPost, "/v1/auth/"+c.loginMount+"/login", "", map[string]string{
+		"role": c.loginRole,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}, &response)
+	end(err)
+	if err != nil {
+		return "", fmt.Errorf("failed to log in to vault: %w", err)
+	}
+	vaultTokenCache, vaultTokenCacheExpiration = response.Auth.ClientToken, time.Time{}
+	if response.Auth.LeaseDuration > 0 {
+		vaultTokenCacheExpiration = time.Now().Add(time.Duration(response.Auth.LeaseDuration) * time.Second)
+	}
+	return vaultTokenCache, nil
+}
+
+// invalidateAuthToken drops the cached login token, unless another request has already replaced it
+func invalidateAuthToken(token string) {
+	vaultTokenCacheMutex.Lock()
+	defer vaultTokenCacheMutex.Unlock()
+	if vaultTokenCache == token {
+		vaultTokenCache = ""
+	}
+}
+
+// call sends an authenticated request. If a login token has been revoked or has expired early, Vault responds with 403,
+// so the request is retried once with a new token.
+func (c *vaultClient) call(ctx context.Context, method string, path string, body interface{}, response interface{}) error {
+	token, err := c.authToken(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.do(ctx, method, path, token, body, response)
+	var apiErr *vaultError
+	if c.token != "" || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		return err
+	}
+	invalidateAuthToken(token)
+	if token, err = c.authToken(ctx); err != nil {
+		return err
+	}
+	return c.do(ctx, method, path, token, body, response)
+}
+
+// do sends the request and decodes the JSON response
+func (c *vaultClient) do(ctx context.Context, method string, path string, token string, body interface{}, response interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.address, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &vaultError{StatusCode: resp.StatusCode}
+		_ = json.Unmarshal(data, apiErr)
+		return apiErr
+	}
+	return json.Unmarshal(data, response)
+}
@@ -0,0 +1,376 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testVaultToken     = "root"
+	testVaultNamespace = "admin"
+)
+
+// fakeVault stands in for a Vault dev server serving the roles of auth mounts
+type fakeVault struct {
+	mu sync.Mutex
+	// mounts maps the auth mounts to their roles, mounts without roles respond with 404 like Vault
+	mounts map[string]map[string]vaultRole
+	// failing are the roles of the form <mount>/<name> which can't be read
+	failing map[string]bool
+	// token is accepted by the fake, and returned by logins to the kubernetes mount without a lease duration
+	token string
+	// logins counts the logins
+	logins int
+	// paths are the escaped paths of all requests
+	paths []string
+}
+
+func newFakeVault(t *testing.T, mounts map[string]map[string]vaultRole) (*fakeVault, *httptest.Server) {
+	vault := &fakeVault{mounts: mounts, failing: map[string]bool{}, token: testVaultToken}
+	server := httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+	return vault, server
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.paths = append(f.paths, r.URL.EscapedPath())
+	if r.Method == http.MethodPost && r.URL.Path == "/v1/auth/kubernetes/login" {
+		f.logins++
+		_ = json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": f.token, "lease_duration": 0}})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != f.token || r.Header.Get("X-Vault-Namespace") != testVaultNamespace {
+		f.fail(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	mount, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/auth/"), "/role")
+	roles := f.mounts[mount]
+	switch {
+	case !ok:
+		f.fail(w, http.StatusNotFound, "")
+	case r.Method == "LIST" && rest == "":
+		if len(roles) == 0 {
+			f.fail(w, http.StatusNotFound, "")
+			return
+		}
+		keys := make([]string, 0, len(roles))
+		for name := range roles {
+			keys = append(keys, name)
+		}
+		sort.Strings(keys)
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"keys": keys}})
+	case r.Method == http.MethodGet && strings.HasPrefix(rest, "/"):
+		name := rest[1:]
+		role, ok := roles[name]
+		switch {
+		case !ok:
+			f.fail(w, http.StatusNotFound, "")
+		case f.failing[mount+"/"+name]:
+			f.fail(w, http.StatusInternalServerError, "internal error")
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": role})
+		}
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+func (f *fakeVault) fail(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	errs := []string{}
+	if message != "" {
+		errs = append(errs, message)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": errs})
+}
+
+func newTestVaultQueryProvider(t *testing.T, server *httptest.Server, mounts []string, serviceAccount *corev1.ServiceAccount) *vaultQueryProvider {
+	provider, err := NewVaultQueryProvider(serviceAccount, logr.Discard(), config.Config{
+		VaultAddress:    server.URL,
+		VaultNamespace:  testVaultNamespace,
+		VaultToken:      testVaultToken,
+		VaultAuthMounts: mounts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestVaultBound(t *testing.T) {
+	tests := []struct {
+		name  string
+		role  vaultRole
+		bound bool
+	}{
+		{
+			name:  "kubernetes role bound to name and namespace",
+			role:  vaultRole{BoundServiceAccountNames: []string{"other", "app"}, BoundServiceAccountNamespaces: []string{"team-a"}},
+			bound: true,
+		},
+		{
+			name:  "kubernetes role bound to name glob",
+			role:  vaultRole{BoundServiceAccountNames: []string{"ap*"}, BoundServiceAccountNamespaces: []string{"team-*"}},
+			bound: true,
+		},
+		{
+			name:  "kubernetes role bound to every namespace",
+			role:  vaultRole{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"*"}},
+			bound: true,
+		},
+		{
+			name: "kubernetes role bound to other namespace",
+			role: vaultRole{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"team-b"}},
+		},
+		{
+			name: "kubernetes role bound to other name",
+			role: vaultRole{BoundServiceAccountNames: []string{"other"}, BoundServiceAccountNamespaces: []string{"team-a"}},
+		},
+		{
+			name: "kubernetes role bound to every service account",
+			role: vaultRole{BoundServiceAccountNames: []string{"*"}, BoundServiceAccountNamespaces: []string{"team-a"}},
+		},
+		{
+			name:  "jwt role bound to subject",
+			role:  vaultRole{BoundSubject: "system:serviceaccount:team-a:app"},
+			bound: true,
+		},
+		{
+			name: "jwt role bound to other subject",
+			role: vaultRole{BoundSubject: "system:serviceaccount:team-b:app"},
+		},
+		{
+			name:  "jwt role with sub claim",
+			role:  vaultRole{BoundClaims: map[string]interface{}{"sub": "system:serviceaccount:team-a:app"}},
+			bound: true,
+		},
+		{
+			name:  "jwt role with sub claim list",
+			role:  vaultRole{BoundClaims: map[string]interface{}{"sub": []interface{}{"system:serviceaccount:team-b:app", "system:serviceaccount:team-a:app"}}},
+			bound: true,
+		},
+		{
+			name: "jwt role with sub claim pattern without glob type",
+			role: vaultRole{BoundClaims: map[string]interface{}{"sub": "system:serviceaccount:team-a:*"}},
+		},
+		{
+			name:  "jwt role with glob sub claim",
+			role:  vaultRole{BoundClaims: map[string]interface{}{"sub": "system:serviceaccount:team-a:*"}, BoundClaimsType: "glob"},
+			bound: true,
+		},
+		{
+			name: "jwt role with glob sub claim of other namespace",
+			role: vaultRole{BoundClaims: map[string]interface{}{"sub": []interface{}{"system:serviceaccount:team-b:*"}}, BoundClaimsType: "glob"},
+		},
+		{
+			name: "jwt role with wildcard glob sub claim",
+			role: vaultRole{BoundClaims: map[string]interface{}{"sub": "*"}, BoundClaimsType: "glob"},
+		},
+		{
+			name: "jwt role bound to other claims",
+			role: vaultRole{BoundClaims: map[string]interface{}{"aud": "vault"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &vaultQueryProvider{defaultQueryProvider: defaultQueryProvider{
+				serviceAccount: &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}},
+			}}
+			if bound := v.bound(&tt.role); bound != tt.bound {
+				t.Errorf("expected bound %t, got %t", tt.bound, bound)
+			}
+		})
+	}
+}
+
+func TestVaultQuery(t *testing.T) {
+	bound := vaultRole{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"team-a"}}
+	boundSubject := vaultRole{BoundSubject: "system:serviceaccount:team-a:app"}
+	wildcard := vaultRole{BoundServiceAccountNames: []string{"*"}, BoundServiceAccountNamespaces: []string{"*"}}
+
+	tests := []struct {
+		name         string
+		mounts       map[string]map[string]vaultRole
+		failing      []string
+		wantRole     string
+		wantAuthPath string
+		wantErr      error
+		wantVaultErr bool
+	}{
+		{
+			name:         "kubernetes role",
+			mounts:       map[string]map[string]vaultRole{"kubernetes": {"app": bound, "all": wildcard}},
+			wantRole:     "app",
+			wantAuthPath: "auth/kubernetes",
+		},
+		{
+			name:         "first mount with a bound role wins",
+			mounts:       map[string]map[string]vaultRole{"kubernetes": {"app": bound}, "jwt": {"app-jwt": boundSubject}},
+			wantRole:     "app",
+			wantAuthPath: "auth/kubernetes",
+		},
+		{
+			name:         "next mount if the first has only wildcard roles",
+			mounts:       map[string]map[string]vaultRole{"kubernetes": {"all": wildcard}, "jwt": {"app-jwt": boundSubject}},
+			wantRole:     "app-jwt",
+			wantAuthPath: "auth/jwt",
+		},
+		{
+			name:         "mount without roles",
+			mounts:       map[string]map[string]vaultRole{"jwt": {"app-jwt": boundSubject}},
+			wantRole:     "app-jwt",
+			wantAuthPath: "auth/jwt",
+		},
+		{
+			name:   "only wildcard roles",
+			mounts: map[string]map[string]vaultRole{"kubernetes": {"all": wildcard}},
+		},
+		{
+			name:    "several bound roles in a mount",
+			mounts:  map[string]map[string]vaultRole{"kubernetes": {"app": bound, "app-2": bound}},
+			wantErr: ErrAmbiguousIdentity,
+		},
+		{
+			name:         "unreadable role besides a match",
+			mounts:       map[string]map[string]vaultRole{"kubernetes": {"app": bound, "broken": bound}},
+			failing:      []string{"kubernetes/broken"},
+			wantVaultErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault, server := newFakeVault(t, tt.mounts)
+			for _, role := range tt.failing {
+				vault.failing[role] = true
+			}
+			serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}
+
+			_, err := newTestVaultQueryProvider(t, server, []string{"kubernetes", "jwt"}, serviceAccount).Query(context.Background())
+			var apiErr *vaultError
+			switch {
+			case tt.wantVaultErr:
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("expected vault error, got %v", err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := serviceAccount.Annotations[vaultRoleAnnotation]; got != tt.wantRole {
+				t.Errorf("expected role %q, got %q", tt.wantRole, got)
+			}
+			if got := serviceAccount.Annotations[vaultAuthPathAnnotation]; got != tt.wantAuthPath {
+				t.Errorf("expected auth path %q, got %q", tt.wantAuthPath, got)
+			}
+		})
+	}
+}
+
+func TestVaultVerify(t *testing.T) {
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		wantWarnings int
+		wantErr      bool
+	}{
+		{name: "bound role", annotations: map[string]string{vaultRoleAnnotation: "app"}},
+		{name: "bound role of auth path", annotations: map[string]string{vaultRoleAnnotation: "app-jwt", vaultAuthPathAnnotation: "auth/jwt"}},
+		{name: "role bound to other service account", annotations: map[string]string{vaultRoleAnnotation: "other"}, wantWarnings: 1},
+		{name: "wildcard role", annotations: map[string]string{vaultRoleAnnotation: "all"}, wantWarnings: 1},
+		{name: "missing role", annotations: map[string]string{vaultRoleAnnotation: "missing"}, wantWarnings: 1},
+		{name: "no role annotation"},
+		{name: "auth path outside of the configured mounts", annotations: map[string]string{vaultRoleAnnotation: "app", vaultAuthPathAnnotation: "auth/other"}, wantErr: true},
+		{name: "auth path traversal", annotations: map[string]string{vaultRoleAnnotation: "app", vaultAuthPathAnnotation: "auth/kubernetes/../../sys"}, wantErr: true},
+		{name: "role traversal", annotations: map[string]string{vaultRoleAnnotation: "../../../sys/seal-status?list=true"}, wantWarnings: 1},
+		{name: "parent role", annotations: map[string]string{vaultRoleAnnotation: ".."}, wantWarnings: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault, server := newFakeVault(t, map[string]map[string]vaultRole{
+				"kubernetes": {
+					"app":   {BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"team-a"}},
+					"other": {BoundServiceAccountNames: []string{"other"}, BoundServiceAccountNamespaces: []string{"team-a"}},
+					"all":   {BoundServiceAccountNames: []string{"*"}, BoundServiceAccountNamespaces: []string{"*"}},
+				},
+				"jwt": {"app-jwt": {BoundSubject: "system:serviceaccount:team-a:app"}},
+			})
+			serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a", Annotations: tt.annotations}}
+
+			warnings, err := newTestVaultQueryProvider(t, server, []string{"kubernetes", "jwt"}, serviceAccount).Verify(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("expected %d warnings, got %v", tt.wantWarnings, warnings)
+			}
+			// the annotations may only select a single role of a configured mount
+			for _, path := range vault.paths {
+				role, ok := strings.CutPrefix(path, "/v1/auth/kubernetes/role/")
+				if !ok {
+					role, ok = strings.CutPrefix(path, "/v1/auth/jwt/role/")
+				}
+				if !ok || strings.Contains(role, "/") || role == ".." {
+					t.Errorf("unexpected request to %s", path)
+				}
+			}
+		})
+	}
+}
+
+func TestVaultLoginToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("jwt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defaultTokenFile := vaultServiceAccountTokenFile
+	vaultServiceAccountTokenFile = tokenFile
+	resetVaultTokenCache := func() { vaultTokenCache, vaultTokenCacheExpiration = "", time.Time{} }
+	resetVaultTokenCache()
+	t.Cleanup(func() {
+		vaultServiceAccountTokenFile = defaultTokenFile
+		resetVaultTokenCache()
+	})
+
+	vault, server := newFakeVault(t, map[string]map[string]vaultRole{"kubernetes": {"app": {BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"team-a"}}}})
+	client := &vaultClient{address: server.URL, namespace: testVaultNamespace, loginMount: "kubernetes", loginRole: "syncer", httpClient: server.Client()}
+
+	// tokens without a lease duration don't expire
+	for i := 0; i < 3; i++ {
+		if _, err := client.listRoles(context.Background(), "kubernetes"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if vault.logins != 1 {
+		t.Errorf("expected 1 login, got %d", vault.logins)
+	}
+
+	// a revoked token is replaced by a new login
+	vault.token = "rotated"
+	if _, err := client.listRoles(context.Background(), "kubernetes"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if vault.logins != 2 {
+		t.Errorf("expected 2 logins, got %d", vault.logins)
+	}
+}
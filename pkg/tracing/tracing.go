@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracerName is the instrumentation scope of all spans
+	tracerName  = "github.com/shiftavenue/azure-clientid-syncer"
+	serviceName = "azure-clientid-syncer"
+
+	// AdmissionUIDKey is the attribute holding the UID of the admission request, it is added to every span of the request
+	AdmissionUIDKey = attribute.Key("admission.uid")
+)
+
+type admissionUIDContextKey struct{}
+
+// InitTracer exports spans via OTLP/gRPC to the given endpoint, e.g. "otel-collector.monitoring:4317".
+// The standard OTEL_EXPORTER_OTLP_* environment variables are respected as well. Without InitTracer all spans are discarded.
+// The returned function flushes the remaining spans and has to be called on shutdown.
+func InitTracer(ctx context.Context, endpoint string, insecure bool, sampleRatio float64) (func(context.Context) error, error) {
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// WithAdmissionUID stores the UID of the admission request in the context, so that it is added to all spans started from it
+func WithAdmissionUID(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, admissionUIDContextKey{}, uid)
+}
+
+// Start starts a span with the given attributes and the admission UID of the context
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if uid, ok := ctx.Value(admissionUIDContextKey{}).(string); ok {
+		attributes = append(attributes, AdmissionUIDKey.String(uid))
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End records the error, if any, and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/audit"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// audit records the mutation decision for the request. The service account may be empty if the request couldn't be decoded.
+func (m *serviceAccountMutator) audit(req admission.Request, serviceAccount *corev1.ServiceAccount, results []provider.ProviderResult, policyEnabled bool, response admission.Response, latency time.Duration) {
+	if m.auditLogger == nil {
+		return
+	}
+
+	event := audit.Event{
+		Time:       time.Now().UTC(),
+		RequestUID: string(req.UID),
+		Operation:  string(req.Operation),
+		DryRun:     req.DryRun != nil && *req.DryRun,
+		User: audit.User{
+			Username: req.UserInfo.Username,
+			UID:      req.UserInfo.UID,
+			Groups:   req.UserInfo.Groups,
+		},
+		ServiceAccount: audit.ServiceAccount{Namespace: req.Namespace, Name: serviceAccount.Name},
+		Allowed:        response.Allowed,
+		LatencySeconds: latency.Seconds(),
+	}
+	if event.ServiceAccount.Name == "" {
+		event.ServiceAccount.Name = req.Name
+	}
+	if !response.Allowed && response.Result != nil {
+		event.Error = response.Result.Message
+	}
+
+	for _, result := range results {
+		decision := audit.Provider{
+			Provider:    result.Provider,
+			Outcome:     result.Outcome,
+			Candidates:  result.Candidates,
+			Annotations: result.Annotations,
+		}
+		if result.Identity != nil {
+			decision.Identity = &audit.Identity{ResourceID: result.Identity.ResourceID, ClientID: result.Identity.ClientID, TenantID: result.Identity.TenantID}
+		}
+		switch {
+		case result.Outcome == provider.ProviderOutcomeDenied:
+			decision.Policy = audit.PolicyDenied
+		case result.Outcome == provider.ProviderOutcomeMatched && policyEnabled:
+			decision.Policy = audit.PolicyAllowed
+		}
+		if result.Err != nil {
+			decision.Error = result.Err.Error()
+		}
+		event.Providers = append(event.Providers, decision)
+	}
+
+	m.auditLogger.Record(event)
+}
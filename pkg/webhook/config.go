@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/kuberneteshelper"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// resolveConfig parses the configuration for a request in the given namespace, applies the namespace overrides and detects the OIDC issuer URL.
+// It returns the namespace along with the configuration, or the http status code to respond with if it fails.
+func resolveConfig(ctx context.Context, c client.Client, kubernetesHelper *kuberneteshelper.KubernetesHelper, logger logr.Logger, namespaceName string) (_ *config.Config, _ *corev1.Namespace, _ int32, err error) {
+	ctx, span := tracing.Start(ctx, "resolveConfig", attribute.String("namespace", namespaceName))
+	defer func() { tracing.End(span, err) }()
+
+	config, err := config.ParseConfig()
+	if err != nil {
+		logger.Error(err, "failed to parse config")
+		return nil, nil, http.StatusInternalServerError, err
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := c.Get(ctx, client.ObjectKey{Name: namespaceName}, namespace); err != nil {
+		logger.Error(err, "failed to get namespace", "namespace", namespaceName)
+		return nil, nil, http.StatusInternalServerError, err
+	}
+
+	if len(config.NamespaceOverrideAllowlist) > 0 {
+		// an invalid override must not block all service accounts of the namespace, the global configuration is used instead
+		overrides, err := config.ApplyNamespaceOverrides(namespace.Annotations)
+		if err != nil {
+			logger.Error(err, "ignoring invalid namespace overrides", "namespace", namespaceName)
+		}
+		if len(overrides) > 0 {
+			logger.Info("applied namespace overrides", "namespace", namespaceName, "overrides", overrides)
+		}
+	}
+
+	if config.AutoDetectOidcIssuerUrl {
+		issuerCtx, issuerSpan := tracing.Start(ctx, "detectOidcIssuerUrl")
+		config.OidcIssuerUrl, err = kubernetesHelper.GetOidcIssuerUrl(issuerCtx)
+		tracing.End(issuerSpan, err)
+		if err != nil {
+			logger.Error(err, "failed to get OIDC issuer URL")
+			return nil, nil, http.StatusInternalServerError, err
+		}
+		logger.Info("detected OIDC issuer URL: " + config.OidcIssuerUrl)
+	}
+
+	return config, namespace, http.StatusOK, nil
+}
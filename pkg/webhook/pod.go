@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,groups="",resources=pods,verbs=create,versions=v1,name=pod-mutation.azure-clientid-syncer-webhook.io,sideEffects=None,admissionReviewVersions=v1;v1beta1,matchPolicy=Equivalent,reinvocationPolicy=IfNeeded
+
+const (
+	// syncerUseLabel marks service accounts handled by the service account mutator
+	syncerUseLabel = "azure.clientid.syncer/use"
+	// podInjectLabel disables the pod mutation for a pod if set to "false"
+	podInjectLabel = "azure.clientid.syncer/inject"
+)
+
+// podMutator adds the workload identity configuration to pods using a service account annotated by the service account mutator
+type podMutator struct {
+	client  client.Client
+	decoder *admission.Decoder
+	logger  logr.Logger
+}
+
+// NewPodMutator returns a pod mutation handler
+func NewPodMutator(client client.Client, scheme *runtime.Scheme, log logr.Logger) (admission.Handler, error) {
+	return &podMutator{
+		client:  client,
+		logger:  log,
+		decoder: admission.NewDecoder(scheme),
+	}, nil
+}
+
+// Handle mutates pods whose service account carries the syncer label and identity annotations
+func (m *podMutator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := m.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if pod.Labels[podInjectLabel] == "false" {
+		return admission.Allowed("pod mutation disabled by label")
+	}
+
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := m.client.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: serviceAccountName}, serviceAccount); err != nil {
+		if apierrors.IsNotFound(err) {
+			return admission.Allowed("service account not found")
+		}
+		m.logger.Error(err, "failed to get service account", "name", serviceAccountName, "namespace", req.Namespace)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if serviceAccount.Labels[syncerUseLabel] != "true" {
+		return admission.Allowed("service account not managed by azure-clientid-syncer")
+	}
+
+	if !provider.MutatePod(pod, serviceAccount) {
+		return admission.Allowed("")
+	}
+	m.logger.Info("injected workload identity configuration into pod", "serviceAccount", serviceAccountName, "namespace", req.Namespace)
+
+	marshaledPod, err := json.Marshal(pod)
+	if err != nil {
+		m.logger.Error(err, "failed to marshal pod")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+}
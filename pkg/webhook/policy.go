@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/apis/v1alpha1"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/policy"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// identityDeniedReason is the reason of the events emitted if a policy denies an identity
+	identityDeniedReason = "IdentityDenied"
+)
+
+// identityPolicy returns a policy enforcing all ClusterIdentityPolicies on the identities found for the service account
+// and whether any of them selects the namespace.
+// Denials are emitted as events on the denying policy and the namespace and are reported as metric. The service account
+// doesn't exist yet on CREATE, the denial reason is returned to the requester as admission warning instead.
+func (m *serviceAccountMutator) identityPolicy(ctx context.Context, namespace *corev1.Namespace, serviceAccount *corev1.ServiceAccount) (provider.PolicyFunc, bool, error) {
+	policies := &v1alpha1.ClusterIdentityPolicyList{}
+	if err := m.client.List(ctx, policies); err != nil {
+		return nil, false, err
+	}
+	if len(policies.Items) == 0 {
+		return nil, false, nil
+	}
+
+	return func(result provider.ProviderResult) error {
+		denyingPolicy, err := policy.Evaluate(policies.Items, namespace, result.Provider, result.Identity)
+		if err == nil {
+			return nil
+		}
+		m.recorder.Eventf(denyingPolicy, corev1.EventTypeWarning, identityDeniedReason,
+			"denied %s identity for service account %s/%s: %s", result.Provider, serviceAccount.Namespace, serviceAccount.Name, err)
+		m.recorder.Eventf(namespace, corev1.EventTypeWarning, identityDeniedReason,
+			"denied %s identity for service account %s: %s", result.Provider, serviceAccount.Name, err)
+		ReportPolicyDenied(ctx, namespace.Name, result.Provider, denyingPolicy.Name)
+		return err
+	}, policy.SelectsNamespace(policies.Items, namespace), nil
+}
@@ -4,19 +4,28 @@ import (
 	"context"
 	"time"
 
-	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
 const (
 	requestDurationMetricName = "azurecs_mutation_request"
+	providerResultMetricName  = "azurecs_provider_result"
+	policyDeniedMetricName    = "azurecs_policy_denied"
+	admissionMetricName       = "azurecs_admission"
 
 	namespaceKey = "namespace"
+	providerKey  = "provider"
+	outcomeKey   = "outcome"
+	policyKey    = "policy"
 )
 
 var (
-	req metric.Float64Histogram
+	req            metric.Float64Histogram
+	providerResult metric.Int64Counter
+	policyDenied   metric.Int64Counter
+	admissions     metric.Int64Counter
 	// if service.name is not specified, the default is "unknown_service:<exe name>"
 	// xref: https://opentelemetry.io/docs/reference/specification/resource/semantic_conventions/#service
 	labels = []attribute.KeyValue{attribute.String("service.name", "webhook")}
@@ -29,6 +38,27 @@ func registerMetrics() error {
 	req, err = meter.Float64Histogram(
 		requestDurationMetricName,
 		metric.WithDescription("Distribution of how long it took for the azure-clientid-syncer mutation request"))
+	if err != nil {
+		return err
+	}
+
+	providerResult, err = meter.Int64Counter(
+		providerResultMetricName,
+		metric.WithDescription("Number of provider queries by provider and outcome"))
+	if err != nil {
+		return err
+	}
+
+	policyDenied, err = meter.Int64Counter(
+		policyDeniedMetricName,
+		metric.WithDescription("Number of identities denied by a cluster identity policy"))
+	if err != nil {
+		return err
+	}
+
+	admissions, err = meter.Int64Counter(
+		admissionMetricName,
+		metric.WithDescription("Number of mutation requests by outcome"))
 
 	return err
 }
@@ -37,4 +67,22 @@ func registerMetrics() error {
 func ReportRequest(ctx context.Context, namespace string, duration time.Duration) {
 	l := append(labels, attribute.String(namespaceKey, namespace))
 	req.Record(ctx, duration.Seconds(), metric.WithAttributes(l...))
-}
\ No newline at end of file
+}
+
+// ReportProviderResult reports the outcome of a single provider for the given namespace.
+func ReportProviderResult(ctx context.Context, namespace string, provider string, outcome string) {
+	l := append(labels, attribute.String(namespaceKey, namespace), attribute.String(providerKey, provider), attribute.String(outcomeKey, outcome))
+	providerResult.Add(ctx, 1, metric.WithAttributes(l...))
+}
+
+// ReportPolicyDenied reports an identity of the given provider denied by the given policy for the given namespace.
+func ReportPolicyDenied(ctx context.Context, namespace string, provider string, policy string) {
+	l := append(labels, attribute.String(namespaceKey, namespace), attribute.String(providerKey, provider), attribute.String(policyKey, policy))
+	policyDenied.Add(ctx, 1, metric.WithAttributes(l...))
+}
+
+// ReportAdmission reports the outcome of a mutation request for the given namespace.
+func ReportAdmission(ctx context.Context, namespace string, outcome string) {
+	l := append(labels, attribute.String(namespaceKey, namespace), attribute.String(outcomeKey, outcome))
+	admissions.Add(ctx, 1, metric.WithAttributes(l...))
+}
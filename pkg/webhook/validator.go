@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/kuberneteshelper"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/validate-v1-serviceaccount,mutating=false,failurePolicy=ignore,groups="",resources=serviceaccounts,verbs=create;update,versions=v1,name=validation.azure-clientid-syncer-webhook.io,sideEffects=None,admissionReviewVersions=v1;v1beta1,matchPolicy=Equivalent
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations,verbs=get;list;watch;update
+
+const (
+	// identityMismatchReason is the reason of the events emitted if an identity annotation does not trust the service account
+	identityMismatchReason = "IdentityAnnotationMismatch"
+)
+
+// serviceAccountValidator verifies that manually set identity annotations actually trust the service account
+type serviceAccountValidator struct {
+	client           client.Client
+	kubernetesHelper *kuberneteshelper.KubernetesHelper
+	recorder         record.EventRecorder
+	sharedClients    *provider.SharedClients
+	decoder          *admission.Decoder
+	logger           logr.Logger
+}
+
+// NewServiceAccountValidator returns a service account validation handler. The shared clients may be nil.
+func NewServiceAccountValidator(client client.Client, restConfig *rest.Config, httpClient *http.Client, recorder record.EventRecorder, sharedClients *provider.SharedClients, scheme *runtime.Scheme, log logr.Logger) (admission.Handler, error) {
+	if _, err := config.ParseConfig(); err != nil {
+		return nil, err
+	}
+
+	kubernetesHelper, err := kuberneteshelper.NewKubernetesHelper(restConfig, httpClient, log)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kubernetes helper")
+	}
+
+	return &serviceAccountValidator{
+		client:           client,
+		kubernetesHelper: kubernetesHelper,
+		recorder:         recorder,
+		sharedClients:    sharedClients,
+		logger:           log,
+		decoder:          admission.NewDecoder(scheme),
+	}, nil
+}
+
+// Handle verifies the identity annotations of the service account. Depending on VALIDATION_MODE a mismatch is returned as warning or denies the request.
+// Service accounts which can't be verified, e.g. because the cloud API is unavailable, are always allowed with a warning.
+// Service accounts being deleted and updates which don't change the identity annotations are allowed without verification.
+func (v *serviceAccountValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ctx = tracing.WithAdmissionUID(ctx, string(req.UID))
+	ctx, span := tracing.Start(ctx, "ServiceAccountValidator.Handle", attribute.String("namespace", req.Namespace))
+	defer span.End()
+
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := v.decoder.Decode(req, serviceAccount); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !provider.HasIdentityAnnotations(serviceAccount) {
+		return admission.Allowed("")
+	}
+	// a service account being deleted must not be blocked, e.g. the removal of its finalizers
+	if !serviceAccount.DeletionTimestamp.IsZero() {
+		return admission.Allowed("")
+	}
+	// updates of e.g. labels or finalizers don't change the identity, it has been verified before
+	if req.Operation == admissionv1.Update {
+		oldServiceAccount := &corev1.ServiceAccount{}
+		if err := v.decoder.DecodeRaw(req.OldObject, oldServiceAccount); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if !provider.IdentityAnnotationsChanged(oldServiceAccount, serviceAccount) {
+			return admission.Allowed("")
+		}
+	}
+	v.logger.Info("received request to validate service account", "name", serviceAccount.Name, "namespace", serviceAccount.Namespace)
+
+	c, namespace, status, err := resolveConfig(ctx, v.client, v.kubernetesHelper, v.logger, req.Namespace)
+	if err != nil {
+		return admission.Errored(status, err)
+	}
+
+	queryProvider, err := provider.NewQueryProvider(serviceAccount, v.logger, *c, v.client, true)
+	if err != nil {
+		v.logger.Error(err, "failed to create query provider")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	queryProvider.WithNamespace(namespace).WithSharedClients(v.sharedClients)
+
+	problems, err := queryProvider.Verify(ctx)
+	if err != nil {
+		v.logger.Error(err, "failed to verify service account")
+		return admission.Allowed("").WithWarnings(fmt.Sprintf("identity annotations could not be verified: %s", err))
+	}
+	if len(problems) == 0 {
+		return admission.Allowed("")
+	}
+
+	message := strings.Join(problems, "; ")
+	v.logger.Info("identity annotations do not trust the service account", "name", serviceAccount.Name, "namespace", serviceAccount.Namespace, "problems", problems, "mode", c.ValidationMode)
+	if c.ValidationMode == config.ValidationModeDeny {
+		return admission.Denied(message)
+	}
+	if req.DryRun == nil || !*req.DryRun {
+		v.recorder.Event(serviceAccount, corev1.EventTypeWarning, identityMismatchReason, message)
+	}
+	return admission.Allowed("").WithWarnings(problems...)
+}
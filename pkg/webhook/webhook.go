@@ -3,99 +3,156 @@ package webhook
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/audit"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/config"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/kuberneteshelper"
 	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
-// +kubebuilder:webhook:path=/mutate-v1-serviceaccount,mutating=true,failurePolicy=fail,groups="",resources=serviceaccounts,verbs=create,versions=v1,name=mutation.azure-clientid-syncer-webhook.io,sideEffects=None,admissionReviewVersions=v1;v1beta1,matchPolicy=Equivalent,reinvocationPolicy=IfNeeded
+// +kubebuilder:webhook:path=/mutate-v1-serviceaccount,mutating=true,failurePolicy=fail,groups="",resources=serviceaccounts,verbs=create,versions=v1,name=mutation.azure-clientid-syncer-webhook.io,sideEffects=NoneOnDryRun,admissionReviewVersions=v1;v1beta1,matchPolicy=Equivalent,reinvocationPolicy=IfNeeded
 // +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;update
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=azure.clientid.syncer,resources=identitybindings,verbs=get;list;watch
+// +kubebuilder:rbac:groups=azure.clientid.syncer,resources=identitybindings/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=azure.clientid.syncer,resources=clusteridentitypolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // this is required for the webhook server certs generated and rotated as part of cert-controller rotator
 // +kubebuilder:rbac:groups="",namespace=azure-clientid-syncer-webhook-system,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// this is required for the leader election of the controllers and the inventory
+// +kubebuilder:rbac:groups=coordination.k8s.io,namespace=azure-clientid-syncer-webhook-system,resources=leases,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;list;watch;update
 
+const (
+	// audienceMismatchReason is the reason of the events emitted if a federated identity credential has the wrong audience
+	audienceMismatchReason = "FederatedCredentialAudienceMismatch"
+	// providerWarningReason is the reason of the events emitted for warnings reported by a provider
+	providerWarningReason = "ProviderWarning"
+)
+
 // serviceAccountMutator mutates serviceAccount objects to add clientid and tenantid annotations
 type serviceAccountMutator struct {
 	client client.Client
 	// reader is an instance of mgr.GetAPIReader that is configured to use the API server.
 	// This should be used sparingly and only when the client does not fit the use case.
-	reader  client.Reader
-	config  *config.Config
-	decoder *admission.Decoder
-	logger  logr.Logger
+	reader           client.Reader
+	config           *config.Config
+	kubernetesHelper *kuberneteshelper.KubernetesHelper
+	recorder         record.EventRecorder
+	sharedClients    *provider.SharedClients
+	auditLogger      *audit.Logger
+	decoder          *admission.Decoder
+	logger           logr.Logger
 }
 
-// NewServiceAccountMutator returns a service account mutation handler
-func NewServiceAccountMutator(client client.Client, reader client.Reader, scheme *runtime.Scheme, log logr.Logger) (admission.Handler, error) {
+// NewServiceAccountMutator returns a service account mutation handler. The shared clients and the audit logger may be nil.
+func NewServiceAccountMutator(client client.Client, reader client.Reader, restConfig *rest.Config, httpClient *http.Client, recorder record.EventRecorder, sharedClients *provider.SharedClients, auditLogger *audit.Logger, scheme *runtime.Scheme, log logr.Logger) (admission.Handler, error) {
 	c, err := config.ParseConfig()
 	if err != nil {
 		return nil, err
 	}
 
+	kubernetesHelper, err := kuberneteshelper.NewKubernetesHelper(restConfig, httpClient, log)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kubernetes helper")
+	}
+
 	if err := registerMetrics(); err != nil {
 		return nil, errors.Wrap(err, "failed to register metrics")
 	}
 
 	return &serviceAccountMutator{
-		client:  client,
-		reader:  reader,
-		config:  c,
-		logger:  log,
-		decoder: admission.NewDecoder(scheme),
+		client:           client,
+		reader:           reader,
+		config:           c,
+		kubernetesHelper: kubernetesHelper,
+		recorder:         recorder,
+		sharedClients:    sharedClients,
+		auditLogger:      auditLogger,
+		logger:           log,
+		decoder:          admission.NewDecoder(scheme),
 	}, nil
 }
 
 // serviceAccountMutator adds annotations to service account objects if the service account can be linked to an Azure identity
 func (m *serviceAccountMutator) Handle(ctx context.Context, req admission.Request) (response admission.Response) {
+	ctx = tracing.WithAdmissionUID(ctx, string(req.UID))
+	ctx, span := tracing.Start(ctx, "ServiceAccountMutator.Handle", attribute.String("namespace", req.Namespace), attribute.String("operation", string(req.Operation)))
 	timeStart := time.Now()
 	m.logger.Info("received request to mutate service account")
+	serviceAccount := &corev1.ServiceAccount{}
+	var results []provider.ProviderResult
+	policyEnabled := false
 	defer func() {
 		ReportRequest(ctx, req.Namespace, time.Since(timeStart))
+		ReportAdmission(ctx, req.Namespace, admissionOutcome(response, results))
+		m.audit(req, serviceAccount, results, policyEnabled, response, time.Since(timeStart))
+		span.SetAttributes(attribute.String("name", serviceAccount.Name), attribute.Bool("allowed", response.Allowed))
+		var err error
+		if !response.Allowed && response.Result != nil {
+			err = errors.New(response.Result.Message)
+		}
+		tracing.End(span, err)
 	}()
 
-	serviceAccount := &corev1.ServiceAccount{}
 	err := m.decoder.Decode(req, serviceAccount)
 	if err != nil {
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
-	config, err := config.ParseConfig()
+	config, namespace, status, err := resolveConfig(ctx, m.client, m.kubernetesHelper, m.logger, req.Namespace)
 	if err != nil {
-		m.logger.Error(err, "failed to parse config")
+		return admission.Errored(status, err)
+	}
+
+	queryProvider, err := provider.NewQueryProvider(serviceAccount, m.logger, *config, m.client, req.DryRun != nil && *req.DryRun)
+	if err != nil {
+		m.logger.Error(err, "failed to create query provider")
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
+	queryProvider.WithNamespace(namespace).WithSharedClients(m.sharedClients)
 
-	if config.AutoDetectOidcIssuerUrl {
-		kuberneteshelper, err := kuberneteshelper.NewKubernetesHelper(m.logger)
-		if err != nil {
-			m.logger.Error(err, "failed to create KubernetesHelper")
-			return admission.Errored(http.StatusInternalServerError, err)
-		}
-		config.OidcIssuerUrl, err = kuberneteshelper.GetOidcIssuerUrl()
+	if config.IdentityPolicyEnabled {
+		identityPolicy, policySelected, err := m.identityPolicy(ctx, namespace, serviceAccount)
 		if err != nil {
-			m.logger.Error(err, "failed to get OIDC issuer URL")
+			m.logger.Error(err, "failed to get identity policies")
 			return admission.Errored(http.StatusInternalServerError, err)
 		}
-		m.logger.Info("detected OIDC issuer URL: " + config.OidcIssuerUrl)
+		queryProvider.WithPolicy(identityPolicy, policySelected)
+		policyEnabled = identityPolicy != nil
 	}
 
-	queryProvider, err := provider.NewQueryProvider(serviceAccount, m.logger, *config)
-	if err != nil {
-		m.logger.Error(err, "failed to create query provider")
-		return admission.Errored(http.StatusInternalServerError, err)
+	annotatedServiceAccount, err := queryProvider.Query(ctx)
+	results = queryProvider.Results()
+	var warnings []string
+	for _, result := range results {
+		ReportProviderResult(ctx, req.Namespace, result.Provider, result.Outcome)
+		if result.Outcome == provider.ProviderOutcomeAudienceMismatch {
+			m.recorder.Eventf(serviceAccount, corev1.EventTypeWarning, audienceMismatchReason, "%s: %s", result.Provider, result.Err)
+			warnings = append(warnings, result.Err.Error())
+		}
+		if result.Outcome == provider.ProviderOutcomeDenied {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", result.Provider, result.Err))
+		}
+		for _, warning := range result.Warnings {
+			m.recorder.Eventf(serviceAccount, corev1.EventTypeWarning, providerWarningReason, "%s: %s", result.Provider, warning)
+			warnings = append(warnings, fmt.Sprintf("%s: %s", result.Provider, warning))
+		}
 	}
-	
-	annotatedServiceAccount, err := queryProvider.Query()
 	if err != nil {
 		m.logger.Error(err, "failed to query service account")
 		return admission.Errored(http.StatusInternalServerError, err)
@@ -106,5 +163,40 @@ func (m *serviceAccountMutator) Handle(ctx context.Context, req admission.Reques
 		m.logger.Error(err, "failed to marshal service account")
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledServiceAccount)
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledServiceAccount).WithWarnings(warnings...)
+}
+
+// admissionOutcomeSeverity orders the outcomes of the providers, the most severe one is reported for an admission
+var admissionOutcomeSeverity = map[string]int{
+	provider.ProviderOutcomeSkipped:          0,
+	provider.ProviderOutcomeNotFound:         1,
+	provider.ProviderOutcomeAudienceMismatch: 2,
+	provider.ProviderOutcomeDenied:           3,
+	provider.ProviderOutcomeAmbiguous:        4,
+	provider.ProviderOutcomeError:            5,
+	provider.ProviderOutcomeMatched:          6,
+}
+
+// admissionOutcome summarizes the outcomes of the providers. A request is matched if any provider matched, otherwise
+// the most severe outcome is reported, and skipped if no provider was enabled. A failed request reports the most severe
+// outcome of the providers which failed it, ambiguous or error, and error if no provider explains the failure.
+func admissionOutcome(response admission.Response, results []provider.ProviderResult) string {
+	outcome, failure := provider.ProviderOutcomeSkipped, ""
+	for _, result := range results {
+		if admissionOutcomeSeverity[result.Outcome] > admissionOutcomeSeverity[outcome] {
+			outcome = result.Outcome
+		}
+		if (result.Outcome == provider.ProviderOutcomeError || result.Outcome == provider.ProviderOutcomeAmbiguous) &&
+			admissionOutcomeSeverity[result.Outcome] > admissionOutcomeSeverity[failure] {
+			failure = result.Outcome
+		}
+	}
+	switch {
+	case response.Allowed:
+		return outcome
+	case failure != "":
+		return failure
+	default:
+		return provider.ProviderOutcomeError
+	}
 }
@@ -0,0 +1,45 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/shiftavenue/azure-clientid-syncer/pkg/provider"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestAdmissionOutcome(t *testing.T) {
+	allowed := admission.Allowed("")
+	failed := admission.Errored(http.StatusInternalServerError, errors.New("failed"))
+	results := func(outcomes ...string) []provider.ProviderResult {
+		var results []provider.ProviderResult
+		for _, outcome := range outcomes {
+			results = append(results, provider.ProviderResult{Outcome: outcome})
+		}
+		return results
+	}
+
+	tests := []struct {
+		name     string
+		response admission.Response
+		results  []provider.ProviderResult
+		want     string
+	}{
+		{name: "no providers", response: allowed, want: provider.ProviderOutcomeSkipped},
+		{name: "matched", response: allowed, results: results(provider.ProviderOutcomeNotFound, provider.ProviderOutcomeMatched), want: provider.ProviderOutcomeMatched},
+		{name: "matched beats error", response: allowed, results: results(provider.ProviderOutcomeError, provider.ProviderOutcomeMatched), want: provider.ProviderOutcomeMatched},
+		{name: "most severe", response: allowed, results: results(provider.ProviderOutcomeNotFound, provider.ProviderOutcomeDenied, provider.ProviderOutcomeAudienceMismatch), want: provider.ProviderOutcomeDenied},
+		{name: "failed by ambiguous provider", response: failed, results: results(provider.ProviderOutcomeAmbiguous), want: provider.ProviderOutcomeAmbiguous},
+		{name: "failed by erroring provider", response: failed, results: results(provider.ProviderOutcomeAmbiguous, provider.ProviderOutcomeError), want: provider.ProviderOutcomeError},
+		{name: "failed without explaining provider", response: failed, results: results(provider.ProviderOutcomeMatched), want: provider.ProviderOutcomeError},
+		{name: "failed before the providers", response: failed, want: provider.ProviderOutcomeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := admissionOutcome(tt.response, tt.results); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -90,6 +90,13 @@ az role assignment create \
   --assignee-principal-type ServicePrincipal \
   --scope subscriptions/$SUBSCRIPTION_ID
 
+# required to provision federated identity credentials
+az role assignment create \
+  --role "Managed Identity Contributor" \
+  --assignee-object-id $IDENTITY_PRINCIPAL_ID \
+  --assignee-principal-type ServicePrincipal \
+  --scope subscriptions/$SUBSCRIPTION_ID/resourceGroups/$RG
+
 az aks get-credentials --resource-group $RG --name $CLUSTER
 
 cat <<EOF >values.yaml
@@ -97,6 +104,9 @@ config:
   azure:
     tenantID: "$TENANT_ID"
     enabled: true
+    provisioning:
+      enabled: true
+      identityAllowlist: "/subscriptions/$SUBSCRIPTION_ID/resourceGroups/$RG/providers/Microsoft.ManagedIdentity/userAssignedIdentities/*"
   # filterTags: "aks-clientid-syncer:true,namespace:<NAMESPACE>,serviceaccountname:<SERVICE_ACCOUNT_NAME>"
 podLabels:
   azure.workload.identity/use: "true"
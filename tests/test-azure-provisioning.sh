@@ -0,0 +1,68 @@
+#! /bin/bash -e
+set -x
+
+# read output.json file and set variables
+source $(realpath $(dirname "$0"))/../.env
+az aks get-credentials --resource-group $RG --name $CLUSTER
+apt-get update && apt-get install -y jq
+
+TEST_IDENTITY_NAME=testprovisioning
+
+TEST_IDENTITY_CLIENT_ID="$(az identity create \
+  --resource-group $RG \
+  --name $TEST_IDENTITY_NAME \
+  --query clientId -otsv)"
+
+TEST_IDENTITY_ID="$(az identity show \
+  --resource-group $RG \
+  --name $TEST_IDENTITY_NAME \
+  --query id -otsv)"
+
+for run in {1..10}; do
+  az identity list --resource-group $RG | grep $TEST_IDENTITY_CLIENT_ID
+  if [[ $? -eq 0 ]]; then
+    echo "identity found in list"
+    break
+  fi
+  echo "waiting for identity to appear in list"
+  sleep 6
+done
+
+kubectl apply -f - <<EOT
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: testprovisioning
+  labels:
+    azure.clientid.syncer/use: "true"
+  annotations:
+    azure.clientid.syncer/identity-resource-id: "$TEST_IDENTITY_ID"
+EOT
+
+if [[ $(kubectl get sa -ojson testprovisioning | jq -r '.metadata.annotations."azure.workload.identity/client-id"') != $TEST_IDENTITY_CLIENT_ID ]]; then
+  echo "Service account testprovisioning does not have the correct client id"
+  exit 1
+fi
+
+if [[ $(az identity federated-credential list \
+  --identity-name $TEST_IDENTITY_NAME \
+  --resource-group $RG \
+  --query "[?issuer=='$ISSUER' && subject=='system:serviceaccount:default:testprovisioning'] | length(@)") != 1 ]]; then
+  echo "No federated identity credential has been provisioned for service account testprovisioning"
+  exit 1
+fi
+
+kubectl delete sa testprovisioning --timeout=60s
+
+if [[ $(az identity federated-credential list \
+  --identity-name $TEST_IDENTITY_NAME \
+  --resource-group $RG \
+  --query "[?issuer=='$ISSUER' && subject=='system:serviceaccount:default:testprovisioning'] | length(@)") != 0 ]]; then
+  echo "The provisioned federated identity credential has not been deleted with service account testprovisioning"
+  exit 1
+fi
+
+set +x
+echo "###################################################"
+echo "####### succeeded azure provisioning ##############"
+echo "###################################################"